@@ -4,6 +4,7 @@
 # vammultipl (06-10-2024)
 # https://github.com/vammultipl/vammultiplayer_revamped
 
+import ipaddress
 import socket
 import threading
 import sys
@@ -25,7 +26,9 @@ class VAMMultiplayerServer:
     def __init__(self, host, port):
         self.host = host
         self.port = port
-        self.sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        # Dual-stack socket: accepts IPv6 and IPv4 (as IPv4-mapped IPv6) clients
+        self.sock = socket.socket(socket.AF_INET6, socket.SOCK_STREAM)
+        self.sock.setsockopt(socket.IPPROTO_IPV6, socket.IPV6_V6ONLY, 0)
         # Set TCP_NODELAY to disable Nagle's algorithm
         self.sock.setsockopt(socket.IPPROTO_TCP, socket.TCP_NODELAY, 1)
         self.sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
@@ -42,18 +45,25 @@ class VAMMultiplayerServer:
         self.sock.listen(USERS_LIMIT)  # Limit number of users connected
         while True:
             client, address = self.sock.accept()
-            logging.info(f"New connection from {address[0]}:{address[1]}")
+            # Report IPv4 clients with their plain IPv4 address
+            address = (self.client_ip(address[0]), address[1])
             # Load IP allowlist fresh
             allowlist = self.load_allowlist('allowlist.txt')
-            if address[0] not in allowlist:
-                logging.info(f"Connection from {address[0]}:{address[1]} rejected: IP not in allowlist")
+            allowed = self.is_allowed(address[0], allowlist)
+            if not allowed and ipaddress.ip_address(address[0]).is_loopback:
+                # The Discord bot's watchdog checking that the port is open, not a player
+                client.close()
+                continue
+            logging.info(f"New connection from {self.format_address(address)}")
+            if not allowed:
+                logging.info(f"Connection from {self.format_address(address)} rejected: IP not in allowlist")
                 client.close()
                 continue
             client.settimeout(90)
             threading.Thread(target=self.client_connection, args=(client, address)).start()
 
     def client_connection(self, client, address):
-        key = f"{address[0]}:{address[1]}"
+        key = self.format_address(address)
         # Last saved partial message (when recv() didnt get the whole message)
         saved_partial_message = b''
         try:
@@ -88,23 +98,46 @@ class VAMMultiplayerServer:
                             self.handle_request(client, msg, address)
 
         except Exception as e:
-            logging.info(f"Error from {address[0]}:{address[1]} :{e}")
+            logging.info(f"Error from {self.format_address(address)} :{e}")
         finally:
             self.handle_disconnect(client, address)
             client.close()
 
     def load_allowlist(self, filename):
-        allowlist = set()
+        # Entries are single IPv4/IPv6 addresses or CIDR ranges, followed by a timestamp
+        allowlist = []
         try:
             with open(filename, 'r') as file:
                 for line in file:
                     parts = line.strip().split()
                     if len(parts) == 2:
-                        allowlist.add(parts[0])
+                        try:
+                            allowlist.append(ipaddress.ip_network(parts[0], strict=False))
+                        except ValueError:
+                            logging.error(f"Invalid allowlist entry {parts[0]}")
         except FileNotFoundError:
             logging.error(f"Allowlist file {filename} not found.")
         return allowlist
 
+    def is_allowed(self, ip, allowlist):
+        try:
+            address = ipaddress.ip_address(ip)
+        except ValueError:
+            return False
+        return any(address in network for network in allowlist)
+
+    def client_ip(self, ip):
+        address = ipaddress.ip_address(ip.split('%')[0])
+        if address.version == 6 and address.ipv4_mapped:
+            return str(address.ipv4_mapped)
+        return str(address)
+
+    def format_address(self, address):
+        # IPv6 addresses are bracketed so the port can be told apart: [2001:db8::1]:5000
+        if ':' in address[0]:
+            return f"[{address[0]}]:{address[1]}"
+        return f"{address[0]}:{address[1]}"
+
     def parse_initial_frame(self, data):
         # Extract version information
         major, minor, patch = struct.unpack('BBB', data[len(MAGIC_NUMBER):len(MAGIC_NUMBER)+3])
@@ -125,7 +158,7 @@ class VAMMultiplayerServer:
 
     def handle_request(self, client, request, address):
         # key for hashmaps involving user (IP:port)
-        key = f"{address[0]}:{address[1]}"
+        key = self.format_address(address)
 
         # Check if it is initial frame
         if len(request) >= len(MAGIC_NUMBER) + 3: # 3 bytes for version
@@ -276,7 +309,7 @@ class VAMMultiplayerServer:
 
     def handle_disconnect(self, client, address):
         # Log disconnect details
-        key = f"{address[0]}:{address[1]}"
+        key = self.format_address(address)
         logging.info(f"Client disconnected from {key}")
 
         with self.lock:
@@ -315,7 +348,7 @@ class VAMMultiplayerServer:
             f.write(f"{timestamp};{state}\n")
 
 def main():
-    host = "0.0.0.0"
+    host = "::"
     port = 8888  # Default port
     logging.basicConfig(level=logging.DEBUG,
                         format='%(asctime)s - %(levelname)s - %(message)s',
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	adminRoleIDs []string // IDs of the Discord roles allowed to use /admin (optional)
+
+	maxReplyLength = 1900 // stay below Discord's 2000 character message limit
+)
+
+// isAdmin reports whether userID has one of the admin roles in the guild.
+func isAdmin(s discordAPI, userID string) bool {
+	roles := adminRoles()
+	if len(roles) == 0 {
+		return false
+	}
+	member, err := s.GuildMember(guildID, userID)
+	if err != nil {
+		log.Printf("Error fetching guild member %s: %v", userID, err)
+		return false
+	}
+	for _, adminRole := range roles {
+		if hasRole(member, adminRole) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminCommand processes the /admin <subcommand> commands, available to
+// members with one of the admin_roles from the config.
+func handleAdminCommand(c *commandContext) {
+	// Replies contain full IPs, keep them out of public channels
+	if !c.isDM && c.messageID != "" {
+		c.reply("Use /admin as a slash command or via DM.", true)
+		return
+	}
+	if !isAdmin(c.s, c.userID) {
+		log.Printf("Admin command denied for %s", c.username)
+		c.reply("You are not allowed to use admin commands.", true)
+		return
+	}
+	if len(c.args) < 2 {
+		c.reply(adminUsage, true)
+		return
+	}
+
+	switch c.args[1] {
+	case "registrations":
+		handleAdminRegistrations(c)
+	case "revoke":
+		handleAdminRevoke(c)
+	case "extend":
+		handleAdminExtend(c)
+	case "ban":
+		handleAdminBan(c)
+	case "unban":
+		handleAdminUnban(c)
+	case "bans":
+		handleAdminBans(c)
+	case "audit":
+		handleAdminAudit(c)
+	default:
+		c.reply(adminUsage, true)
+	}
+}
+
+const adminUsage = "Admin commands:\n" +
+	"`/admin registrations [user]` - List registrations of a user or everyone.\n" +
+	"`/admin revoke <user>` - Remove all registrations of a user.\n" +
+	"`/admin extend <user> <days>` - Push back the expiry of a user's registrations.\n" +
+	"`/admin ban <user|IP|range> [IP|range] [reason] [duration]` - Remove the registrations of a user, an IP or both and keep them from registering, e.g. `/admin ban alice 1.2.3.0/24 spamming 7d`. Permanent without a duration.\n" +
+	"`/admin unban <user|IP|range>` - Lift the bans of a user or an IP.\n" +
+	"`/admin bans` - List active bans and their reasons.\n" +
+	"`/admin audit [user]` - Show the latest registration and moderation actions of a user or everyone."
+
+// adminTarget resolves the user an admin command is about to their unique
+// username. Users who left the guild can still be given by unique username.
+func adminTarget(c *commandContext, identifier string) string {
+	user, err := findUserInGuild(c.s, guildID, identifier)
+	if err != nil {
+		return identifier
+	}
+	return user.Username
+}
+
+func handleAdminRegistrations(c *commandContext) {
+	registrations, err := store.AllRegistrations()
+	if err != nil {
+		log.Printf("Error reading registrations: %v", err)
+		c.reply("Failed to read registrations.", true)
+		return
+	}
+
+	owners := make(map[string][]string) // IP -> users who registered it
+	for _, r := range registrations {
+		owners[r.IP] = append(owners[r.IP], r.Username)
+	}
+
+	var username string
+	if len(c.args) >= 3 {
+		username = adminTarget(c, c.args[2])
+		registrations = userRegistrations(registrations, username)
+	}
+	if len(registrations) == 0 {
+		if username != "" {
+			c.reply(fmt.Sprintf("%s has no registrations.", username), true)
+		} else {
+			c.reply("Nobody is registered.", true)
+		}
+		return
+	}
+
+	lines := []string{fmt.Sprintf("%d registrations:", len(registrations))}
+	for _, r := range registrations {
+		line := fmt.Sprintf("- %s (%s): %s, expires <t:%d:R>", r.Username, r.Device, r.IP, registrationExpiry(r).Unix())
+		if len(owners[r.IP]) > 1 {
+			line += ", shared with " + strings.Join(removeFromSlice(owners[r.IP], r.Username), ", ")
+		}
+		lines = append(lines, line)
+	}
+	if username != "" {
+		bans, _ := store.Bans()
+		for _, ban := range bans {
+			if ban.Username == username && ban.active(time.Now()) {
+				lines = append(lines, "Banned: "+describeBan(ban))
+			}
+		}
+	}
+	c.reply(truncateLines(lines, maxReplyLength), true)
+}
+
+func handleAdminRevoke(c *commandContext) {
+	if len(c.args) < 3 {
+		c.reply("Usage: /admin revoke <user>", true)
+		return
+	}
+	username := adminTarget(c, c.args[2])
+
+	removed, dropped, err := store.RevokeUser(username)
+	if err != nil {
+		log.Printf("Error revoking registrations of %s: %v", username, err)
+		c.reply("Failed to revoke registrations.", true)
+		return
+	}
+	if len(removed) == 0 {
+		c.reply(fmt.Sprintf("%s has no registrations.", username), true)
+		return
+	}
+
+	log.Printf("Admin %s revoked the registrations of %s", c.username, username)
+	auditRemoved("revoke", c.username, "", removed)
+	c.reply(fmt.Sprintf("Revoked the registrations of %s.\n%s", username, describeRevoked(removed, dropped)), true)
+}
+
+func handleAdminExtend(c *commandContext) {
+	if len(c.args) < 4 {
+		c.reply("Usage: /admin extend <user> <days>", true)
+		return
+	}
+	days, err := strconv.Atoi(c.args[3])
+	if err != nil || days < 1 || days > 365 {
+		c.reply("Please give the number of days as a whole number between 1 and 365.", true)
+		return
+	}
+	username := adminTarget(c, c.args[2])
+
+	extended, err := store.ExtendRegistrations(username, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Printf("Error extending registrations of %s: %v", username, err)
+		c.reply("Failed to extend registrations.", true)
+		return
+	}
+	if len(extended) == 0 {
+		c.reply(fmt.Sprintf("%s has no registrations.", username), true)
+		return
+	}
+
+	log.Printf("Admin %s extended the registrations of %s by %d days", c.username, username, days)
+	lines := []string{fmt.Sprintf("Extended the registrations of %s by %d days. Usernames mapping updated:", username, days)}
+	for _, r := range extended {
+		recordAudit(AuditEvent{Action: "extend", Actor: c.username, Target: username, IP: r.IP, Device: r.Device, Detail: fmt.Sprintf("by %d days", days)})
+		lines = append(lines, fmt.Sprintf("- %s (%s) now expires <t:%d:f>", r.IP, r.Device, registrationExpiry(r).Unix()))
+	}
+	c.reply(truncateLines(lines, maxReplyLength), true)
+}
+
+func handleAdminBan(c *commandContext) {
+	if len(c.args) < 3 {
+		c.reply("Usage: /admin ban <user|IP|range> [IP|range] [reason] [duration]", true)
+		return
+	}
+	now := time.Now()
+	ban := Ban{By: c.username, Created: now}
+
+	// A member can be banned together with an IP or range given right after them
+	rest := c.args[3:]
+	if prefix, err := parseRegistrationAddress(c.args[2]); err == nil {
+		ban.IP = allowlistEntry(prefix)
+	} else {
+		// Someone who isn't on the server is banned by their user ID or username
+		if user, err := findUserInGuild(c.s, guildID, c.args[2]); err == nil {
+			ban.UserID, ban.Username = user.ID, user.Username
+		} else if isSnowflake(c.args[2]) {
+			ban.UserID = c.args[2]
+		} else {
+			ban.Username = c.args[2]
+		}
+		if len(rest) > 0 {
+			if prefix, err := parseRegistrationAddress(rest[0]); err == nil {
+				ban.IP = allowlistEntry(prefix)
+				rest = rest[1:]
+			}
+		}
+	}
+
+	if c.options != nil {
+		// Slash commands name the reason and duration, so neither is guessed
+		ban.Reason = strings.TrimSpace(c.options["reason"])
+		if text := strings.TrimSpace(c.options["duration"]); text != "" {
+			d, err := parseBanDuration(text)
+			if err != nil {
+				c.reply(fmt.Sprintf("%q is not a duration, use e.g. 12h or 7d.", text), true)
+				return
+			}
+			ban.Until = now.Add(d)
+		}
+	} else {
+		// The duration is optional and comes last, everything in between is the reason
+		if len(rest) > 0 {
+			if d, err := parseBanDuration(rest[len(rest)-1]); err == nil {
+				ban.Until = now.Add(d)
+				rest = rest[:len(rest)-1]
+			}
+		}
+		ban.Reason = strings.Join(rest, " ")
+	}
+
+	if err := store.AddBan(ban); err != nil {
+		log.Printf("Error banning %s: %v", describeBanTarget(ban), err)
+		c.reply("Failed to save the ban.", true)
+		return
+	}
+	// Banned IPs leave the allowlist right away instead of at the next cleanup
+	removed, dropped := enforceBan(ban)
+
+	log.Printf("Admin %s banned %s", c.username, describeBanTarget(ban))
+	recordAudit(AuditEvent{Action: "ban", Actor: c.username, Target: ban.Username, IP: ban.IP, Detail: banAuditDetail(ban)})
+	auditRemoved("revoke", c.username, "banned", removed)
+	summary := "Banned " + describeBan(ban)
+	if len(removed) == 0 {
+		summary += "\nNo registrations were affected, the allowlist is unchanged."
+	} else {
+		summary += "\n" + describeRevoked(removed, dropped)
+	}
+	c.reply(summary, true)
+}
+
+func handleAdminUnban(c *commandContext) {
+	if len(c.args) < 3 {
+		c.reply("Usage: /admin unban <user|IP|range>", true)
+		return
+	}
+
+	// Members who left the guild can be unbanned by their user ID or username from /admin bans
+	target := c.args[2]
+	if prefix, err := parseRegistrationAddress(target); err == nil {
+		target = allowlistEntry(prefix)
+	} else if user, err := findUserInGuild(c.s, guildID, target); err == nil {
+		target = user.ID
+	}
+
+	lifted, err := store.RemoveBan(target)
+	if err != nil {
+		log.Printf("Error unbanning %s: %v", target, err)
+		c.reply("Failed to lift the ban.", true)
+		return
+	}
+	if len(lifted) == 0 {
+		c.reply(fmt.Sprintf("%s is not banned.", c.args[2]), true)
+		return
+	}
+
+	lines := []string{"Lifted bans:"}
+	for _, ban := range lifted {
+		log.Printf("Admin %s unbanned %s", c.username, describeBanTarget(ban))
+		recordAudit(AuditEvent{Action: "unban", Actor: c.username, Target: ban.Username, IP: ban.IP})
+		lines = append(lines, "- "+describeBan(ban))
+	}
+	c.reply(truncateLines(lines, maxReplyLength), true)
+}
+
+func handleAdminBans(c *commandContext) {
+	bans, err := store.Bans()
+	if err != nil {
+		log.Printf("Error reading bans: %v", err)
+		c.reply("Failed to read bans.", true)
+		return
+	}
+
+	now := time.Now()
+	var lines []string
+	for _, ban := range bans {
+		if ban.active(now) {
+			lines = append(lines, "- "+describeBan(ban))
+		}
+	}
+	if len(lines) == 0 {
+		c.reply("Nobody is banned.", true)
+		return
+	}
+	lines = append([]string{fmt.Sprintf("%d active bans:", len(lines))}, lines...)
+	c.reply(truncateLines(lines, maxReplyLength), true)
+}
+
+// describeRevoked reports which registrations were removed from the usernames
+// mapping and which IPs dropped off the allowlist.
+func describeRevoked(removed []Registration, dropped []string) string {
+	var entries []string
+	for _, r := range removed {
+		entries = append(entries, fmt.Sprintf("%s (%s)", r.IP, r.Device))
+	}
+	message := "Removed from usernames mapping: " + strings.Join(entries, ", ") + "."
+	if len(dropped) == 0 {
+		return message + "\nRemoved from allowlist: none, the IPs are still registered by other users."
+	}
+	message += "\nRemoved from allowlist: " + strings.Join(dropped, ", ") + "."
+	if len(dropped) < len(removed) {
+		message += " The other IPs are still registered by other users."
+	}
+	return message
+}
+
+// truncateLines joins lines, leaving out the ones that don't fit in max characters.
+func truncateLines(lines []string, max int) string {
+	var b strings.Builder
+	for i, line := range lines {
+		if b.Len()+len(line)+1 > max {
+			fmt.Fprintf(&b, "...and %d more", len(lines)-i)
+			break
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestAdminCommands(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "mod", "")
+	b.fake.addMember("2", "alice", "Ally")
+	b.fake.addMember("3", "bob", "")
+	b.fake.setRoles("1", "moderators")
+	adminRoleIDs = []string{"moderators"}
+
+	run := func(userID, username, text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command(userID, username, true, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "alice", "laptop", time.Now())
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+
+	if got := run("3", "bob", "/admin registrations"); !strings.Contains(got, "not allowed") {
+		t.Errorf("/admin by a non-moderator = %q", got)
+	}
+	if got := run("1", "mod", "/admin registrations"); !strings.Contains(got, "3 registrations") {
+		t.Errorf("/admin registrations = %q", got)
+	}
+	got := run("1", "mod", "/admin registrations Ally")
+	for _, want := range []string{"2 registrations", "alice (laptop): 9.9.9.9", "shared with bob"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/admin registrations Ally = %q, want it to contain %q", got, want)
+		}
+	}
+
+	if got := run("1", "mod", "/admin extend alice 0"); !strings.Contains(got, "between 1 and 365") {
+		t.Errorf("/admin extend with 0 days = %q", got)
+	}
+	if got := run("1", "mod", "/admin extend alice 3"); !strings.Contains(got, "by 3 days") {
+		t.Errorf("/admin extend = %q", got)
+	}
+
+	got = run("1", "mod", "/admin ban Ally spamming rooms 7d")
+	for _, want := range []string{"Banned alice (2), banned by mod until", ": spamming rooms", "Removed from usernames mapping: 8.8.8.8 (default), 9.9.9.9 (laptop)", "Removed from allowlist: 8.8.8.8."} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/admin ban = %q, want it to contain %q", got, want)
+		}
+	}
+	if user, _ := usernameOf(store, "9.9.9.9"); user != "bob" {
+		t.Errorf("9.9.9.9 registered to %q after the ban, want bob", user)
+	}
+	// The ban follows the user ID, the reason is only for moderators
+	if got := run("2", "alice_renamed", "/register 8.8.8.8"); !strings.Contains(got, "You are banned") || strings.Contains(got, "spamming") {
+		t.Errorf("/register while banned = %q", got)
+	}
+	if got := run("1", "mod", "/admin bans"); !strings.Contains(got, "1 active bans") || !strings.Contains(got, "spamming rooms") {
+		t.Errorf("/admin bans = %q", got)
+	}
+
+	if got := run("1", "mod", "/admin unban alice"); !strings.Contains(got, "Lifted bans") {
+		t.Errorf("/admin unban = %q", got)
+	}
+	if got := run("2", "alice", "/register 8.8.8.8"); !strings.Contains(got, "successfully registered") {
+		t.Errorf("/register after unban = %q", got)
+	}
+}
+
+func TestAdminBanIP(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "mod", "")
+	b.fake.addMember("3", "carol", "")
+	b.fake.setRoles("1", "moderators")
+	adminRoleIDs = []string{"moderators"}
+
+	run := func(userID, username, text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command(userID, username, true, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+	got := run("1", "mod", "/admin ban 9.9.9.0/24")
+	if !strings.Contains(got, "9.9.9.0/24, banned by mod permanently") || !strings.Contains(got, "Removed from allowlist: 9.9.9.9.") {
+		t.Errorf("/admin ban of a range = %q", got)
+	}
+	if got := run("3", "carol", "/register 9.9.9.10"); !strings.Contains(got, "This IP address is banned") {
+		t.Errorf("/register of a banned IP = %q", got)
+	}
+	if got := run("3", "carol", "/register 9.9.0.0/16"); !strings.Contains(got, "This IP address is banned") {
+		t.Errorf("/register of a range overlapping a banned one = %q", got)
+	}
+	if got := run("3", "carol", "/register 8.8.8.8"); !strings.Contains(got, "successfully registered") {
+		t.Errorf("/register of another IP = %q", got)
+	}
+
+	// Bans added to bans.txt by hand are enforced at cleanup
+	store.AddBan(Ban{IP: "8.8.8.8", By: "operator", Created: time.Now()})
+	enforceBans(time.Now())
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Errorf("8.8.8.8 still registered after enforceBans")
+	}
+
+	// Slash commands take the reason and duration from their options, so a
+	// reason ending in something like a duration stays the reason
+	ban := func(options ...*discordgo.ApplicationCommandInteractionDataOption) {
+		runSlashCommand(b, "", discordgo.ApplicationCommandInteractionData{Name: "admin", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: "ban", Type: discordgo.ApplicationCommandOptionSubCommand, Options: options},
+		}})
+	}
+	option := func(name, value string) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionString, Value: value}
+	}
+	ban(option("user", "carol"), option("reason", "spamming for 7d"))
+	bans, _ := store.Bans()
+	if last := bans[len(bans)-1]; last.Username != "carol" || last.IP != "" || last.Reason != "spamming for 7d" || !last.Until.IsZero() {
+		t.Errorf("ban = %+v", last)
+	}
+	ban(option("user", "carol"), option("duration", "2d"))
+	bans, _ = store.Bans()
+	if last := bans[len(bans)-1]; last.Reason != "" || last.Until.IsZero() {
+		t.Errorf("ban with a duration = %+v", last)
+	}
+	ban(option("user", "carol"), option("duration", "forever"))
+	if edit := b.fake.edits[len(b.fake.edits)-1]; !strings.Contains(*edit.Content, `"forever" is not a duration`) {
+		t.Errorf("reply to an invalid duration = %q", *edit.Content)
+	}
+}
+
+func TestAdminBanUserNotInGuild(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "mod", "")
+	b.fake.setRoles("1", "moderators")
+	adminRoleIDs = []string{"moderators"}
+
+	run := func(text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command("1", "mod", true, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	// eve registered before she left the server
+	if err := registerIP("5.5.5.5", "424242", "eve", defaultDevice); err != nil {
+		t.Fatal(err)
+	}
+	if got := run("/admin ban 424242 alt account"); !strings.Contains(got, "Banned 424242, banned by mod permanently: alt account") || !strings.Contains(got, "5.5.5.5") {
+		t.Errorf("/admin ban by user ID = %q", got)
+	}
+	if all, _ := store.AllRegistrations(); len(deriveAllowlist(all)) != 0 {
+		t.Errorf("allowlist after the user ID ban = %+v", deriveAllowlist(all))
+	}
+	if got := run("/admin ban mallory"); !strings.Contains(got, "Banned mallory, banned by mod") {
+		t.Errorf("/admin ban by username = %q", got)
+	}
+	if _, banned := findBan("424242", "someone", "", time.Now()); !banned {
+		t.Errorf("user ID ban not found")
+	}
+	if ban, banned := findBan("7", "mallory", "", time.Now()); !banned || !strings.Contains(banMessage(ban), "You are banned") {
+		t.Errorf("username ban = %+v, %v", ban, banned)
+	}
+
+	if got := run("/admin unban mallory"); !strings.Contains(got, "Lifted bans") {
+		t.Errorf("/admin unban by username = %q", got)
+	}
+	if _, banned := findBan("7", "mallory", "", time.Now()); banned {
+		t.Errorf("mallory still banned")
+	}
+}
+
+func TestParseBanDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		ok   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"12h", 12 * time.Hour, true},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"spamming", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBanDuration(tt.text)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBanDuration(%q) = %v, %v", tt.text, got, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// rangeRequest is a CIDR range registration waiting for a moderator. Requests
+// are kept in memory only, after a restart the member has to ask again.
+type rangeRequest struct {
+	ID        string
+	UserID    string
+	Username  string
+	Device    string
+	Prefix    netip.Prefix
+	Requested time.Time
+}
+
+var (
+	pendingRangesMutex sync.Mutex
+	pendingRanges      = make(map[string]*rangeRequest) // request ID -> request
+	rangeRequestTTL    = 24 * time.Hour                 // unanswered requests are dropped after this
+)
+
+// Custom IDs of the approval buttons, followed by the request ID.
+const (
+	rangeApprovePrefix = "range_approve:"
+	rangeDenyPrefix    = "range_deny:"
+)
+
+// requestRangeApproval asks the moderators to approve a CIDR range registration.
+func requestRangeApproval(c *commandContext, prefix netip.Prefix, device string) {
+	channelID := moderatorChannel()
+	if channelID == "" {
+		c.reply("Registering IP ranges is not enabled on this server. Please register a single IP address.", true)
+		return
+	}
+
+	request := &rangeRequest{
+		ID:        newRequestID(),
+		UserID:    c.userID,
+		Username:  c.username,
+		Device:    device,
+		Prefix:    prefix,
+		Requested: time.Now(),
+	}
+
+	pendingRangesMutex.Lock()
+	for id, pending := range pendingRanges {
+		if time.Since(pending.Requested) > rangeRequestTTL {
+			delete(pendingRanges, id)
+		}
+	}
+	pendingRanges[request.ID] = request
+	pendingRangesMutex.Unlock()
+
+	_, err := c.s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("%s (%s) asks to register the range %s (%d addresses).",
+			request.Username, request.UserID, request.Prefix, rangeSize(request.Prefix)),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Approve", Style: discordgo.SuccessButton, CustomID: rangeApprovePrefix + request.ID},
+				discordgo.Button{Label: "Deny", Style: discordgo.DangerButton, CustomID: rangeDenyPrefix + request.ID},
+			}},
+		},
+	})
+	if err != nil {
+		log.Println("Error posting range request to moderators:", err)
+		pendingRangesMutex.Lock()
+		delete(pendingRanges, request.ID)
+		pendingRangesMutex.Unlock()
+		c.reply("Failed to send your request to the moderators, please try again later.", true)
+		return
+	}
+
+	log.Printf("Range %s requested by %s", request.Prefix, request.Username)
+	c.reply(fmt.Sprintf("Your request to register %s was sent to the moderators. You will get a DM once it is reviewed.", request.Prefix), true)
+}
+
+// handleComponentInteraction handles button clicks.
+func handleComponentInteraction(s discordAPI, i *discordgo.InteractionCreate) {
+	customID := i.MessageComponentData().CustomID
+	switch {
+	case strings.HasPrefix(customID, rangeApprovePrefix):
+		handleRangeDecision(s, i, strings.TrimPrefix(customID, rangeApprovePrefix), true)
+	case strings.HasPrefix(customID, rangeDenyPrefix):
+		handleRangeDecision(s, i, strings.TrimPrefix(customID, rangeDenyPrefix), false)
+	case strings.HasPrefix(customID, renewPrefix):
+		handleRenewButton(s, i, strings.TrimPrefix(customID, renewPrefix))
+	}
+}
+
+// handleRangeDecision applies a moderator's decision on a range request and
+// replaces the buttons with the outcome.
+func handleRangeDecision(s discordAPI, i *discordgo.InteractionCreate, id string, approved bool) {
+	// Anyone who can see the moderator channel can click, only admins decide
+	if i.Member == nil || i.Member.User == nil || !isAdmin(s, i.Member.User.ID) {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Only admins can approve or deny range requests.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.Println("Error responding to interaction:", err)
+		}
+		return
+	}
+	moderator := i.Member.User.Username
+
+	pendingRangesMutex.Lock()
+	request, ok := pendingRanges[id]
+	delete(pendingRanges, id)
+	pendingRangesMutex.Unlock()
+
+	var outcome, dm string
+	switch {
+	case !ok:
+		outcome = "This request has expired or was already handled."
+	case !approved:
+		outcome = fmt.Sprintf("Range %s for %s denied by %s.", request.Prefix, request.Username, moderator)
+		recordAudit(AuditEvent{Action: "deny_range", Actor: moderator, Target: request.Username, IP: request.Prefix.String(), Device: request.Device})
+		dm = fmt.Sprintf("Your request to register %s was denied. Please register a single IP address instead.", request.Prefix)
+	default:
+		// The member may have left or lost the role while the request waited
+		err := checkEligibility(s, request.UserID, time.Now())
+		if err == nil {
+			err = registerIP(allowlistEntry(request.Prefix), request.UserID, request.Username, request.Device)
+		}
+		if err != nil {
+			outcome = fmt.Sprintf("Failed to register range %s for %s: %v", request.Prefix, request.Username, err)
+			dm = fmt.Sprintf("Your IP range %s was approved but could not be registered: %s", request.Prefix, registerErrorMessage(err))
+			break
+		}
+		log.Printf("Registered range %s for %s, approved by %s", request.Prefix, request.Username, moderator)
+		recordAudit(AuditEvent{Action: "approve_range", Actor: moderator, Target: request.Username, IP: request.Prefix.String(), Device: request.Device})
+		outcome = fmt.Sprintf("Range %s for %s approved by %s.", request.Prefix, request.Username, moderator)
+		dm = fmt.Sprintf("Your IP range %s has been approved and registered%s. You can now connect to the game.", request.Prefix, deviceSuffix(request.Device))
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    outcome,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		log.Println("Error responding to interaction:", err)
+	}
+
+	if dm != "" {
+		sendUserDM(s, request.UserID, dm)
+	}
+}
+
+// sendUserDM sends a direct message to a user by ID.
+func sendUserDM(s discordAPI, userID, message string) error {
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		log.Printf("Failed to create DM channel for %s: %v", userID, err)
+		return err
+	}
+	if _, err := s.ChannelMessageSend(channel.ID, message); err != nil {
+		log.Printf("Failed to send DM to %s: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+// rangeSize returns the number of addresses in a range, capped for large IPv6 ranges.
+func rangeSize(prefix netip.Prefix) uint64 {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 64 {
+		return 1<<64 - 1
+	}
+	return 1 << hostBits
+}
+
+// newRequestID returns a random ID for a pending request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// clickButton simulates a moderator clicking a button with the given custom ID.
+func clickButton(b *testBot, customID string) {
+	clickButtonAs(b, "99", "mod", customID)
+}
+
+func clickButtonAs(b *testBot, userID, username, customID string) {
+	interactionCreate(b.fake, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:    discordgo.InteractionMessageComponent,
+		GuildID: "guild",
+		Member:  &discordgo.Member{User: &discordgo.User{ID: userID, Username: username}},
+		Data:    discordgo.MessageComponentInteractionData{CustomID: customID},
+	}}, "bot-channel")
+}
+
+// requestRange registers a range as alice and returns the approve and deny button
+// IDs. The moderator mod may decide on it.
+func requestRange(t *testing.T, b *testBot) (approve, deny string) {
+	t.Helper()
+	b.fake.addMember("99", "mod", "")
+	b.fake.setRoles("99", "moderators")
+	adminRoleIDs = []string{"moderators"}
+	var replies []string
+	handleRegisterCommand(b.command("1", "alice", true, "/register 8.8.8.0/28", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "sent to the moderators") {
+		t.Fatalf("replies = %q", replies)
+	}
+	if len(b.fake.complexMessages) != 1 {
+		t.Fatalf("moderator messages = %d, want 1", len(b.fake.complexMessages))
+	}
+	row := b.fake.complexMessages[0].Components[0].(discordgo.ActionsRow)
+	return row.Components[0].(discordgo.Button).CustomID, row.Components[1].(discordgo.Button).CustomID
+}
+
+func TestRangeRegistrationApproved(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	moderatorChannelID = "mods"
+
+	approve, _ := requestRange(t, b)
+	if got := b.fake.sentTo("mods"); len(got) != 1 || !strings.Contains(got[0], "8.8.8.0/28") {
+		t.Errorf("moderator channel got %q", got)
+	}
+	if _, err := usernameOf(store, "8.8.8.5"); err == nil {
+		t.Errorf("range registered before approval")
+	}
+
+	clickButton(b, approve)
+	if user, err := usernameOf(store, "8.8.8.5"); err != nil || user != "alice" {
+		t.Errorf("UsernameForIP(8.8.8.5) = %q, %v; want alice", user, err)
+	}
+	if len(b.fake.responses) != 1 || b.fake.responses[0].Type != discordgo.InteractionResponseUpdateMessage ||
+		!strings.Contains(b.fake.responses[0].Data.Content, "approved by mod") {
+		t.Errorf("responses = %+v", b.fake.responses)
+	}
+	if got := b.fake.sentTo("dm-1"); len(got) != 1 || !strings.Contains(got[0], "approved") {
+		t.Errorf("DMs to requester = %q", got)
+	}
+
+	// A second click on the same request does nothing
+	clickButton(b, approve)
+	if len(b.fake.responses) != 2 || !strings.Contains(b.fake.responses[1].Data.Content, "already handled") {
+		t.Errorf("second click response = %+v", b.fake.responses[1:])
+	}
+}
+
+func TestRangeRegistrationDenied(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	moderatorChannelID = "mods"
+
+	_, deny := requestRange(t, b)
+	clickButton(b, deny)
+	if _, err := usernameOf(store, "8.8.8.5"); err == nil {
+		t.Errorf("denied range was registered")
+	}
+	if got := b.fake.sentTo("dm-1"); len(got) != 1 || !strings.Contains(got[0], "denied") {
+		t.Errorf("DMs to requester = %q", got)
+	}
+}
+
+func TestRangeDecisionNeedsAdmin(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	b.fake.addMember("2", "bob", "")
+	moderatorChannelID = "mods"
+
+	approve, _ := requestRange(t, b)
+	clickButtonAs(b, "2", "bob", approve)
+	if _, err := usernameOf(store, "8.8.8.5"); err == nil {
+		t.Errorf("range approved by a member without an admin role")
+	}
+	if len(b.fake.responses) != 1 || b.fake.responses[0].Data.Flags != discordgo.MessageFlagsEphemeral ||
+		!strings.Contains(b.fake.responses[0].Data.Content, "Only admins") {
+		t.Errorf("responses = %+v", b.fake.responses)
+	}
+
+	// The request is still there for a moderator
+	clickButton(b, approve)
+	if user, _ := usernameOf(store, "8.8.8.5"); user != "alice" {
+		t.Errorf("range not registered after the moderator approved it")
+	}
+}
+
+func TestRangeApprovalChecksEligibility(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	moderatorChannelID = "mods"
+
+	approve, _ := requestRange(t, b)
+	b.fake.members = b.fake.members[1:] // alice left while the request waited
+	clickButton(b, approve)
+	if _, err := usernameOf(store, "8.8.8.5"); err == nil {
+		t.Errorf("range registered for a former member")
+	}
+	if got := b.fake.sentTo("dm-1"); len(got) != 1 || !strings.Contains(got[0], "Only members") {
+		t.Errorf("DMs to requester = %q", got)
+	}
+}
+
+func TestRangeRegistrationWithoutModerators(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	var replies []string
+	handleRegisterCommand(b.command("1", "alice", true, "/register 8.8.8.0/28", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "not enabled") {
+		t.Errorf("replies = %q", replies)
+	}
+
+	replies = nil
+	handleRegisterCommand(b.command("1", "alice", true, "/register 8.8.0.0/16", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "too large") {
+		t.Errorf("replies = %q", replies)
+	}
+}
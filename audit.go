@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditLogFileName = "audit_log.jsonl" // append-only audit trail, one JSON event per line
+	auditChannelID   = ""                // ID of a private channel audit events are mirrored to (optional)
+	auditMutex       sync.Mutex          // serializes appends to the audit log
+
+	maxAuditResults = 20  // events shown by /admin audit
+	auditQueueSize  = 500 // audit events waiting to be mirrored, more are dropped
+
+	auditMirror = newAuditQueue(auditQueueSize)
+)
+
+// auditBot is the actor of automatic actions such as expiry.
+const auditBot = "bot"
+
+// AuditEvent is one line of the audit log: who did what to whom.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // register, refresh, unregister, expire, revoke, extend, ban, unban, track, untrack, approve_range, deny_range
+	Actor  string    `json:"actor"`  // username of whoever acted, "bot" for automatic actions
+	Target string    `json:"target,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Device string    `json:"device,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// recordAudit appends event to the audit log and queues it for the audit channel.
+// Failures are logged, they never fail or delay the action being audited.
+func recordAudit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := appendAuditEvent(auditLogFileName, event); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+
+	if channelID := auditChannel(); channelID != "" && discordSession != nil {
+		auditMirror.add(mirroredAudit{s: discordSession, channelID: channelID, event: event})
+	}
+}
+
+// mirroredAudit is an audit event waiting to be posted to the audit channel.
+type mirroredAudit struct {
+	s         discordAPI
+	channelID string
+	event     AuditEvent
+}
+
+// auditQueue posts audit events to the audit channel in the background, like
+// dmQueue, so a slow or rate limited channel doesn't hold up the commands.
+// Events queued while a message is sent go out together in the next one.
+type auditQueue struct {
+	mu      sync.Mutex
+	closed  bool
+	pending chan mirroredAudit
+	stopped chan struct{}
+}
+
+func newAuditQueue(size int) *auditQueue {
+	return &auditQueue{
+		pending: make(chan mirroredAudit, size),
+		stopped: make(chan struct{}),
+	}
+}
+
+// add queues an event. It is dropped if the queue is full or closed, the audit
+// log still has it.
+func (q *auditQueue) add(m mirroredAudit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		log.Printf("Shutting down, not mirroring audit event %s by %s", m.event.Action, m.event.Actor)
+		return
+	}
+	select {
+	case q.pending <- m:
+	default:
+		log.Printf("Too many audit events queued, not mirroring %s by %s", m.event.Action, m.event.Actor)
+	}
+}
+
+// run posts the queued events until the queue is closed and empty.
+func (q *auditQueue) run() {
+	defer close(q.stopped)
+	for m := range q.pending {
+		batch := []mirroredAudit{m}
+	queued:
+		for {
+			select {
+			case next, ok := <-q.pending:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, next)
+			default:
+				break queued
+			}
+		}
+		sendAuditMirror(batch)
+	}
+}
+
+// closeAndWait stops accepting events and waits until the queued ones are posted.
+func (q *auditQueue) closeAndWait() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	<-q.stopped
+}
+
+// sendAuditMirror posts batch with one line per event, in as few messages as
+// Discord's message length allows.
+func sendAuditMirror(batch []mirroredAudit) {
+	var (
+		s         discordAPI
+		channelID string
+		lines     []string
+		length    int
+	)
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+		if _, err := s.ChannelMessageSend(channelID, strings.Join(lines, "\n")); err != nil {
+			log.Printf("Error mirroring %d audit events to channel %s: %v", len(lines), channelID, err)
+		}
+		lines, length = nil, 0
+	}
+	for _, m := range batch {
+		line := formatAuditEvent(m.event)
+		if m.channelID != channelID || length+len(line)+1 > maxReplyLength {
+			flush()
+		}
+		s, channelID = m.s, m.channelID
+		lines = append(lines, line)
+		length += len(line) + 1
+	}
+	flush()
+}
+
+// auditRemoved records one event per removed registration.
+func auditRemoved(action, actor, detail string, removed []Registration) {
+	for _, r := range removed {
+		recordAudit(AuditEvent{Action: action, Actor: actor, Target: r.Username, IP: r.IP, Device: r.Device, Detail: detail})
+	}
+}
+
+func appendAuditEvent(path string, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readAuditEvents returns the last limit events in which username acted or was
+// the target, oldest first. An empty username matches every event.
+func readAuditEvents(path, username string, limit int) ([]AuditEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if username != "" && event.Actor != username && event.Target != username {
+			continue
+		}
+		events = append(events, event)
+		if len(events) > limit {
+			events = events[1:]
+		}
+	}
+	return events, scanner.Err()
+}
+
+// formatAuditEvent formats an event for Discord, e.g.
+// "<t:1700000000:f> register by alice: 8.8.8.8 (laptop)".
+func formatAuditEvent(event AuditEvent) string {
+	text := fmt.Sprintf("<t:%d:f> %s by %s", event.Time.Unix(), event.Action, event.Actor)
+	if event.Target != "" && event.Target != event.Actor {
+		text += " for " + event.Target
+	}
+	var details []string
+	if event.IP != "" {
+		ip := event.IP
+		if event.Device != "" {
+			ip += " (" + event.Device + ")"
+		}
+		details = append(details, ip)
+	}
+	if event.Detail != "" {
+		details = append(details, event.Detail)
+	}
+	if len(details) > 0 {
+		text += ": " + strings.Join(details, ", ")
+	}
+	return text
+}
+
+func handleAdminAudit(c *commandContext) {
+	var username string
+	if len(c.args) >= 3 {
+		username = adminTarget(c, c.args[2])
+	}
+
+	events, err := readAuditEvents(auditLogFileName, username, maxAuditResults)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		c.reply("Failed to read the audit log.", true)
+		return
+	}
+	if len(events) == 0 {
+		c.reply("No matching audit events.", true)
+		return
+	}
+
+	// Newest first, so truncation drops the oldest events
+	lines := []string{fmt.Sprintf("Last %d audit events:", len(events))}
+	for i := len(events) - 1; i >= 0; i-- {
+		lines = append(lines, "- "+formatAuditEvent(events[i]))
+	}
+	c.reply(truncateLines(lines, maxReplyLength), true)
+}
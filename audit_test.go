@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "mod", "")
+	b.fake.addMember("2", "alice", "Ally")
+	b.fake.setRoles("1", "moderators")
+	adminRoleIDs = []string{"moderators"}
+	auditChannelID = "audit"
+
+	run := func(userID, username, text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command(userID, username, true, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	run("2", "alice", "/register 8.8.8.8 laptop")
+	run("2", "alice", "/register 8.8.8.8 laptop")
+	run("2", "alice", "/track mod")
+	run("1", "mod", "/admin revoke alice")
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now().Add(-8*24*time.Hour))
+	cleanupExpiredIPs()
+
+	events, err := readAuditEvents(auditLogFileName, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action+" "+event.Actor+" "+event.Target+" "+event.IP)
+	}
+	want := []string{
+		"register alice alice 8.8.8.8",
+		"refresh alice alice 8.8.8.8",
+		"track alice mod ",
+		"revoke mod alice 8.8.8.8",
+		"expire bot bob 9.9.9.9",
+	}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit events:\n%s\nwant:\n%s", strings.Join(actions, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The events are mirrored in the background, closing the queue waits for them
+	auditMirror.closeAndWait()
+	mirrored := strings.Split(strings.Join(b.fake.sentTo("audit"), "\n"), "\n")
+	if len(mirrored) != len(want) || !strings.Contains(mirrored[0], "register by alice: 8.8.8.8 (laptop)") {
+		t.Errorf("mirrored events = %q", mirrored)
+	}
+
+	// Both events alice acted in and events about her are found
+	got := run("1", "mod", "/admin audit Ally")
+	if !strings.Contains(got, "Last 4 audit events") || !strings.Contains(got, "revoke by mod for alice") {
+		t.Errorf("/admin audit Ally = %q", got)
+	}
+	if strings.Contains(got, "bob") {
+		t.Errorf("/admin audit Ally shows other users' events: %q", got)
+	}
+}
+
+func TestSendAuditMirrorBatches(t *testing.T) {
+	b := newTestBot(t)
+	var batch []mirroredAudit
+	for i := 0; i < 100; i++ {
+		batch = append(batch, mirroredAudit{s: b.fake, channelID: "audit", event: AuditEvent{Action: "expire", Actor: auditBot, Target: "alice", IP: "8.8.8.8", Time: time.Unix(1700000000, 0)}})
+	}
+	// A moved audit channel starts a new message
+	batch = append(batch, mirroredAudit{s: b.fake, channelID: "new-audit", event: AuditEvent{Action: "ban", Actor: "mod"}})
+
+	sendAuditMirror(batch)
+	messages := b.fake.sentTo("audit")
+	if len(messages) < 2 || len(messages) > 10 {
+		t.Fatalf("messages for 100 events = %d", len(messages))
+	}
+	lines := 0
+	for _, message := range messages {
+		if len(message) > maxReplyLength {
+			t.Errorf("message of %d characters", len(message))
+		}
+		lines += strings.Count(message, "\n") + 1
+	}
+	if lines != 100 {
+		t.Errorf("mirrored events = %d, want 100", lines)
+	}
+	if got := b.fake.sentTo("new-audit"); len(got) != 1 || !strings.Contains(got[0], "ban by mod") {
+		t.Errorf("messages to the new channel = %q", got)
+	}
+}
+
+func TestReadAuditEventsLimit(t *testing.T) {
+	newTestBot(t)
+	for i := 0; i < 5; i++ {
+		recordAudit(AuditEvent{Action: "register", Actor: "alice", Time: time.Unix(int64(i), 0)})
+	}
+	events, err := readAuditEvents(auditLogFileName, "alice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Time.Unix() != 2 || events[2].Time.Unix() != 4 {
+		t.Errorf("events = %+v, want the last 3", events)
+	}
+}
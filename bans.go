@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// banError is returned when a banned user or IP tries to register.
+type banError struct {
+	ban Ban
+}
+
+func (e *banError) Error() string {
+	return "banned: " + describeBanTarget(e.ban)
+}
+
+// findBan returns the active ban that keeps userID, known as username, from
+// registering entry, if any. IP bans cover every address and range overlapping
+// the banned one.
+func findBan(userID, username, entry string, now time.Time) (Ban, bool) {
+	bans, err := store.Bans()
+	if err != nil {
+		log.Printf("Error reading bans: %v", err)
+		return Ban{}, false
+	}
+	for _, ban := range bans {
+		if !ban.active(now) {
+			continue
+		}
+		if ban.UserID != "" && ban.UserID == userID {
+			return ban, true
+		}
+		if ban.UserID == "" && ban.Username != "" && ban.Username == username {
+			return ban, true
+		}
+		if ban.IP != "" && entry != "" && entriesOverlap(ban.IP, entry) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// banMessage explains a ban to whoever tried to register. The reason is only
+// shown to moderators.
+func banMessage(ban Ban) string {
+	message := "You are banned from the VaM multiplayer server"
+	if ban.UserID == "" && ban.Username == "" {
+		message = "This IP address is banned from the VaM multiplayer server"
+	}
+	if !ban.Until.IsZero() {
+		message += fmt.Sprintf(" until <t:%d:f>", ban.Until.Unix())
+	}
+	return message + ". Please contact a moderator if you think this is a mistake."
+}
+
+// enforceBan removes the registrations covered by ban from the usernames mapping
+// and the allowlist. It returns the removed registrations and the IPs that
+// dropped off the allowlist.
+func enforceBan(ban Ban) ([]Registration, []string) {
+	var removed []Registration
+	var dropped []string
+	// Registrations made since user IDs were recorded follow the account
+	if ban.UserID != "" {
+		r, d, err := store.RevokeUserID(ban.UserID)
+		if err != nil {
+			log.Printf("Error revoking registrations of %s: %v", ban.UserID, err)
+		}
+		removed, dropped = append(removed, r...), append(dropped, d...)
+	}
+	if ban.Username != "" {
+		r, d, err := store.RevokeUser(ban.Username)
+		if err != nil {
+			log.Printf("Error revoking registrations of %s: %v", ban.Username, err)
+		}
+		removed, dropped = append(removed, r...), append(dropped, d...)
+	}
+	if ban.IP != "" {
+		r, d, err := store.RevokeIP(ban.IP)
+		if err != nil {
+			log.Printf("Error revoking registrations of %s: %v", ban.IP, err)
+		}
+		removed, dropped = append(removed, r...), append(dropped, d...)
+	}
+	return removed, dropped
+}
+
+// enforceBans removes the registrations covered by active bans. Bans take effect
+// right away when issued; this catches bans added to bans.txt by hand.
+func enforceBans(now time.Time) {
+	bans, err := store.Bans()
+	if err != nil {
+		log.Printf("Error reading bans: %v", err)
+		return
+	}
+	for _, ban := range bans {
+		if !ban.active(now) {
+			continue
+		}
+		removed, dropped := enforceBan(ban)
+		for _, ip := range dropped {
+			log.Printf("Banned IP removed: %s (%s)", ip, describeBanTarget(ban))
+		}
+		auditRemoved("revoke", auditBot, "banned", removed)
+	}
+}
+
+// describeBanTarget names who or what a ban covers, e.g. "alice (1234)" or
+// "alice (1234) and 1.2.3.0/24".
+func describeBanTarget(ban Ban) string {
+	var targets []string
+	switch {
+	case ban.UserID != "" && ban.Username != "":
+		targets = append(targets, fmt.Sprintf("%s (%s)", ban.Username, ban.UserID))
+	case ban.UserID != "":
+		targets = append(targets, ban.UserID)
+	case ban.Username != "":
+		targets = append(targets, ban.Username)
+	}
+	if ban.IP != "" {
+		targets = append(targets, ban.IP)
+	}
+	return strings.Join(targets, " and ")
+}
+
+// describeBan summarizes a ban for moderators.
+func describeBan(ban Ban) string {
+	description := describeBanTarget(ban) + ", banned by " + ban.By
+	if ban.Until.IsZero() {
+		description += " permanently"
+	} else {
+		description += fmt.Sprintf(" until <t:%d:f>", ban.Until.Unix())
+	}
+	if ban.Reason != "" {
+		description += ": " + ban.Reason
+	}
+	return description
+}
+
+// banAuditDetail records the reason and expiry of a ban in the audit log.
+func banAuditDetail(ban Ban) string {
+	detail := "permanent"
+	if !ban.Until.IsZero() {
+		detail = "until " + ban.Until.UTC().Format(time.RFC3339)
+	}
+	if ban.Reason != "" {
+		detail += ", " + ban.Reason
+	}
+	return detail
+}
+
+// parseBanDuration parses durations such as 30m, 12h or 7d.
+func parseBanDuration(text string) (time.Duration, error) {
+	if strings.HasSuffix(text, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
+		if err != nil || days < 1 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return d, nil
+}
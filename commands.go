@@ -0,0 +1,506 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Slash commands registered with Discord, see slashCommands. Options are listed in
+// the same order as the arguments of the equivalent text command, so both end up
+// in the same handler.
+var dmPermission = true
+var minMonitorHours = 1.0
+var minExtendDays = 1.0
+
+// publicSlashCommands are the commands whose replies everyone in the channel
+// sees, the others answer only the user.
+var publicSlashCommands = map[string]bool{
+	"state":       true,
+	"monitor":     true,
+	"stats":       true,
+	"leaderboard": true,
+}
+
+// slashCommands returns the slash commands. Some describe settings, so they are
+// built once the configuration is loaded.
+func slashCommands() []*discordgo.ApplicationCommand {
+	return []*discordgo.ApplicationCommand{
+		{
+			Name:         "register",
+			Description:  fmt.Sprintf("Register your IP address with the VaM multiplayer server (valid for %s)", formatTTL(registrationTTL())),
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "ip",
+					Description: "Your public IPv4 or IPv6 address, or a small CIDR range; leave empty to get a registration link",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "device",
+					Description: "Name of the device, e.g. laptop, to keep several registered",
+					MaxLength:   maxDeviceNameLength,
+				},
+			},
+		},
+		{
+			Name:         "state",
+			Description:  "Show who is playing in each room",
+			DMPermission: &dmPermission,
+		},
+		{
+			Name:         "monitor",
+			Description:  "Post game status changes in this channel",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "hours",
+					Description: "How many hours to monitor for",
+					Required:    true,
+					MinValue:    &minMonitorHours,
+					MaxValue:    float64(monitorMaxHours),
+				},
+			},
+		},
+		{
+			Name:         "track",
+			Description:  "Get a DM when a user joins the game",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "username",
+					Description: "Username, nickname or display name to track",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:         "untrack",
+			Description:  "Stop tracking a user",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "username",
+					Description: "Username, nickname or display name to stop tracking",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:         "tracking",
+			Description:  "List the users you are tracking",
+			DMPermission: &dmPermission,
+		},
+		{
+			Name:         "stats",
+			Description:  "Show playtime statistics",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "user",
+					Description: "Playtime, sessions, favourite character and scene of a user",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "username",
+							Description: "Username, nickname or display name, yourself if empty",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "room",
+					Description: "Peak concurrency and busiest hours of the rooms",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Room name, all rooms if empty",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:         "leaderboard",
+			Description:  "Rank players by playtime and sessions",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "period",
+					Description: "Time period, last week by default",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "week", Value: "week"},
+						{Name: "month", Value: "month"},
+						{Name: "all", Value: "all"},
+					},
+				},
+			},
+		},
+		{
+			Name:         "devices",
+			Description:  "List your registered devices and when they expire",
+			DMPermission: &dmPermission,
+		},
+		{
+			Name:         "unregister",
+			Description:  "Remove your registration or one of your registered devices",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "device",
+					Description: "Device name as shown by /devices, can be left out if you have only one",
+					MaxLength:   maxDeviceNameLength,
+				},
+			},
+		},
+		{
+			Name:         "whoami",
+			Description:  "Show your registrations and when they expire",
+			DMPermission: &dmPermission,
+		},
+		{
+			Name:         "reminders",
+			Description:  "Get a DM a day before a registration expires",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "setting",
+					Description: "Turn reminders on or off",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "on", Value: "on"},
+						{Name: "off", Value: "off"},
+					},
+				},
+			},
+		},
+		{
+			Name:         "admin",
+			Description:  "Moderator commands for registrations and bans",
+			DMPermission: &dmPermission,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "registrations",
+					Description: "List registrations of a user or everyone",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname or display name, everyone if empty",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "revoke",
+					Description: "Remove all registrations of a user",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname or display name",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "extend",
+					Description: "Push back the expiry of a user's registrations",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname or display name",
+							Required:    true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "days",
+							Description: "Number of days to extend by",
+							Required:    true,
+							MinValue:    &minExtendDays,
+							MaxValue:    365,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "ban",
+					Description: "Remove the registrations of a user or IP and keep them from registering",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname, display name or user ID, or an IP address or range",
+							Required:    true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "ip",
+							Description: "IP address or range to ban together with the user",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "reason",
+							Description: "Only shown to moderators",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "duration",
+							Description: "e.g. 12h or 7d, permanent if empty",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "unban",
+					Description: "Lift the bans of a user or IP",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname, display name or user ID, or an IP address or range",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "bans",
+					Description: "List active bans and their reasons",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "audit",
+					Description: "Show the latest registration and moderation actions",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "user",
+							Description: "Username, nickname or display name, everyone if empty",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:         "help",
+			Description:  "Show the available commands",
+			DMPermission: &dmPermission,
+		},
+	}
+}
+
+// formatTTL formats a registration lifetime, e.g. "1 week" or "36 hours".
+func formatTTL(d time.Duration) string {
+	for _, unit := range []struct {
+		name string
+		size time.Duration
+	}{{"week", 7 * 24 * time.Hour}, {"day", 24 * time.Hour}, {"hour", time.Hour}} {
+		if d >= unit.size && d%unit.size == 0 {
+			if n := int(d / unit.size); n != 1 {
+				return fmt.Sprintf("%d %ss", n, unit.name)
+			}
+			return "1 " + unit.name
+		}
+	}
+	return d.String()
+}
+
+// registerSlashCommands overwrites the bot's global application commands with slashCommands.
+// Global commands are used because guild commands are not available in DMs.
+func registerSlashCommands(s discordAPI) {
+	commands := slashCommands()
+	_, err := s.ApplicationCommandBulkOverwrite(applicationID, "", commands)
+	if err != nil {
+		log.Println("Error registering slash commands:", err)
+		return
+	}
+	log.Printf("Registered %d slash commands", len(commands))
+}
+
+// interactionCreate routes slash command interactions to the command handlers.
+func interactionCreate(s discordAPI, i *discordgo.InteractionCreate, allowedChannelName string) {
+	if i.Type == discordgo.InteractionMessageComponent {
+		handleComponentInteraction(s, i)
+		return
+	}
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	// Guild interactions carry the member, DM interactions carry the user
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil {
+		return
+	}
+
+	data := i.ApplicationCommandData()
+
+	// Handlers can take longer than the 3 seconds Discord waits for an answer,
+	// so acknowledge right away and fill in the reply when they are done
+	deferredPrivate := !publicSlashCommands[data.Name]
+	var deferredFlags discordgo.MessageFlags
+	if deferredPrivate {
+		deferredFlags = discordgo.MessageFlagsEphemeral
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: deferredFlags},
+	})
+	if err != nil {
+		log.Println("Error responding to interaction:", err)
+		return
+	}
+
+	responded := false
+	reply := func(text string, private bool) {
+		// The first reply replaces the deferred response, later ones are follow-ups.
+		// The visibility of the deferred response can't change, so a reply with
+		// another visibility replaces it with a follow-up.
+		if !responded {
+			responded = true
+			if private == deferredPrivate {
+				if _, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &text}); err != nil {
+					log.Println("Error editing interaction response:", err)
+				}
+				return
+			}
+			if err := s.InteractionResponseDelete(i.Interaction); err != nil {
+				log.Println("Error deleting interaction response:", err)
+			}
+		}
+		var flags discordgo.MessageFlags
+		if private {
+			flags = discordgo.MessageFlagsEphemeral
+		}
+		_, err := s.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+			Content: text,
+			Flags:   flags,
+		})
+		if err != nil {
+			log.Println("Error sending interaction follow-up:", err)
+		}
+	}
+	// A handler that didn't reply leaves nothing to show
+	defer func() {
+		if !responded {
+			if err := s.InteractionResponseDelete(i.Interaction); err != nil {
+				log.Println("Error deleting interaction response:", err)
+			}
+		}
+	}()
+
+	isDM := i.GuildID == ""
+	if !isDM {
+		// Only respond in the allowed channel, same as text commands
+		channel, err := s.Channel(i.ChannelID)
+		if err != nil {
+			log.Println("Error getting channel info: ", err)
+			return
+		}
+		if channel.Name != allowedChannelName {
+			reply(fmt.Sprintf("Please use bot commands in #%s or in a DM.", allowedChannelName), true)
+			return
+		}
+	}
+
+	log.Printf("Got slash command /%s from %s", data.Name, user.Username)
+
+	c := &commandContext{
+		s:         s,
+		userID:    user.ID,
+		username:  user.Username,
+		channelID: i.ChannelID,
+		isDM:      isDM,
+		args:      slashCommandArgs(data),
+		options:   slashCommandOptions(data.Options),
+		reply:     reply,
+	}
+	dispatchCommand(c)
+}
+
+// slashCommandArgs flattens slash command options into text command style arguments,
+// in the order the options are declared in slashCommands. Options are looked up by
+// name, one that wasn't given is "" when a later one was, so "/register device:laptop"
+// becomes ["/register", "", "laptop"]. Subcommands become a word, e.g. "/stats room ROOM1".
+func slashCommandArgs(data discordgo.ApplicationCommandInteractionData) []string {
+	args := []string{"/" + data.Name}
+	for _, cmd := range slashCommands() {
+		if cmd.Name == data.Name {
+			args = appendOptionArgs(args, cmd.Options, data.Options)
+		}
+	}
+	return args
+}
+
+// slashCommandOptions maps the names of the options given to their values,
+// including the options of the subcommand, for handlers that need to know which
+// option a value came from.
+func slashCommandOptions(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]string {
+	values := make(map[string]string)
+	for _, opt := range options {
+		switch opt.Type {
+		case discordgo.ApplicationCommandOptionSubCommand, discordgo.ApplicationCommandOptionSubCommandGroup:
+			for name, value := range slashCommandOptions(opt.Options) {
+				values[name] = value
+			}
+		case discordgo.ApplicationCommandOptionString:
+			values[opt.Name] = opt.StringValue()
+		default:
+			values[opt.Name] = fmt.Sprint(opt.Value)
+		}
+	}
+	return values
+}
+
+func appendOptionArgs(args []string, declared []*discordgo.ApplicationCommandOption, options []*discordgo.ApplicationCommandInteractionDataOption) []string {
+	given := make(map[string]*discordgo.ApplicationCommandInteractionDataOption)
+	for _, opt := range options {
+		given[opt.Name] = opt
+	}
+
+	missing := 0 // options skipped since the last one given
+	for _, decl := range declared {
+		opt, ok := given[decl.Name]
+		if !ok {
+			// Only one subcommand is ever given, the others are not missing
+			if decl.Type != discordgo.ApplicationCommandOptionSubCommand && decl.Type != discordgo.ApplicationCommandOptionSubCommandGroup {
+				missing++
+			}
+			continue
+		}
+		for ; missing > 0; missing-- {
+			args = append(args, "")
+		}
+		switch opt.Type {
+		case discordgo.ApplicationCommandOptionSubCommand, discordgo.ApplicationCommandOptionSubCommandGroup:
+			args = append(args, opt.Name)
+			args = appendOptionArgs(args, decl.Options, opt.Options)
+		case discordgo.ApplicationCommandOptionInteger:
+			args = append(args, strconv.FormatInt(opt.IntValue(), 10))
+		case discordgo.ApplicationCommandOptionString:
+			args = append(args, opt.StringValue())
+		default:
+			args = append(args, fmt.Sprint(opt.Value))
+		}
+	}
+	return args
+}
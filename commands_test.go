@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSlashCommandArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		data discordgo.ApplicationCommandInteractionData
+		want []string
+	}{
+		{
+			"options in declaration order",
+			discordgo.ApplicationCommandInteractionData{Name: "monitor", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "hours", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(5)},
+			}},
+			[]string{"/monitor", "5"},
+		},
+		{
+			"options looked up by name",
+			discordgo.ApplicationCommandInteractionData{Name: "register", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "device", Type: discordgo.ApplicationCommandOptionString, Value: "laptop"},
+			}},
+			[]string{"/register", "", "laptop"},
+		},
+		{
+			"options given out of order",
+			discordgo.ApplicationCommandInteractionData{Name: "register", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "device", Type: discordgo.ApplicationCommandOptionString, Value: "laptop"},
+				{Name: "ip", Type: discordgo.ApplicationCommandOptionString, Value: "8.8.8.8"},
+			}},
+			[]string{"/register", "8.8.8.8", "laptop"},
+		},
+		{
+			"subcommand",
+			discordgo.ApplicationCommandInteractionData{Name: "stats", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "room", Type: discordgo.ApplicationCommandOptionSubCommand, Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "name", Type: discordgo.ApplicationCommandOptionString, Value: "ROOM1"},
+				}},
+			}},
+			[]string{"/stats", "room", "ROOM1"},
+		},
+		{
+			"later subcommand with a skipped option",
+			discordgo.ApplicationCommandInteractionData{Name: "admin", Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: "ban", Type: discordgo.ApplicationCommandOptionSubCommand, Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "user", Type: discordgo.ApplicationCommandOptionString, Value: "bob"},
+					{Name: "reason", Type: discordgo.ApplicationCommandOptionString, Value: "spam"},
+				}},
+			}},
+			[]string{"/admin", "ban", "bob", "", "spam"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := slashCommandArgs(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("slashCommandArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// runSlashCommand simulates alice using a slash command in a channel, or in a DM if channelID is empty.
+func runSlashCommand(b *testBot, channelID string, data discordgo.ApplicationCommandInteractionData) {
+	guild := ""
+	if channelID != "" {
+		guild = "guild"
+	}
+	interactionCreate(b.fake, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   guild,
+		ChannelID: channelID,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "1", Username: "alice"}},
+		Data:      data,
+	}}, "vam-mp-bot")
+}
+
+func TestSlashCommandsAreDeferred(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addChannel("bot", "vam-mp-bot", discordgo.ChannelTypeGuildText)
+	b.fake.addChannel("general", "general", discordgo.ChannelTypeGuildText)
+
+	runSlashCommand(b, "bot", discordgo.ApplicationCommandInteractionData{Name: "state"})
+	if len(b.fake.responses) != 1 || b.fake.responses[0].Type != discordgo.InteractionResponseDeferredChannelMessageWithSource ||
+		b.fake.responses[0].Data.Flags != 0 {
+		t.Fatalf("responses = %+v, want one public deferred response", b.fake.responses)
+	}
+	if len(b.fake.edits) != 1 || !strings.Contains(*b.fake.edits[0].Content, "ROOM1") {
+		t.Errorf("edits = %+v, want the game status", b.fake.edits)
+	}
+
+	// /whoami answers only alice
+	runSlashCommand(b, "", discordgo.ApplicationCommandInteractionData{Name: "whoami"})
+	if len(b.fake.responses) != 2 || b.fake.responses[1].Data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("responses = %+v, want an ephemeral deferred response", b.fake.responses[1:])
+	}
+	if len(b.fake.edits) != 2 {
+		t.Errorf("edits = %d, want 2", len(b.fake.edits))
+	}
+
+	// A private reply to a public command replaces the deferred response
+	runSlashCommand(b, "general", discordgo.ApplicationCommandInteractionData{Name: "state"})
+	if b.fake.deletedReplies != 1 || len(b.fake.followups) != 1 || b.fake.followups[0].Flags != discordgo.MessageFlagsEphemeral ||
+		!strings.Contains(b.fake.followups[0].Content, "#vam-mp-bot") {
+		t.Errorf("deleted %d responses, follow-ups %+v", b.fake.deletedReplies, b.fake.followups)
+	}
+}
+
+func TestSlashCommandsFollowConfig(t *testing.T) {
+	keepSettings(t)
+	expirationTime, monitorMaxHours = 48*time.Hour, 4
+
+	for _, cmd := range slashCommands() {
+		switch cmd.Name {
+		case "register":
+			if !strings.Contains(cmd.Description, "valid for 2 days") {
+				t.Errorf("/register description = %q", cmd.Description)
+			}
+		case "monitor":
+			if max := cmd.Options[0].MaxValue; max != 4 {
+				t.Errorf("/monitor hours max = %v, want 4", max)
+			}
+		}
+	}
+}
+
+func TestFormatTTL(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		7 * 24 * time.Hour:  "1 week",
+		14 * 24 * time.Hour: "2 weeks",
+		48 * time.Hour:      "2 days",
+		36 * time.Hour:      "36 hours",
+		90 * time.Minute:    "1h30m0s",
+	} {
+		if got := formatTTL(d); got != want {
+			t.Errorf("formatTTL(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
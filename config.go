@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	configFileName = "config.json" // all settings in one file (optional, the old txt files still work)
+	envPrefix      = "VAMMP_"      // environment variables override the files, e.g. VAMMP_TOKEN
+
+	cleanupInterval    = 6 * time.Hour    // how often expired registrations are removed
+	statusPollInterval = 20 * time.Second // how often status files are polled when they can't be watched
+)
+
+// Config holds the bot's settings, read from config.json and from environment
+// variables named after the JSON keys, e.g. VAMMP_GUILD_ID, which win. The
+// settings that had a txt file of their own before config.json existed still
+// fall back to the file named in their file tag. rooms.json keeps its own format.
+type Config struct {
+	Token                string   `json:"token" file:"token.txt"`
+	GuildID              string   `json:"guild_id" file:"guild_id.txt"`
+	BotChannel           string   `json:"bot_channel" file:"bot_discord_channel_name.txt"`
+	AlwaysMonitorChannel string   `json:"always_monitor_channel" file:"always_monitor_channel.txt"`
+	ModeratorChannel     string   `json:"moderator_channel"`
+	AuditChannel         string   `json:"audit_channel"`
+	AdminRoles           []string `json:"admin_roles"`
+	RegistrationRole     string   `json:"registration_role"`
+	MinAccountAgeDays    int      `json:"min_account_age_days"`
+	MinMembershipAgeDays int      `json:"min_membership_age_days"`
+	LegacyTextCommands   bool     `json:"legacy_text_commands"`
+	WeeklyDigest         bool     `json:"weekly_digest"`
+	HTTPListenAddress    string   `json:"http_listen_address"`
+	MetricsListenAddress string   `json:"metrics_listen_address"`
+	RegistrationLinkURL  string   `json:"registration_link_url"`
+	TrustedProxyHeader   string   `json:"trusted_proxy_header"`
+	RoomProbeHost        string   `json:"room_probe_host"`
+	StaleRoomHours       int      `json:"stale_room_hours"`
+	Expiration           Duration `json:"expiration"`        // how long a registration lasts
+	MonitorMaxHours      int      `json:"monitor_max_hours"` // longest /monitor
+	CleanupInterval      Duration `json:"cleanup_interval"`
+	StatusPollInterval   Duration `json:"status_poll_interval"`
+	// Command limits like "5 2m", "*" for every other command and
+	// "distinct_ips" for the IP hopping alert, on top of the defaults
+	RateLimits map[string]rateLimit `json:"rate_limits"`
+}
+
+// Duration is a time.Duration written like "168h" or "20s" in config.json.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"168h\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// defaultConfig returns the settings used when nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		LegacyTextCommands:   true,
+		HTTPListenAddress:    "127.0.0.1:8090", // keep it local, expose it through a reverse proxy
+		MetricsListenAddress: "127.0.0.1:8091", // keep it local, don't publish it
+		RoomProbeHost:        "127.0.0.1",      // the room servers run next to the bot
+		StaleRoomHours:       12,
+		Expiration:           Duration{7 * 24 * time.Hour},
+		MonitorMaxHours:      16,
+		CleanupInterval:      Duration{6 * time.Hour},
+		StatusPollInterval:   Duration{20 * time.Second},
+	}
+}
+
+// loadConfig reads the defaults, then the txt files that exist, then
+// config.json, then the VAMMP_* environment variables. The error lists every
+// problem found, not just the first.
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+	var errs []error
+
+	fields := configFields(&cfg)
+	for _, field := range fields {
+		if field.file == "" {
+			continue
+		}
+		if _, err := os.Stat(field.file); os.IsNotExist(err) {
+			continue
+		}
+		if err := field.setFromFile(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field.file, err))
+		}
+	}
+
+	if data, err := ioutil.ReadFile(configFileName); err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", configFileName, err))
+		}
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+
+	for _, field := range fields {
+		value, ok := os.LookupEnv(field.env)
+		if !ok {
+			continue
+		}
+		if err := field.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field.env, err))
+		}
+	}
+
+	errs = append(errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+// validate checks the values that can't be used as they are.
+func (cfg Config) validate() []error {
+	var errs []error
+	if cfg.Token == "" {
+		errs = append(errs, errors.New("token is missing, put it in token.txt, config.json or VAMMP_TOKEN"))
+	}
+	if cfg.BotChannel == "" {
+		errs = append(errs, errors.New("bot_channel is missing, put it in bot_discord_channel_name.txt, config.json or VAMMP_BOT_CHANNEL"))
+	}
+
+	ids := map[string]string{
+		"guild_id":               cfg.GuildID,
+		"always_monitor_channel": cfg.AlwaysMonitorChannel,
+		"moderator_channel":      cfg.ModeratorChannel,
+		"audit_channel":          cfg.AuditChannel,
+		"registration_role":      cfg.RegistrationRole,
+	}
+	for i, role := range cfg.AdminRoles {
+		ids[fmt.Sprintf("admin_roles[%d]", i)] = role
+	}
+	for _, name := range sortedKeys(ids) {
+		if id := ids[name]; id != "" && !isSnowflake(id) {
+			errs = append(errs, fmt.Errorf("%s: %q is not a Discord ID", name, id))
+		}
+	}
+
+	if cfg.MinAccountAgeDays < 0 {
+		errs = append(errs, errors.New("min_account_age_days must not be negative"))
+	}
+	if cfg.MinMembershipAgeDays < 0 {
+		errs = append(errs, errors.New("min_membership_age_days must not be negative"))
+	}
+	if cfg.StaleRoomHours < 0 {
+		errs = append(errs, errors.New("stale_room_hours must not be negative, 0 turns the check off"))
+	}
+	if cfg.MonitorMaxHours <= 0 {
+		errs = append(errs, errors.New("monitor_max_hours must be positive"))
+	}
+	if cfg.Expiration.Duration <= 0 {
+		errs = append(errs, errors.New("expiration must be positive"))
+	}
+	if cfg.CleanupInterval.Duration <= 0 {
+		errs = append(errs, errors.New("cleanup_interval must be positive"))
+	}
+	if cfg.StatusPollInterval.Duration <= 0 {
+		errs = append(errs, errors.New("status_poll_interval must be positive"))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.HTTPListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("http_listen_address: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(cfg.MetricsListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("metrics_listen_address: %w", err))
+	} else if cfg.MetricsListenAddress == cfg.HTTPListenAddress {
+		errs = append(errs, errors.New("metrics_listen_address must differ from http_listen_address"))
+	}
+	if cfg.RegistrationLinkURL != "" {
+		if u, err := url.Parse(cfg.RegistrationLinkURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("registration_link_url: %q is not an http or https URL", cfg.RegistrationLinkURL))
+		}
+	}
+	if cfg.RoomProbeHost == "" {
+		errs = append(errs, errors.New("room_probe_host must not be empty"))
+	}
+	for _, command := range sortedKeys(cfg.RateLimits) {
+		if command != "*" && command != distinctIPsLimit && !strings.HasPrefix(command, "/") {
+			errs = append(errs, fmt.Errorf("rate_limits: %q is not a command, \"*\" or %q", command, distinctIPsLimit))
+		}
+	}
+	return errs
+}
+
+// isSnowflake reports whether id looks like a Discord ID.
+func isSnowflake(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// applyConfig makes cfg the bot's settings at startup, see reloadConfig for
+// changes while running.
+func applyConfig(cfg Config) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	activeConfig = cfg
+	token = cfg.Token
+	botChannelName = cfg.BotChannel
+	guildID = cfg.GuildID
+	alwaysMonitorChannelID = cfg.AlwaysMonitorChannel
+	moderatorChannelID = cfg.ModeratorChannel
+	auditChannelID = cfg.AuditChannel
+	adminRoleIDs = cfg.AdminRoles
+	registrationRoleID = cfg.RegistrationRole
+	minAccountAge = time.Duration(cfg.MinAccountAgeDays) * 24 * time.Hour
+	minMembershipAge = time.Duration(cfg.MinMembershipAgeDays) * 24 * time.Hour
+	legacyTextCommands = cfg.LegacyTextCommands
+	weeklyDigestEnabled = cfg.WeeklyDigest
+	httpListenAddress = cfg.HTTPListenAddress
+	metricsListenAddress = cfg.MetricsListenAddress
+	registrationLinkBaseURL = strings.TrimSuffix(cfg.RegistrationLinkURL, "/")
+	trustedProxyHeader = cfg.TrustedProxyHeader
+	probeHost = cfg.RoomProbeHost
+	staleRoomAfter = time.Duration(cfg.StaleRoomHours) * time.Hour
+	expirationTime = cfg.Expiration.Duration
+	monitorMaxHours = cfg.MonitorMaxHours
+	cleanupInterval = cfg.CleanupInterval.Duration
+	statusPollInterval = cfg.StatusPollInterval.Duration
+	for command, limit := range cfg.RateLimits {
+		if command == distinctIPsLimit {
+			distinctIPAlertCount, distinctIPAlertWindow = limit.Burst, limit.Every
+			continue
+		}
+		rateLimits[command] = limit
+	}
+
+	log.Printf("Loaded %d admin roles", len(adminRoleIDs))
+	log.Printf("Registration requires role %q, account age %v, membership age %v", registrationRoleID, minAccountAge, minMembershipAge)
+	log.Printf("Legacy text commands enabled: %v", legacyTextCommands)
+	log.Printf("Rate limits: %v, alert after %d IPs in %v", rateLimits, distinctIPAlertCount, distinctIPAlertWindow)
+}
+
+// configField is a setting of Config with the names of its file and
+// environment variable.
+type configField struct {
+	name  string // JSON key
+	value reflect.Value
+	file  string
+	env   string
+}
+
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		fields = append(fields, configField{
+			name:  name,
+			value: v.Field(i),
+			file:  field.Tag.Get("file"),
+			env:   envPrefix + strings.ToUpper(name),
+		})
+	}
+	return fields
+}
+
+// setFromFile reads the setting from the first line of its txt file that
+// isn't a comment.
+func (f configField) setFromFile() error {
+	value, err := readChannelNameFromFile(f.file)
+	if err != nil {
+		return err
+	}
+	return f.set(value)
+}
+
+// set parses value into the setting. Lists are comma separated.
+func (f configField) set(value string) error {
+	value = strings.TrimSpace(value)
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(value)
+	case []string:
+		var values []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(values))
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		f.value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		f.value.SetBool(b)
+	case Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.value.Set(reflect.ValueOf(Duration{d}))
+	case map[string]rateLimit:
+		// "/register 5 2m, * 10 10s"
+		limits := make(map[string]rateLimit)
+		for _, item := range strings.Split(value, ",") {
+			command, text, _ := strings.Cut(strings.TrimSpace(item), " ")
+			limit, err := parseRateLimit(text)
+			if err != nil {
+				return fmt.Errorf("%s: %w", command, err)
+			}
+			limits[command] = limit
+		}
+		f.value.Set(reflect.ValueOf(limits))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
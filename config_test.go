@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test in an empty directory, where loadConfig looks for its files.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func writeFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"token.txt":                    "secret\n",
+		"bot_discord_channel_name.txt": "# the channel\nvam-mp-bot\n",
+		"guild_id.txt":                 "111\n",
+		"always_monitor_channel.txt":   "222\n",
+		"config.json": `{"guild_id": "555", "admin_roles": ["333", "444"], "weekly_digest": true,
+			"expiration": "72h", "monitor_max_hours": 4}`,
+		// Settings added with config.json have no txt file
+		"moderator_channel.txt": "777\n",
+	})
+	t.Setenv("VAMMP_GUILD_ID", "666")
+	t.Setenv("VAMMP_STATUS_POLL_INTERVAL", "5s")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.Token = "secret"
+	want.BotChannel = "vam-mp-bot"
+	want.GuildID = "666"
+	want.AlwaysMonitorChannel = "222"
+	want.AdminRoles = []string{"333", "444"}
+	want.WeeklyDigest = true
+	want.Expiration = Duration{72 * time.Hour}
+	want.MonitorMaxHours = 4
+	want.StatusPollInterval = Duration{5 * time.Second}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("loadConfig =\n%+v\nwant\n%+v", cfg, want)
+	}
+}
+
+func TestLoadConfigWithoutFiles(t *testing.T) {
+	inTempDir(t)
+	t.Setenv("VAMMP_TOKEN", "secret")
+	t.Setenv("VAMMP_BOT_CHANNEL", "vam-mp-bot")
+	t.Setenv("VAMMP_ADMIN_ROLES", "333, 444")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token != "secret" || cfg.BotChannel != "vam-mp-bot" || !reflect.DeepEqual(cfg.AdminRoles, []string{"333", "444"}) {
+		t.Errorf("loadConfig = %+v", cfg)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"config.json": `{"moderator_channel": "mods", "expiration": "0s", "http_listen_address": "8090", "registration_link_url": "example.com"}`,
+	})
+	t.Setenv("VAMMP_LEGACY_TEXT_COMMANDS", "maybe")
+	t.Setenv("VAMMP_MIN_ACCOUNT_AGE_DAYS", "a week")
+
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig accepted an invalid configuration")
+	}
+	for _, want := range []string{
+		`VAMMP_MIN_ACCOUNT_AGE_DAYS: "a week" is not a number`,
+		`VAMMP_LEGACY_TEXT_COMMANDS: "maybe" is not true or false`,
+		"token is missing",
+		"bot_channel is missing",
+		`moderator_channel: "mods" is not a Discord ID`,
+		"expiration must be positive",
+		"http_listen_address: address 8090: missing port in address",
+		`registration_link_url: "example.com" is not an http or https URL`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	inTempDir(t)
+	writeFiles(t, map[string]string{"config.json": `{"token": "secret", "bot_channel": "vam-mp-bot", "guild": "111"}`})
+
+	_, err := loadConfig()
+	if err == nil || !strings.Contains(err.Error(), `config.json: json: unknown field "guild"`) {
+		t.Errorf("loadConfig = %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// maxDeviceNameLength is the longest device name accepted by /register.
+const maxDeviceNameLength = 20
+
+// isDeviceName reports whether name can be used as a device name: letters,
+// digits, - and _ only, so it fits in a single field of usernames_ips.txt.
+func isDeviceName(name string) bool {
+	if name == "" || len(name) > maxDeviceNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceSuffix names the device in replies, unless it is the default one.
+func deviceSuffix(device string) string {
+	if device == defaultDevice {
+		return ""
+	}
+	return fmt.Sprintf(" for your device %s", device)
+}
+
+// formatExpiry formats the time left until a registration expires.
+func formatExpiry(left time.Duration) string {
+	switch {
+	case left <= 0:
+		return "expired"
+	case left >= 48*time.Hour:
+		return fmt.Sprintf("expires in %d days", int(left.Hours()/24))
+	default:
+		return "expires in " + formatDuration(left)
+	}
+}
+
+// handleDevicesCommand processes the /devices command.
+func handleDevicesCommand(c *commandContext) {
+	// The list contains IPs, keep it out of public channels
+	if !c.isDM && c.messageID != "" {
+		c.reply("Send /devices via DM only.", true)
+		return
+	}
+
+	registrations, err := store.Registrations(c.username)
+	if err != nil {
+		log.Printf("Error reading registrations: %v", err)
+		c.reply("Failed to read your devices.", true)
+		return
+	}
+	if len(registrations) == 0 {
+		c.reply("You have no registered devices. Use /register <IP> [device] to register one.", true)
+		return
+	}
+
+	var lines []string
+	for _, r := range registrations {
+		lines = append(lines, fmt.Sprintf("- %s: %s, %s", r.Device, r.IP, formatExpiry(time.Until(registrationExpiry(r)))))
+	}
+	c.reply(fmt.Sprintf("Your registered devices (%d of %d):\n%s", len(registrations), maxDevicesPerUser, strings.Join(lines, "\n")), true)
+}
+
+// handleUnregisterCommand processes the /unregister [device] command. The device
+// can be left out by users with a single registration.
+func handleUnregisterCommand(c *commandContext) {
+	var device string
+	if len(c.args) >= 2 {
+		device = strings.ToLower(c.args[1])
+	} else {
+		registrations, err := store.Registrations(c.username)
+		if err != nil {
+			log.Printf("Error reading registrations: %v", err)
+			c.reply("Failed to read your devices.", true)
+			return
+		}
+		switch len(registrations) {
+		case 0:
+			c.reply("You are not registered.", true)
+			return
+		case 1:
+			device = registrations[0].Device
+		default:
+			c.reply("You have several devices registered. Please use /unregister <device>, /devices lists them.", true)
+			return
+		}
+	}
+
+	ip, err := store.Unregister(c.username, device)
+	if err == errDeviceNotFound {
+		c.reply(fmt.Sprintf("You have no device named %s, /devices lists your devices.", device), true)
+		return
+	}
+	if err != nil {
+		log.Printf("Error unregistering device %s of %s: %v", device, c.username, err)
+		c.reply("Failed to unregister the device.", true)
+		return
+	}
+
+	log.Printf("Unregistered IP: %s (%s)", ip, device)
+	recordAudit(AuditEvent{Action: "unregister", Actor: c.username, Target: c.username, IP: ip, Device: device})
+	if device == defaultDevice {
+		c.reply("Your registration has been removed. The game server will no longer accept your IP.", true)
+		return
+	}
+	c.reply(fmt.Sprintf("Your device %s has been unregistered.", device), true)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceCommands(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	run := func(isDM bool, text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command("1", "alice", isDM, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	if got := run(true, "/devices"); !strings.Contains(got, "no registered devices") {
+		t.Errorf("/devices before registering = %q", got)
+	}
+	if got := run(true, "/register 8.8.8.8 Laptop"); !strings.Contains(got, "for your device laptop") {
+		t.Errorf("/register with device = %q", got)
+	}
+	run(true, "/register 9.9.9.9")
+	if got := run(true, "/register 8.8.4.4 my.laptop"); !strings.Contains(got, "Invalid device name") {
+		t.Errorf("/register with a bad device name = %q", got)
+	}
+	run(true, "/register 1.0.0.1 phone")
+	if got := run(true, "/register 1.1.1.1 tablet"); !strings.Contains(got, "/unregister") {
+		t.Errorf("/register over the device limit = %q", got)
+	}
+
+	got := run(true, "/devices")
+	for _, want := range []string{"3 of 3", "laptop: 8.8.8.8, expires in 6 days", "default: 9.9.9.9", "phone: 1.0.0.1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/devices = %q, want it to contain %q", got, want)
+		}
+	}
+	if got := run(false, "/devices"); !strings.Contains(got, "via DM only") {
+		t.Errorf("/devices in a channel = %q", got)
+	}
+
+	if got := run(true, "/unregister laptop"); !strings.Contains(got, "unregistered") {
+		t.Errorf("/unregister = %q", got)
+	}
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Errorf("8.8.8.8 still registered after /unregister")
+	}
+	if got := run(true, "/unregister laptop"); !strings.Contains(got, "no device named laptop") {
+		t.Errorf("second /unregister = %q", got)
+	}
+}
+
+func TestFormatExpiry(t *testing.T) {
+	tests := []struct {
+		left time.Duration
+		want string
+	}{
+		{-time.Minute, "expired"},
+		{90 * time.Minute, "expires in 1h 30m"},
+		{7 * 24 * time.Hour, "expires in 7 days"},
+	}
+	for _, tt := range tests {
+		if got := formatExpiry(tt.left); got != tt.want {
+			t.Errorf("formatExpiry(%v) = %q, want %q", tt.left, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import "github.com/bwmarrin/discordgo"
+
+// discordAPI is the subset of *discordgo.Session the bot uses. Handlers take it
+// instead of the concrete session so they can be exercised with a fake in tests.
+type discordAPI interface {
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	UpdateCustomStatus(state string) error
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error
+	FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+}
+
+var _ discordAPI = (*discordgo.Session)(nil)
+
+// meteredDiscord wraps a discordAPI and counts failed calls per method for /metrics.
+type meteredDiscord struct {
+	api discordAPI
+}
+
+func (m meteredDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	channel, err := m.api.Channel(channelID, options...)
+	countDiscordError("Channel", err)
+	return channel, err
+}
+
+func (m meteredDiscord) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	msg, err := m.api.ChannelMessageSend(channelID, content, options...)
+	countDiscordError("ChannelMessageSend", err)
+	return msg, err
+}
+
+func (m meteredDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	msg, err := m.api.ChannelMessageSendComplex(channelID, data, options...)
+	countDiscordError("ChannelMessageSendComplex", err)
+	return msg, err
+}
+
+func (m meteredDiscord) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	err := m.api.ChannelMessageDelete(channelID, messageID, options...)
+	countDiscordError("ChannelMessageDelete", err)
+	return err
+}
+
+func (m meteredDiscord) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	member, err := m.api.GuildMember(guildID, userID, options...)
+	countDiscordError("GuildMember", err)
+	return member, err
+}
+
+func (m meteredDiscord) GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	members, err := m.api.GuildMembers(guildID, after, limit, options...)
+	countDiscordError("GuildMembers", err)
+	return members, err
+}
+
+func (m meteredDiscord) GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	members, err := m.api.GuildMembersSearch(guildID, query, limit, options...)
+	countDiscordError("GuildMembersSearch", err)
+	return members, err
+}
+
+func (m meteredDiscord) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	channel, err := m.api.UserChannelCreate(recipientID, options...)
+	countDiscordError("UserChannelCreate", err)
+	return channel, err
+}
+
+func (m meteredDiscord) UpdateCustomStatus(state string) error {
+	err := m.api.UpdateCustomStatus(state)
+	countDiscordError("UpdateCustomStatus", err)
+	return err
+}
+
+func (m meteredDiscord) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	err := m.api.InteractionRespond(interaction, resp, options...)
+	countDiscordError("InteractionRespond", err)
+	return err
+}
+
+func (m meteredDiscord) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	msg, err := m.api.InteractionResponseEdit(interaction, newresp, options...)
+	countDiscordError("InteractionResponseEdit", err)
+	return msg, err
+}
+
+func (m meteredDiscord) InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error {
+	err := m.api.InteractionResponseDelete(interaction, options...)
+	countDiscordError("InteractionResponseDelete", err)
+	return err
+}
+
+func (m meteredDiscord) FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	msg, err := m.api.FollowupMessageCreate(interaction, wait, data, options...)
+	countDiscordError("FollowupMessageCreate", err)
+	return msg, err
+}
+
+func (m meteredDiscord) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	registered, err := m.api.ApplicationCommandBulkOverwrite(appID, guildID, commands, options...)
+	countDiscordError("ApplicationCommandBulkOverwrite", err)
+	return registered, err
+}
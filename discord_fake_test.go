@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// sentMessage is a message recorded by fakeDiscord.
+type sentMessage struct {
+	ChannelID string
+	Content   string
+}
+
+// fakeDiscord implements discordAPI without touching the network. It serves
+// members and channels from memory and records everything the bot sends.
+type fakeDiscord struct {
+	mu              sync.Mutex
+	members         []*discordgo.Member
+	channels        map[string]*discordgo.Channel
+	messages        []sentMessage
+	complexMessages []*discordgo.MessageSend
+	deleted         []string // IDs of deleted messages
+	customStatuses  []string
+	responses       []*discordgo.InteractionResponse
+	followups       []*discordgo.WebhookParams
+	edits           []*discordgo.WebhookEdit          // edits of deferred responses
+	deletedReplies  int                               // deferred responses deleted
+	commandSets     [][]*discordgo.ApplicationCommand // slash commands registered with each overwrite
+}
+
+func newFakeDiscord() *fakeDiscord {
+	return &fakeDiscord{channels: make(map[string]*discordgo.Channel)}
+}
+
+// addMember adds a guild member; nick may be empty.
+func (f *fakeDiscord) addMember(id, username, nick string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members = append(f.members, &discordgo.Member{
+		User: &discordgo.User{ID: id, Username: username},
+		Nick: nick,
+	})
+}
+
+func (f *fakeDiscord) addChannel(id, name string, channelType discordgo.ChannelType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[id] = &discordgo.Channel{ID: id, Name: name, Type: channelType}
+}
+
+// sent returns a copy of the messages sent so far.
+func (f *fakeDiscord) sent() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentMessage(nil), f.messages...)
+}
+
+// sentTo returns the contents of messages sent to channelID.
+func (f *fakeDiscord) sentTo(channelID string) []string {
+	var contents []string
+	for _, msg := range f.sent() {
+		if msg.ChannelID == channelID {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents
+}
+
+// waitForMessages waits until at least n messages were sent to channelID, for
+// messages sent from goroutines such as tracker DMs.
+func (f *fakeDiscord) waitForMessages(t *testing.T, channelID string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		contents := f.sentTo(channelID)
+		if len(contents) >= n || time.Now().After(deadline) {
+			return contents
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (f *fakeDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channel, ok := f.channels[channelID]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel %s", channelID)
+	}
+	return channel, nil
+}
+
+func (f *fakeDiscord) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, sentMessage{ChannelID: channelID, Content: content})
+	return &discordgo.Message{ChannelID: channelID, Content: content}, nil
+}
+
+// ChannelMessageSendComplex records the content, components are kept in complexMessages.
+func (f *fakeDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, sentMessage{ChannelID: channelID, Content: data.Content})
+	f.complexMessages = append(f.complexMessages, data)
+	return &discordgo.Message{ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (f *fakeDiscord) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, messageID)
+	return nil
+}
+
+// setRoles sets the role IDs of a member added with addMember.
+func (f *fakeDiscord) setRoles(id string, roles ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, member := range f.members {
+		if member.User.ID == id {
+			member.Roles = roles
+		}
+	}
+}
+
+func (f *fakeDiscord) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, member := range f.members {
+		if member.User.ID == userID {
+			return member, nil
+		}
+	}
+	// Like Discord, answer 404 Unknown Member for users who are not in the guild
+	return nil, &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Message:  &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownMember, Message: "Unknown Member"},
+	}
+}
+
+func (f *fakeDiscord) GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*discordgo.Member(nil), f.members...), nil
+}
+
+func (f *fakeDiscord) GuildMembersSearch(guildID, query string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []*discordgo.Member
+	for _, member := range f.members {
+		if strings.HasPrefix(member.User.Username, query) || strings.HasPrefix(member.Nick, query) {
+			found = append(found, member)
+		}
+		if len(found) == limit {
+			break
+		}
+	}
+	return found, nil
+}
+
+// UserChannelCreate returns the DM channel "dm-<user ID>".
+func (f *fakeDiscord) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: "dm-" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (f *fakeDiscord) UpdateCustomStatus(state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.customStatuses = append(f.customStatuses, state)
+	return nil
+}
+
+func (f *fakeDiscord) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, resp)
+	return nil
+}
+
+func (f *fakeDiscord) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.edits = append(f.edits, newresp)
+	return &discordgo.Message{Content: *newresp.Content}, nil
+}
+
+func (f *fakeDiscord) InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletedReplies++
+	return nil
+}
+
+func (f *fakeDiscord) FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.followups = append(f.followups, data)
+	return &discordgo.Message{Content: data.Content}, nil
+}
+
+func (f *fakeDiscord) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commandSets = append(f.commandSets, commands)
+	return commands, nil
+}
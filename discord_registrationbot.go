@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"os/signal"
-	"regexp"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,65 +24,67 @@ var (
 	token	       string
 	allowlistFile	    = "allowlist.txt" // user IP allowlist
 	usernamesFile	    = "usernames_ips.txt" // mapping of IPs into usernames
-	alwaysMonitorFileName = "always_monitor_channel.txt" // channel to always monitor (optional)
-	guildIDFileName = "guild_id.txt" // ID of the Discord server (used to fetch user nickname when they register)
-	guildID = "" // retrieved from guild_id.txt
+	alwaysMonitorChannelID = "" // channel to always monitor (optional)
+	guildID = "" // ID of the Discord server (used to fetch user nickname when they register)
+	moderatorChannelID = "" // ID of the private moderator channel (optional)
+	legacyTextCommands = true // text commands stay enabled until switched off in the config
 	expirationTime = 7 * 24 * 1 * time.Hour // 1 week expiration
-	allowlistMutex		sync.Mutex // Mutex to protect access to the allowlist and usernames file
-	prevPlayerStatus string = ""
+	prevSnapshots []RoomSnapshot // room snapshots at the last status update
 	monitoredChannels = make(map[string]time.Time) // monitoring enabled channels by /monitor command
 	mu		 sync.Mutex // mutex protecting monitoredChannels
 	monitorMaxHours int = 16 // monitor for max 16 hours
+	statusDebounce = 500 * time.Millisecond // quiet time after the last status file change before the status update
 
 	trackingFile      = "tracking.txt"
-	trackingMutex      sync.Mutex
+	remindersFile     = "reminders.txt" // users who want a DM before their registration expires
+	bansFile          = "bans.txt" // users banned by moderators
+	store Store = newFileStore(allowlistFile, usernamesFile, trackingFile, remindersFile, bansFile) // registrations, usernames, trackings, reminders and bans
 	notifiedMutex      sync.Mutex
 	notifiedTrackings  = make(map[string]map[string]bool) // trackedUser -> tracker -> bool
-	discordSession *discordgo.Session
+	discordSession discordAPI
+	applicationID  string // the bot's user ID, slash commands are registered under it
 )
 
 
 func main() {
-	// Read the bot token from a file
-	tokenFile, err := os.Open("token.txt")
+	// Read config.json, the txt files and the VAMMP_* environment variables
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Println("error opening token file,", err)
-		return
-	}
-	defer tokenFile.Close()
-
-	// Read the channel name from the file
-	channelName, err := readChannelNameFromFile("bot_discord_channel_name.txt")
-	if err != nil {
-		log.Println("Error reading channel name:", err)
+		log.Printf("Invalid configuration:\n%v", err)
 		log.Println("Quitting..")
 		return
 	}
-
-	// Read the guild ID
-	readGuildID()
-
-	scanner := bufio.NewScanner(tokenFile)
-	if scanner.Scan() {
-		token = scanner.Text()
-	}
-	if err := scanner.Err(); err != nil {
-		log.Println("error reading token file,", err)
-		return
-	}
-	trimmedToken := strings.TrimSpace(token)
+	applyConfig(cfg)
 
 	// Create a new Discord session using the provided bot token.
-	dg, err := discordgo.New("Bot " + trimmedToken)
+	dg, err := discordgo.New("Bot " + token)
 	if err != nil {
 		log.Println("error creating Discord session,", err)
 		return
 	}
-	discordSession = dg
+	// Count failed API calls for /metrics
+	api := meteredDiscord{dg}
+	discordSession = api
 
 	// Register the messageCreate func as a callback for MessageCreate events.
+	// Handlers are counted so shutdown can wait for their store writes.
 	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
-		messageCreate(s, m, channelName)
+		eventHandlers.run(func() { messageCreate(api, s.State.User.ID, m, botChannel()) })
+	})
+	// Slash commands arrive as interactions
+	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		eventHandlers.run(func() { interactionCreate(api, i, botChannel()) })
+	})
+	// Members leaving the server lose their registrations
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+		eventHandlers.run(func() { handleMemberRemove(m) })
+	})
+	// Track the gateway connection for /readyz
+	dg.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) {
+		discordConnected.Store(true)
+	})
+	dg.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) {
+		discordConnected.Store(false)
 	})
 	// In this example, we only care about receiving message events.
 	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages | discordgo.IntentsGuildMembers
@@ -93,42 +96,59 @@ func main() {
 		return
 	}
 
-	// Start the periodic cleanup in a separate goroutine
-	go startCleanupTimer()
-	// Goroutine to poll for player state changes and update status
-	go startPlayerStateMonitor(dg)
+	// Make the slash commands known to Discord
+	applicationID = dg.State.User.ID
+	registerSlashCommands(api)
+
+	// Everything below stops when CTRL+C or another term signal is received,
+	// or when one of the background tasks fails.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	group, ctx := newSupervisor(ctx)
+
+	// Rebuild the session history from the status files, this reads them completely.
+	// The status updates go ahead meanwhile and the history commands ask to wait.
+	group.Go("history", func(ctx context.Context) error {
+		history.load()
+		return nil
+	})
+
+	// Start the periodic cleanup
+	group.Go("cleanup", startCleanupTimer)
+	// Remind opted-in users before their registrations expire
+	group.Go("reminders", func(ctx context.Context) error { return startRenewalReminders(ctx, api) })
+	// Watch for player state changes and update status
+	group.Go("player state", func(ctx context.Context) error { return startPlayerStateMonitor(ctx, api) })
+	// Probe the room servers and tell moderators when one goes down
+	group.Go("room watchdog", func(ctx context.Context) error { return startRoomWatchdog(ctx, api) })
+	// Send tracker DMs queued by the status updates
+	go trackerDMs.run()
+	// Mirror the audit events to the audit channel
+	go auditMirror.run()
 
 	// Initialize the always monitor channel functionality
 	alwaysMonitorChannel()
+	// Post the weekly digest there if enabled
+	group.Go("weekly digest", func(ctx context.Context) error { return startWeeklyDigest(ctx, api) })
+
+	// Serve the room state over HTTP
+	group.Go("http", startHTTPServer)
+	// Serve the metrics on a local address of their own
+	group.Go("metrics", startMetricsServer)
+	// Reload the configuration on SIGHUP
+	group.Go("reload", watchReloadSignal)
 
 	log.Println("Bot is now running. Press CTRL+C to exit.")
-	// Wait here until CTRL+C or other term signal is received.
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
+	<-ctx.Done()
+	log.Println("Shutting down")
 
-	// Cleanly close down the Discord session.
+	// Stop receiving events, REST calls such as the queued DMs keep working
 	dg.Close()
-}
-
-func readGuildID() {
-	// Check if the guild ID file exists
-	if _, err := os.Stat(guildIDFileName); os.IsNotExist(err) {
-		// File does not exist, set guildID to an empty string
-		guildID = ""
-		return
-	}
-
-	// Read the contents of the guild ID file
-	data, err := ioutil.ReadFile(guildIDFileName)
-	if err != nil {
-		log.Printf("Failed to read %s: %v", guildIDFileName, err)
-		guildID = "" // Set to empty string on error
-		return
+	if err := shutdown(group); err != nil {
+		log.Println("Error shutting down:", err)
+		os.Exit(1)
 	}
-
-	// Trim whitespace from the read data and set guildID
-	guildID = strings.TrimSpace(string(data))
+	log.Println("Bot stopped")
 }
 
 func readChannelNameFromFile(filename string) (string, error) {
@@ -148,9 +168,25 @@ func readChannelNameFromFile(filename string) (string, error) {
 	return "", fmt.Errorf("no valid channel name found in the file")
 }
 
-func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate, allowedChannelName string) {
+// commandContext carries everything a command handler needs, regardless of whether
+// the command arrived as a text message or as a slash command interaction.
+type commandContext struct {
+	s         discordAPI
+	userID    string
+	username  string   // unique Discord username of the caller
+	channelID string
+	messageID string   // ID of the text message; empty for slash commands
+	isDM      bool
+	args      []string // command name followed by its arguments, e.g. ["/register", "1.2.3.4"]
+	options   map[string]string // slash command options by name, also those of subcommands; nil for text commands
+	// reply answers the caller. Private replies are ephemeral for slash commands,
+	// text commands always answer in the channel they came from.
+	reply func(text string, private bool)
+}
+
+func messageCreate(s discordAPI, botUserID string, m *discordgo.MessageCreate, allowedChannelName string) {
     // Ignore all messages created by the bot itself
-    if m.Author.ID == s.State.User.ID {
+    if m.Author.ID == botUserID {
         return
     }
 
@@ -166,93 +202,238 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate, allowedChan
         return
     }
 
-    log.Println("Got message: ", m.Content)
-
     // Split the message into command and arguments
     parts := strings.Fields(m.Content)
     if len(parts) == 0 {
         return
     }
 
-    command := parts[0]
-    args := parts
+    if !legacyTextCommands {
+        // Point DM users at the slash commands, stay quiet in the channel
+        if channel.Type == discordgo.ChannelTypeDM {
+            s.ChannelMessageSend(m.ChannelID, "Text commands are disabled. Please use the slash commands instead, type / to see them.")
+        }
+        return
+    }
+
+    log.Println("Got message: ", m.Content)
+
+    c := &commandContext{
+        s:         s,
+        userID:    m.Author.ID,
+        username:  m.Author.Username,
+        channelID: m.ChannelID,
+        messageID: m.ID,
+        isDM:      channel.Type == discordgo.ChannelTypeDM,
+        args:      parts,
+        reply: func(text string, private bool) {
+            s.ChannelMessageSend(m.ChannelID, text)
+        },
+    }
+    dispatchCommand(c)
+}
+
+// dispatchCommand routes a parsed command to its handler.
+func dispatchCommand(c *commandContext) {
+    if rateLimited(c) {
+        return
+    }
 
-    switch command {
+    switch c.args[0] {
     case "/register":
-        handleRegisterCommand(s, m, channel, args)
+        handleRegisterCommand(c)
     case "/state":
-        handleStateCommand(s, m)
+        handleStateCommand(c)
     case "/monitor":
-        handleMonitorCommand(s, m)
+        handleMonitorCommand(c)
     case "/track":
-        handleTrackCommand(s, m, args)
+        handleTrackCommand(c)
     case "/untrack":
-        handleUntrackCommand(s, m, args)
+        handleUntrackCommand(c)
+    case "/tracking":
+        handleTrackingCommand(c)
+    case "/stats":
+        handleStatsCommand(c)
+    case "/leaderboard":
+        handleLeaderboardCommand(c)
+    case "/devices":
+        handleDevicesCommand(c)
+    case "/unregister":
+        handleUnregisterCommand(c)
+    case "/whoami":
+        handleWhoamiCommand(c)
+    case "/reminders":
+        handleRemindersCommand(c)
+    case "/admin":
+        handleAdminCommand(c)
+    case "/help":
+        c.reply(usageText(), true)
     default:
         // Respond with detailed usage info for any other message
-        sendUnknownCommandResponse(s, m)
+        sendUnknownCommandResponse(c)
     }
 }
 
 // handleStateCommand processes the /state command.
-func handleStateCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func handleStateCommand(c *commandContext) {
     gameStatus, err := getCurrentGameStatus()
     if err != nil {
         log.Println("Error reading game status: ", err)
-        s.ChannelMessageSend(m.ChannelID, "Error retrieving game status.")
+        c.reply("Error retrieving game status.", false)
         return
     }
-    s.ChannelMessageSend(m.ChannelID, gameStatus)
+    c.reply(gameStatus, false)
 }
 
-// handleRegisterCommand processes the /register <IP> command.
-func handleRegisterCommand(s *discordgo.Session, m *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
-    if len(args) < 2 {
+// handleRegisterCommand processes the /register <IP> [device] command.
+func handleRegisterCommand(c *commandContext) {
+    // Slash commands leave out options that weren't given as ""
+    address, deviceArg := "", ""
+    if len(c.args) >= 2 {
+        address = c.args[1]
+    }
+    if len(c.args) >= 3 {
+        deviceArg = c.args[2]
+    }
+    if deviceArg != "" && !isDeviceName(deviceArg) {
+        c.reply(fmt.Sprintf("Invalid device name. Use up to %d letters, digits, - or _, e.g. /register 123.45.67.89 laptop", maxDeviceNameLength), true)
+        return
+    }
+    device := defaultDevice
+    if deviceArg != "" {
+        device = strings.ToLower(deviceArg)
+    }
+
+    // Without an IP, send a link that picks up the member's IP by itself
+    if registrationLinksEnabled() && (address == "" || (len(c.args) == 2 && isDeviceName(address))) {
+        if address != "" {
+            device = strings.ToLower(address) // /register laptop
+        }
+        if err := checkEligibility(c.s, c.userID, time.Now()); err != nil {
+            c.reply(err.Error(), true)
+            return
+        }
+        sendRegistrationLink(c, device)
+        return
+    }
+    if address == "" {
         log.Println("Invalid /register command format.")
-        s.ChannelMessageSend(m.ChannelID, "Invalid command or IP address format. Please use /register 123.45.67.89")
+        c.reply("Invalid command or IP address format. Please use /register 123.45.67.89", true)
         return
     }
 
-    if channel.Type != discordgo.ChannelTypeDM {
+    // Slash command replies are ephemeral so the IP stays private, text messages are not
+    if !c.isDM && c.messageID != "" {
         log.Println("/register command sent not in DM - deleting msg and warning user")
         // Delete the user's message
-        err := s.ChannelMessageDelete(m.ChannelID, m.ID)
+        err := c.s.ChannelMessageDelete(c.channelID, c.messageID)
         if err != nil {
             log.Println("Error deleting message:", err)
         }
-        s.ChannelMessageSend(m.ChannelID, "Send /register commands via DM only.")
+        c.reply("Send /register commands via DM only.", true)
         return
     }
 
-    ip := strings.TrimSpace(args[1])
-    if !isValidIP(ip) {
-        log.Println("Register: invalid IP: ", ip)
-        s.ChannelMessageSend(m.ChannelID, "Invalid IP address format. Please use /register 123.45.67.89")
+    // Only current members of the guild meeting the role and age requirements can register
+    if err := checkEligibility(c.s, c.userID, time.Now()); err != nil {
+        log.Printf("Register: %s may not register: %v", c.username, err)
+        c.reply(err.Error(), true)
         return
     }
 
-    if isLocalIP(ip) {
-        log.Println("Register: local IP not allowed: ", ip)
-        s.ChannelMessageSend(m.ChannelID, "Local IP addresses are not allowed. Please use a public IPv4 address.")
+    prefix, problem := checkRegistrationAddress(address)
+    if problem != "" {
+        c.reply(problem, true)
         return
     }
 
-    //// Get the nickname used by the user on the server
-    //username := getUsernameFromMember(s, m, m.Author.ID)
+    // Banned users and IPs are turned away before anything reaches the moderators
+    if ban, banned := findBan(c.userID, c.username, allowlistEntry(prefix), time.Now()); banned {
+        log.Printf("Register: %s is banned: %s", c.username, describeBanTarget(ban))
+        c.reply(banMessage(ban), true)
+        return
+    }
+
+    // Ranges are for ISPs that rotate addresses within a block and need a moderator's approval
+    if isRange(prefix) {
+        if rangeTooLarge(prefix) {
+            c.reply(fmt.Sprintf("This range is too large. Ranges can be at most /%d for IPv4 and /%d for IPv6.", 32-maxRangeBitsIPv4, 128-maxRangeBitsIPv6), true)
+            return
+        }
+        requestRangeApproval(c, prefix, device)
+        return
+    }
+    ip := allowlistEntry(prefix)
 
     // Store unique usernames in the backend, present nicknames to user in the frontend (bot status)
-    username := m.Author.Username
+    if err := registerIP(ip, c.userID, c.username, device); err != nil {
+        c.reply(registerErrorMessage(err), true)
+        return
+    }
+    c.reply(fmt.Sprintf("Your IP address %s has been successfully registered/refreshed%s. You can now connect to the game.", ip, deviceSuffix(device)), true)
+}
 
-    // Register IP in allowlist txt file and file with IP to username mapping
-    err := registerIP(ip, username)
+// checkRegistrationAddress parses the address given to /register. If it can't be
+// registered, it returns the message to show the member instead.
+func checkRegistrationAddress(text string) (netip.Prefix, string) {
+    prefix, err := parseRegistrationAddress(text)
     if err != nil {
-        log.Println("error: failed to register IP: ", ip)
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to register IP"))
-        return
+        log.Println("Register: invalid IP: ", text)
+        return prefix, "Invalid IP address format. Please use /register 123.45.67.89 (IPv6 addresses work too)"
+    }
+
+    if reason := reservedReason(prefix); reason != "" {
+        log.Printf("Register: %s IP not allowed: %s", reason, prefix)
+        return prefix, fmt.Sprintf("Local IP addresses are not allowed (%s range). Please use your public IP address.", reason)
+    }
+    return prefix, ""
+}
+
+// registerIP adds ip to the allowlist and maps it to a device of username. Both
+// /register and the registration link end up here.
+func registerIP(ip, userID, username, device string) error {
+    if ban, banned := findBan(userID, username, ip, time.Now()); banned {
+        log.Printf("Register: not registering %s for %s, banned: %s", ip, username, describeBanTarget(ban))
+        return &banError{ban}
     }
 
-    log.Println("Registered IP: ", ip)
-    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Your IP address %s has been successfully registered/refreshed. You can now connect to the game.", ip))
+    // Registering the same IP for the same device again only refreshes it
+    action := "register"
+    if registrations, err := store.Registrations(username); err == nil {
+        for _, r := range registrations {
+            if r.Device == device && r.IP == ip {
+                action = "refresh"
+            }
+        }
+    }
+
+    err := store.RegisterIP(ip, userID, username, device, time.Now())
+    if err != nil {
+        log.Println("error: failed to register IP: ", ip, err)
+        return err
+    }
+
+    log.Printf("Registered IP: %s (%s)", ip, device)
+    recordAudit(AuditEvent{Action: action, Actor: username, Target: username, IP: ip, Device: device})
+    countRegistration(action)
+    noteRegisteredIP(userID, username, ip, time.Now())
+    return nil
+}
+
+// registerErrorMessage explains a failed registration to the member.
+func registerErrorMessage(err error) string {
+    var banned *banError
+    if errors.As(err, &banned) {
+        return banMessage(banned.ban)
+    }
+    var ineligible *eligibilityError
+    if errors.As(err, &ineligible) {
+        return ineligible.reason
+    }
+    if err == errTooManyDevices {
+        return fmt.Sprintf("You already have %d devices registered. Remove one with /unregister <device> first, /devices lists them.", maxDevicesPerUser)
+    }
+    return "Failed to register IP"
 }
 
 //// getUsernameFromMember retrieves the username or nickname of a guild member.
@@ -287,36 +468,37 @@ func handleRegisterCommand(s *discordgo.Session, m *discordgo.MessageCreate, cha
 //    return username
 //}
 
-// sendUnknownCommandResponse sends a response for unknown commands.
-func sendUnknownCommandResponse(s *discordgo.Session, m *discordgo.MessageCreate) {
+// usageText lists the available commands.
+func usageText() string {
     url := "https://www.google.com/search?q=google+what+is+my+ip"
-    text := fmt.Sprintf("Unknown command. Here are the commands you can use:\n\n" +
-        "1. `/register <IP>` - Register your IP address with the VaM multiplayer server via DM to the bot. This will gain you entry to the server with 1 week expiration. If you cannot connect to the server in VaM, register again. To find your IP, visit the link below. Link:\n%s\n\n" +
-        "2. `/state` - Check the current game status to see who is playing. You can also see the same info in my status on Discord updated every 20s.\n\n" +
+    return fmt.Sprintf("Here are the commands you can use:\n\n" +
+        "1. `/register <IP> [device]` - Register your IPv4 or IPv6 address with the VaM multiplayer server via DM to the bot. Name the device, e.g. `/register 1.2.3.4 laptop`, to keep up to 3 devices registered at once. If your ISP keeps changing your address within a block, you can request a small range such as 1.2.3.0/28 which a moderator has to approve. Send `/register` without an IP to get a link that registers the IP of the device you open it on. This will gain you entry to the server with %s expiration. If you cannot connect to the server in VaM, register again. To find your IP, visit the link below. Link:\n%s\n\n" +
+        "2. `/state` - Check the current game status to see who is playing. You can also see the same info in my status on Discord, updated as soon as it changes.\n\n" +
         "3. `/monitor <hours>` - Enable monitoring for game status changes on this channel for X hours (useful for notifications)\n\n" +
         "4. `/track <username>` - Track when a user joins the game.\n" +
-        "5. `/untrack <username>` - Stop tracking user.\n\n" +
-        "Please use one of the above commands.\n", url)
-    s.ChannelMessageSend(m.ChannelID, text)
+        "5. `/untrack <username>` - Stop tracking user.\n" +
+        "6. `/tracking` - List the users you are tracking.\n" +
+        "7. `/stats [username]` - Show playtime statistics of a user, `/stats room [name]` shows peak times of the rooms.\n" +
+        "8. `/leaderboard [week|month|all]` - Rank players by playtime.\n" +
+        "9. `/devices` - List your registered devices and when they expire.\n" +
+        "10. `/unregister [device]` - Remove your registration or one of your registered devices.\n" +
+        "11. `/whoami` - Show your registrations and when they expire.\n" +
+        "12. `/reminders on|off` - Get a DM with a renew button a day before a registration expires.\n\n" +
+        "Please use one of the above commands.\n", formatTTL(registrationTTL()), url)
 }
 
+// sendUnknownCommandResponse sends a response for unknown commands.
+func sendUnknownCommandResponse(c *commandContext) {
+    c.reply("Unknown command. "+usageText(), true)
+}
 
-
-// alwaysMonitorChannel checks if always_monitor_channel.txt file is present, and if so,
-// reads the channel ID from the file and sets its expiry time to 999999 hours in the future.
+// alwaysMonitorChannel monitors the always monitored channel from the config, if
+// there is one, by setting its expiry time to 999999 hours in the future.
 func alwaysMonitorChannel() {
-	if _, err := os.Stat(alwaysMonitorFileName); os.IsNotExist(err) {
-		// File does not exist
+	channelID := alwaysMonitoredChannel()
+	if channelID == "" {
 		return
 	}
-
-	data, err := ioutil.ReadFile(alwaysMonitorFileName)
-	if err != nil {
-		log.Printf("Failed to read %s: %v", alwaysMonitorFileName, err)
-		return
-	}
-
-	channelID := strings.TrimSpace(string(data))
 	expiryTime := time.Now().Add(999999 * time.Hour)
 
 	mu.Lock()
@@ -327,29 +509,26 @@ func alwaysMonitorChannel() {
 }
 
 // handleMonitorCommand handles the /monitor <hours> command
-func handleMonitorCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	st, err := s.Channel(m.ChannelID)
-	if err != nil {
-		log.Println("Error retrieving Channel type")
-		return
-	}
-
-	if st.Type == discordgo.ChannelTypeDM {
+func handleMonitorCommand(c *commandContext) {
+	if c.isDM {
 		log.Println("/monitor command sent in DM - ignoring")
-		s.ChannelMessageSend(m.ChannelID, "The /monitor command can only be used in a server channel.")
+		c.reply("The /monitor command can only be used in a server channel.", true)
 		return
 	}
 
 	// Parse the command
 	var hours int
-	_, err = fmt.Sscanf(m.Content, "/monitor %d", &hours)
-	if err != nil || hours <= 0 {
-		s.ChannelMessageSend(m.ChannelID, "Usage: /monitor <hours>")
+	var err error
+	if len(c.args) >= 2 {
+		hours, err = strconv.Atoi(c.args[1])
+	}
+	if len(c.args) < 2 || err != nil || hours <= 0 {
+		c.reply("Usage: /monitor <hours>", true)
 		return
 	}
 	if hours > monitorMaxHours {
 		text := fmt.Sprintf("You can only monitor for maximum %d hours.", monitorMaxHours)
-		s.ChannelMessageSend(m.ChannelID, text)
+		c.reply(text, true)
 		return
 	}
 
@@ -360,111 +539,88 @@ func handleMonitorCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 //
 //	// Update the monitored channels map
 //	mu.Lock()
-//	monitoredChannels[m.ChannelID] = expiryTime
+//	monitoredChannels[c.channelID] = expiryTime
 //	mu.Unlock()
 
-	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Monitoring this channel for %d hours.", hours))
+	c.reply(fmt.Sprintf("Monitoring this channel for %d hours.", hours), false)
 }
 
-// getCurrentGameStatus reads the last line of the file to get the current game status
-// it does that for both files (for both rooms)
+// getCurrentGameStatus reads the last line of the status file of every room
+// defined in rooms.json and renders the current game status
 func getCurrentGameStatus() (string, error) {
-	filenameRoom1 := "current_players_port8888.txt"
-	filenameRoom2 := "current_players_port9999.txt"
-
-	statusRoom1, err := getRoomStatus(filenameRoom1, "ROOM1")
+	snaps, err := currentSnapshots()
 	if err != nil {
 		return "", err
 	}
+	return renderGameStatus(snaps), nil
+}
 
-	statusRoom2, err := getRoomStatus(filenameRoom2, "ROOM2")
-	if err != nil {
-		return "", err
+// renderGameStatus renders room snapshots as the status text shown in Discord.
+func renderGameStatus(snaps []RoomSnapshot) string {
+	status := "-----------------\n"
+	for _, snap := range snaps {
+		status += renderRoomStatus(snap) + "\n"
 	}
-
-	return fmt.Sprintf("-----------------\n%s\n%s\n\n", statusRoom1, statusRoom2), nil
+	return status + "\n"
 }
 
-func getRoomStatus(filePath, roomLabel string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	var lastLine string
-	scanner := bufio.NewScanner(file)
-	fileEmpty := true  // Flag to check if the file is empty
-	for scanner.Scan() {
-		lastLine = scanner.Text()
-		fileEmpty = false // File has at least one line
+func renderRoomStatus(snap RoomSnapshot) string {
+	room := snap.Room
+	roomLabel := room.Name
+	if room.Description != "" {
+		roomLabel = fmt.Sprintf("%s (%s)", room.Name, room.Description)
 	}
 
-	// if file is empty - just say the room is not running
-	if fileEmpty {
-		return fmt.Sprintf("%s:\n%s", roomLabel, "Not running."), nil
+	if snap.Down != "" {
+		return fmt.Sprintf("%s:\nDown (%s).", roomLabel, snap.Down)
 	}
-
-	if err := scanner.Err(); err != nil {
-		return "", err
+	// if file is missing or empty - just say the room is not running
+	if !snap.Running {
+		return fmt.Sprintf("%s:\n%s", roomLabel, "Not running.")
 	}
-
-	// Parsing the last line to extract game status
-	parts := strings.SplitN(lastLine, ";", 2)
-	if len(parts) != 2 {
-		return fmt.Sprintf("%s: Invalid game status format in file.", roomLabel), nil
+	if snap.Problem != "" {
+		return fmt.Sprintf("%s: %s", roomLabel, snap.Problem)
 	}
 
-	timestamp, state := parts[0], parts[1]
+	// Show how full the room is
+	if room.PlayerLimit > 0 && len(snap.Players) > 0 {
+		roomLabel = fmt.Sprintf("%s %d/%d", roomLabel, countControlledPlayers(snap.Players), room.PlayerLimit)
+	}
 
 	// Convert timestamp to human-readable format
-	timestampInt, err := strconv.ParseInt(timestamp, 10, 64)
-	if err != nil {
-		return fmt.Sprintf("%s: Error parsing timestamp.", roomLabel), nil
-	}
-	timestampStr := time.Unix(timestampInt, 0).Format(time.RFC1123)
+	timestampStr := snap.Updated.Format(time.RFC1123)
+	return fmt.Sprintf("%s:\n%s", roomLabel, renderPlayerDetails(snap.Players, timestampStr))
+}
 
-	// Build the player details string
-	playerDetails, err := getPlayerDetails(state, timestampStr)
-	if err != nil {
-		return "", err
+// countControlledPlayers counts the players that are not spectators.
+func countControlledPlayers(players []PlayerPresence) int {
+	count := 0
+	for _, player := range players {
+		if !player.Spectator {
+			count++
+		}
 	}
-
-	return fmt.Sprintf("%s:\n%s", roomLabel, playerDetails), nil
+	return count
 }
 
 func getUsernameFromIP(ip string) (string, error) {
-    allowlistMutex.Lock()
-    defer allowlistMutex.Unlock()
-
-    file, err := os.Open(usernamesFile)
+    uniqueUsernames, err := store.UsernamesForIP(ip)
     if err != nil {
         return "", err
     }
-    defer file.Close()
-
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        parts := strings.SplitN(line, " ", 2)
-        if len(parts) != 2 {
-            continue
-        }
-
-        if parts[0] == ip {
-            uniqueUsername := strings.TrimSpace(parts[1])
-            return getProcessedUsername(discordSession, guildID, uniqueUsername)
+    // A shared IP belongs to all of its owners
+    var names []string
+    for _, uniqueUsername := range uniqueUsernames {
+        name, err := getProcessedUsername(discordSession, guildID, uniqueUsername)
+        if err != nil {
+            return "", err
         }
+        names = append(names, name)
     }
-
-    if err := scanner.Err(); err != nil {
-        return "", err
-    }
-
-    return "", fmt.Errorf("IP %s not found", ip)
+    return strings.Join(names, " or "), nil
 }
 
-func getProcessedUsername(s *discordgo.Session, guildID, uniqueUsername string) (string, error) {
+func getProcessedUsername(s discordAPI, guildID, uniqueUsername string) (string, error) {
     if s == nil {
         return uniqueUsername, nil
     }
@@ -494,242 +650,229 @@ func getProcessedUsername(s *discordgo.Session, guildID, uniqueUsername string)
     return uniqueUsername, nil
 }
 
-func getPlayerDetails(state, timestampStr string) (string, error) {
-	if state == "" {
-		return fmt.Sprintf("%s: Empty.", timestampStr), nil
+func renderPlayerDetails(players []PlayerPresence, timestampStr string) string {
+	if len(players) == 0 {
+		return fmt.Sprintf("%s: Empty.", timestampStr)
 	}
 
-	playerInfo := strings.Split(state, ",")
-	playerDetails := ""
-	sceneNames := make(map[string]int)
-	lastScene := ""
-	for _, info := range playerInfo {
-		playerParts := strings.Split(info, ":")
-		if len(playerParts) < 3 || len(playerParts) > 4 {
-			continue // Skip invalid entries
-		}
-		// get username from mapping file based on IP
-		// we want to avoid showing user IPs
-		username, err := getUsernameFromIP(playerParts[0])
-		if err != nil {
-			username = "unknown"
+	// check if all players are on same scene - then print scene only at the end
+	sameScene := players[0].Scene
+	for _, player := range players {
+		if player.Scene != sameScene {
+			sameScene = ""
+			break
 		}
-		characterName := playerParts[2]
-		sceneName := ""
-		if len(playerParts) == 4 {
-			sceneName = playerParts[3]
-			sceneNames[sceneName]++
-			lastScene = sceneName
-		}
-		if "@SPECTATOR@" == characterName {
+	}
+
+	playerDetails := ""
+	for _, player := range players {
+		// show nicknames, never player IPs
+		username := displayName(player)
+		if player.Spectator {
 			playerDetails += fmt.Sprintf("%s is SPECTATOR.\n", username)
 		} else {
-			playerDetails += fmt.Sprintf("%s controls %s.\n", username, characterName)
+			playerDetails += fmt.Sprintf("%s controls %s.\n", username, player.Character)
 		}
-		if sceneName != "" {
-			playerDetails += fmt.Sprintf("%s is on %s\n", username, sceneName)
+		if sameScene == "" && player.Scene != "" {
+			playerDetails += fmt.Sprintf("%s is on %s\n", username, player.Scene)
 		}
 	}
-	// check if all players are on same scene
-	if len(sceneNames) == 1 && sceneNames[lastScene] == len(playerInfo) {
-		// they are - run the same loop again but print scene only at the end (TODO optimize this)
-		playerDetails = ""
-		for _, info := range playerInfo {
-			playerParts := strings.Split(info, ":")
-			if len(playerParts) < 3 || len(playerParts) > 4 {
-				continue // Skip invalid entries
-			}
-			// get username from mapping file based on IP
-			// we want to avoid showing user IPs
-			username, err := getUsernameFromIP(playerParts[0])
-			if err != nil {
-				username = "unknown"
-			}
-			characterName := playerParts[2]
-			if "@SPECTATOR@" == characterName {
-				playerDetails += fmt.Sprintf("%s is SPECTATOR.\n", username)
-			} else {
-				playerDetails += fmt.Sprintf("%s controls %s.\n", username, characterName)
-			}
-		}
-		playerDetails += fmt.Sprintf("Players running scene: %s\n", lastScene)
+	if sameScene != "" {
+		playerDetails += fmt.Sprintf("Players running scene: %s\n", sameScene)
 	}
 
-	return fmt.Sprintf("%s:\n%s", timestampStr, playerDetails), nil
+	return fmt.Sprintf("%s:\n%s", timestampStr, playerDetails)
 }
 
-func isValidIP(ip string) bool {
-	ipTrimmed := strings.TrimSpace(ip)
-	re := regexp.MustCompile(`^\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`)
-	return re.MatchString(ipTrimmed)
+// displayName returns the Discord nickname of a player, or "unknown" if their IP is not registered.
+func displayName(player PlayerPresence) string {
+	if player.Username == "" {
+		return ownersDisplayName(player, displayName)
+	}
+	name, err := getProcessedUsername(discordSession, guildID, player.Username)
+	if err != nil {
+		log.Println("Error getting nickname:", err)
+	}
+	return name
 }
 
-func isLocalIP(ip string) bool {
-    ipAddress := net.ParseIP(strings.TrimSpace(ip))
-    if ipAddress == nil {
-        return false
-    }
-
-    // Check for private IP ranges
-    privateIPRanges := []struct {
-        start net.IP
-        end   net.IP
-    }{
-        {net.ParseIP("10.0.0.0"), net.ParseIP("10.255.255.255")},
-        {net.ParseIP("172.16.0.0"), net.ParseIP("172.31.255.255")},
-        {net.ParseIP("192.168.0.0"), net.ParseIP("192.168.255.255")},
-        {net.ParseIP("127.0.0.0"), net.ParseIP("127.255.255.255")},
-    }
-
-    for _, r := range privateIPRanges {
-        if bytes.Compare(ipAddress, r.start) >= 0 && bytes.Compare(ipAddress, r.end) <= 0 {
-            return true
-        }
-    }
-
-    return false
+// ownersDisplayName names a player whose IP is shared by several users as all
+// of them, or "unknown" if nobody registered the IP.
+func ownersDisplayName(player PlayerPresence, name func(PlayerPresence) string) string {
+	if len(player.Owners) == 0 {
+		return "unknown"
+	}
+	var names []string
+	for _, owner := range player.Owners {
+		names = append(names, name(PlayerPresence{Username: owner}))
+	}
+	return strings.Join(names, " or ")
 }
 
-func startCleanupTimer() {
-	ticker := time.NewTicker(6 * time.Hour)
+func startCleanupTimer(ctx context.Context) error {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			cleanupExpiredIPs()
+			enforceBans(time.Now())
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-func startPlayerStateMonitor(s *discordgo.Session) {
-	ticker := time.NewTicker(20* time.Second)
+// startPlayerStateMonitor updates the player status whenever a room status file changes.
+// Changes are picked up through file watching and debounced, so a burst of writes
+// leads to one update once it is over. If watching is not available the status
+// files are polled instead.
+func startPlayerStateMonitor(ctx context.Context, s discordAPI) error {
+	watcher, err := newFileWatcher()
+	if err != nil {
+		log.Println("File watching unavailable, polling room status files:", err)
+		return pollPlayerState(ctx, s)
+	}
+	defer watcher.Close()
+
+	if err := watchRoomFiles(watcher); err != nil {
+		log.Println("Error watching room status files, polling instead:", err)
+		return pollPlayerState(ctx, s)
+	}
+	updatePlayerStatus(s)
+
+	debounce := time.NewTimer(statusDebounce)
+	stopTimer(debounce)
+	defer debounce.Stop()
+	var settled <-chan time.Time
 	for {
 		select {
-		case <-ticker.C:
+		case _, ok := <-watcher.Changes:
+			if !ok {
+				log.Println("File watching stopped, polling room status files")
+				return pollPlayerState(ctx, s)
+			}
+			// Wait until the writes have been quiet for statusDebounce before updating
+			stopTimer(debounce)
+			debounce.Reset(statusDebounce)
+			settled = debounce.C
+		case <-roomHealthChanged:
+			updatePlayerStatus(s)
+		case <-settled:
+			settled = nil
 			updatePlayerStatus(s)
+			// rooms.json may have added rooms in the meantime
+			if err := watchRoomFiles(watcher); err != nil {
+				log.Println("Error watching room status files:", err)
+			}
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
 
-func updatePlayerStatus(s *discordgo.Session) {
-    gameStatus, err := getCurrentGameStatus()
-    if err != nil {
-        log.Println("Error getting game status:", err)
-        return
-    }
-
-    if gameStatus != prevPlayerStatus {
-        updateMonitoredChannelsWithStatus(s, gameStatus)
-
-        // Parse previous players from prevPlayerStatus
-        previousPlayers, err := parsePlayerStatus(prevPlayerStatus)
-        if err != nil {
-            log.Println("Error parsing previous player status:", err)
-            previousPlayers = make(map[string]struct{}) // Assume no previous players
-        }
+// stopTimer stops timer and drains its channel so that it can be reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
 
-        // Update previousPlayerStatus
-        prevPlayerStatus = gameStatus
+// watchRoomFiles watches rooms.json and the status file of every room.
+func watchRoomFiles(watcher *fileWatcher) error {
+	if err := watcher.Watch(roomsFileName); err != nil {
+		return err
+	}
+	for _, room := range currentRooms() {
+		if err := watcher.Watch(room.StatusFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-        // Parse current players from gameStatus
-        currentPlayers, err := parsePlayerStatus(gameStatus)
-        if err != nil {
-            log.Println("Error parsing player status:", err)
-            return
-        }
+// pollPlayerState is the fallback when file watching is not available.
+func pollPlayerState(ctx context.Context, s discordAPI) error {
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			updatePlayerStatus(s)
+		case <-roomHealthChanged:
+			updatePlayerStatus(s)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
 
-        // Determine newly joined players
-        newlyJoinedPlayers := []string{}
-        for player := range currentPlayers {
-            if _, exists := previousPlayers[player]; !exists {
-                newlyJoinedPlayers = append(newlyJoinedPlayers, player)
-            }
-        }
+func updatePlayerStatus(s discordAPI) {
+    start := time.Now()
+    defer func() { observeStatusUpdate(time.Since(start)) }()
 
-        // Determine disconnected players
-        disconnectedPlayers := []string{}
-        for player := range previousPlayers {
-            if _, exists := currentPlayers[player]; !exists {
-                disconnectedPlayers = append(disconnectedPlayers, player)
-            }
-        }
+    // Keep the session history in step with the status files
+    history.update()
 
-        // Convert newly joined players to Discord usernames
-        var newlyJoinedUsernames []string
-        for _, player := range newlyJoinedPlayers {
-            user, err := findUserInGuild(s, guildID, player)
-            if err != nil {
-                log.Printf("Error finding user for player %s: %v", player, err)
-                continue
-            }
-            newlyJoinedUsernames = append(newlyJoinedUsernames, user.Username)
-        }
+    snaps, err := currentSnapshots()
+    if err != nil {
+        log.Println("Error getting game status:", err)
+        return
+    }
 
-        // Notify trackers about newly joined players (send DMs)
-        if len(newlyJoinedUsernames) > 0 {
-            notifyTrackers(s, newlyJoinedUsernames)
-        }
+    if reflect.DeepEqual(snaps, prevSnapshots) {
+        return
+    }
 
-        // Reset notifiedTrackings for disconnected players
-        for _, player := range disconnectedPlayers {
-            user, err := findUserInGuild(s, guildID, player)
-            if err != nil {
-                log.Printf("Error finding user for player %s: %v", player, err)
-                continue
-            }
-            resetNotified(user.Username)
+    events := diffSnapshots(prevSnapshots, snaps)
+    wasPresent := presentUsers(prevSnapshots)
+    isPresent := presentUsers(snaps)
+    prevSnapshots = snaps
+
+    // Users who just joined any room, a move between rooms does not count
+    var newlyJoinedUsernames []string
+    for _, event := range events {
+        log.Printf("%s: %s %s", event.Room, event.Player.identity(), event.Type)
+        username := event.Player.Username
+        if event.Type == PlayerJoined && username != "" && !wasPresent[username] {
+            newlyJoinedUsernames = appendIfMissing(newlyJoinedUsernames, username)
         }
+    }
 
-        // Discord limitation on status length
-        if len(gameStatus) > 125 {
-            err = s.UpdateCustomStatus("Send /state command to check the state of rooms")
-        } else {
-            err = s.UpdateCustomStatus(gameStatus)
-        }
+    // Notify trackers about newly joined players (send DMs)
+    if len(newlyJoinedUsernames) > 0 {
+        notifyTrackers(s, newlyJoinedUsernames)
+    }
 
-        if err != nil {
-            log.Println("Error updating custom status:", err)
+    // Reset notifiedTrackings for disconnected players
+    for username := range wasPresent {
+        if !isPresent[username] {
+            resetNotified(username)
         }
     }
-}
-
-// parsePlayerStatus parses the game status string and returns a set of usernames.
-func parsePlayerStatus(gameStatus string) (map[string]struct{}, error) {
-    players := make(map[string]struct{})
 
-    // Split the status by lines
-    lines := strings.Split(gameStatus, "\n")
-    for _, line := range lines {
-        line = strings.TrimSpace(line)
-        if line == "" {
-            continue
-        }
+    // Render the text only now, from the snapshots
+    gameStatus := renderGameStatus(snaps)
+    updateMonitoredChannelsWithStatus(s, gameStatus)
 
-        // Example player line formats:
-        // user1 controls AVATAR3.
-        // user2 controls AVATAR1.
-
-        if strings.Contains(line, "controls") {
-            parts := strings.Split(line, "controls")
-            if len(parts) >= 1 {
-                username := strings.TrimSpace(parts[0])
-                // Remove any leading/trailing characters like bullets or numbering if present
-                username = strings.Trim(username, "•- ")
-                if username != "" {
-                    players[username] = struct{}{}
-                }
-            }
-        }
+    // Discord limitation on status length
+    if len(gameStatus) > 125 {
+        err = s.UpdateCustomStatus("Send /state command to check the state of rooms")
+    } else {
+        err = s.UpdateCustomStatus(gameStatus)
     }
 
-    return players, nil
+    if err != nil {
+        log.Println("Error updating custom status:", err)
+    }
 }
 
-
-func notifyTrackers(s *discordgo.Session, newlyJoinedPlayers []string) {
+func notifyTrackers(s discordAPI, newlyJoinedPlayers []string) {
     // Get the current tracking data
-    trackingMutex.Lock()
-    trackedMap, err := getTrackedUsers()
-    trackingMutex.Unlock()
+    trackedMap, err := store.TrackedUsers()
 
     if err != nil {
         log.Printf("Error reading tracking data: %v", err)
@@ -744,8 +887,8 @@ func notifyTrackers(s *discordgo.Session, newlyJoinedPlayers []string) {
 
         for _, tracker := range trackers {
             if !hasNotified(tracker, player) {
-                // Send DM to tracker
-                go sendDM(s, tracker, player)
+                // Queue a DM to the tracker
+                trackerDMs.add(trackerDM{s: s, tracker: tracker, trackedUser: player})
                 // Mark as notified
                 markAsNotified(tracker, player)
             }
@@ -753,7 +896,7 @@ func notifyTrackers(s *discordgo.Session, newlyJoinedPlayers []string) {
     }
 }
 
-func updateMonitoredChannelsWithStatus(dg *discordgo.Session, currentState string) {
+func updateMonitoredChannelsWithStatus(dg discordAPI, currentState string) {
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -767,270 +910,21 @@ func updateMonitoredChannelsWithStatus(dg *discordgo.Session, currentState strin
 	}
 }
 
-func registerIP(ip string, username string) error {
-	allowlistMutex.Lock()
-	defer allowlistMutex.Unlock()
-
-	// Add IP-username mapping in file
-	fileUsernames, err := os.OpenFile(usernamesFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Println("error opening usernames file,", err)
-		return err
-	}
-	defer fileUsernames.Close()
-
-	var updatedLinesUsernames []string
-	userExists := false
-	scanner := bufio.NewScanner(fileUsernames)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			continue
-		}
-		existingIP := parts[0]
-		existingUser := parts[1]
-		if existingUser == username {
-			// update IP for user
-			updatedLinesUsernames = append(updatedLinesUsernames, fmt.Sprintf("%s %s", ip, username))
-			userExists = true
-		} else {
-			updatedLinesUsernames = append(updatedLinesUsernames, fmt.Sprintf("%s %s", existingIP, existingUser))
-		}
-	}
-
-	if !userExists {
-		updatedLinesUsernames = append(updatedLinesUsernames, fmt.Sprintf("%s %s", ip, username))
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Println("error reading usernames file,", err)
-		return err
-	}
-
-	fileUsernames.Seek(0, 0)
-	fileUsernames.Truncate(0)
-
-	for _, line := range updatedLinesUsernames {
-		_, err := fileUsernames.WriteString(line + "\n")
-		if err != nil {
-			log.Println("error writing to usernames file,", err)
-			return err
-		}
-	}
-
-	// Now update allowlist text file
-	currentTime := time.Now().Unix()
-	var updatedLinesAllowlist []string
-	ipExists := false
-
-	fileAllowlist, err := os.OpenFile(allowlistFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Println("error opening allowlist file,", err)
-		return err
-	}
-	defer fileAllowlist.Close()
-
-	scanner = bufio.NewScanner(fileAllowlist)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			continue
-		}
-		existingIP := parts[0]
-		timestamp := parts[1]
-
-		if existingIP == ip {
-			updatedLinesAllowlist = append(updatedLinesAllowlist, fmt.Sprintf("%s %d", ip, currentTime))
-			ipExists = true
-		} else {
-			updatedLinesAllowlist = append(updatedLinesAllowlist, fmt.Sprintf("%s %s", existingIP, timestamp))
-		}
-	}
-
-	if !ipExists {
-		updatedLinesAllowlist = append(updatedLinesAllowlist, fmt.Sprintf("%s %d", ip, currentTime))
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Println("error reading allowlist file,", err)
-		return err
-	}
-
-	fileAllowlist.Seek(0, 0)
-	fileAllowlist.Truncate(0)
-
-	for _, line := range updatedLinesAllowlist {
-		_, err := fileAllowlist.WriteString(line + "\n")
-		if err != nil {
-			log.Println("error writing to allowlist file,", err)
-			return err
-		}
-	}
-
-	return nil
-}
-
 func cleanupExpiredIPs() {
 	log.Println("Cleaning up expired IPs")
-	allowlistMutex.Lock()
-	defer allowlistMutex.Unlock()
-
-	expiredIPs := make(map[string]struct{})
-
-	currentTime := time.Now().Unix()
-	var updatedLines []string
-
-	file, err := os.OpenFile(allowlistFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Println("error opening allowlist file,", err)
-		return
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			continue
-		}
-		ip := parts[0]
-		timestamp, err := strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			continue
-		}
-
-		if currentTime-timestamp <= int64(expirationTime.Seconds()) {
-			updatedLines = append(updatedLines, line)
-		} else {
-			log.Printf("Expired IP removed: %s\n", ip)
-			expiredIPs[ip] = struct{}{}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Println("error reading allowlist file,", err)
-		return
-	}
-
-	file.Seek(0, 0)
-	file.Truncate(0)
-
-	for _, line := range updatedLines {
-		_, err := file.WriteString(line + "\n")
-		if err != nil {
-			log.Println("error writing to allowlist file,", err)
-		}
-	}
-
-	// No need to proceed if no IPs were expired
-	if len(expiredIPs) == 0 {
-		return
-	}
-
-	// Now clear the expired IPs from usernames mapping file
-	var updatedLinesUsernames []string
-	fileUsernames, err := os.OpenFile(usernamesFile, os.O_RDWR|os.O_CREATE, 0644)
+	expired, removed, err := store.RemoveExpired(time.Now(), registrationTTL())
 	if err != nil {
-		log.Println("error opening usernames file,", err)
-		return
-	}
-	defer fileUsernames.Close()
-
-	scanner = bufio.NewScanner(fileUsernames)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			continue
-		}
-		existingIP := parts[0]
-		existingUser:= parts[1]
-		// skip lines with expired IPs
-		if _, exists := expiredIPs[existingIP]; !exists {
-			updatedLinesUsernames = append(updatedLinesUsernames, fmt.Sprintf("%s %s", existingIP, existingUser))
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Println("error reading usernames file,", err)
-		return
+		log.Println("error cleaning up expired IPs,", err)
 	}
-
-	fileUsernames.Seek(0, 0)
-	fileUsernames.Truncate(0)
-
-	for _, line := range updatedLinesUsernames {
-		_, err := fileUsernames.WriteString(line + "\n")
-		if err != nil {
-			log.Println("error writing to usernames file,", err)
-			return
-		}
+	for _, ip := range removed {
+		log.Printf("Expired IP removed: %s\n", ip)
 	}
+	auditRemoved("expire", auditBot, "", expired)
+	countExpired(len(expired))
 }
 
 // Track and Untrack commands: users can get private DMs when someone who they track joins game
 
-// getTrackedUsers reads the tracking.txt file and returns a map of tracked users to their trackers.
-func getTrackedUsers() (map[string][]string, error) {
-    trackedMap := make(map[string][]string)
-
-    file, err := os.Open(trackingFile)
-    if err != nil {
-        if os.IsNotExist(err) {
-            // If the file doesn't exist, return an empty map
-            return trackedMap, nil
-        }
-        return nil, err
-    }
-    defer file.Close()
-
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := strings.TrimSpace(scanner.Text())
-        if line == "" {
-            continue
-        }
-        parts := strings.SplitN(line, " ", 2)
-        if len(parts) != 2 {
-            log.Printf("Invalid tracking line format: %s", line)
-            continue
-        }
-        trackedUser := parts[0]
-        trackers := strings.Split(parts[1], ",")
-        for i, tracker := range trackers {
-            trackers[i] = strings.TrimSpace(tracker)
-        }
-        trackedMap[trackedUser] = trackers
-    }
-
-    if err := scanner.Err(); err != nil {
-        return nil, err
-    }
-
-    return trackedMap, nil
-}
-
-// addTracking adds a trackedUser to the tracker's tracking list in tracking.txt.
-func addTracking(tracker, trackedUser string) error {
-    trackingMutex.Lock()
-    defer trackingMutex.Unlock()
-
-    // Read existing tracking data
-    trackedMap, err := getTrackedUsers()
-    if err != nil {
-        return err
-    }
-
-    // Append the tracker to the trackedUser's list of trackers in tracking.txt.
-    trackedMap[trackedUser] = appendIfMissing(trackedMap[trackedUser], tracker)
-
-    // Write back to tracking.txt
-    return writeTrackingData(trackedMap)
-}
-
 // appendIfMissing appends an item to a slice if it's not already present.
 func appendIfMissing(slice []string, item string) []string {
     for _, v := range slice {
@@ -1041,33 +935,6 @@ func appendIfMissing(slice []string, item string) []string {
     return append(slice, item)
 }
 
-func removeTracking(tracker, trackedUser string) error {
-    trackingMutex.Lock()
-    defer trackingMutex.Unlock()
-
-    // Read existing tracking data
-    trackedMap, err := getTrackedUsers()
-    if err != nil {
-        log.Printf("Error getting tracked users: %v", err)
-        return err
-    }
-
-    // Remove the tracker from the trackedUser's tracker list
-    if trackers, exists := trackedMap[trackedUser]; exists {
-        updatedTrackers := removeFromSlice(trackers, tracker)
-        if len(updatedTrackers) == 0 {
-            delete(trackedMap, trackedUser)
-        } else {
-            trackedMap[trackedUser] = updatedTrackers
-        }
-    } else {
-        return fmt.Errorf("you are not tracking %s", trackedUser)
-    }
-
-    // Write back to tracking.txt
-    return writeTrackingData(trackedMap)
-}
-
 func removeFromSlice(slice []string, item string) []string {
     updated := []string{}
     for _, v := range slice {
@@ -1078,93 +945,102 @@ func removeFromSlice(slice []string, item string) []string {
     return updated
 }
 
-func writeTrackingData(trackedMap map[string][]string) error {
-    file, err := os.OpenFile(trackingFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-    if err != nil {
-        log.Printf("Error opening tracking file: %v", err)
-        return err
-    }
-    defer file.Close()
-
-    writer := bufio.NewWriter(file)
-    for trackedUser, trackers := range trackedMap {
-        line := fmt.Sprintf("%s %s\n", trackedUser, strings.Join(trackers, ","))
-        if _, err := writer.WriteString(line); err != nil {
-            log.Printf("Error writing line: %v", err)
-            return err
-        }
-    }
-
-    return writer.Flush()
-}
-
 // handleTrackCommand processes the /track <username> command.
-func handleTrackCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
-    if len(args) < 2 {
-        s.ChannelMessageSend(m.ChannelID, "Usage: /track <username>")
+func handleTrackCommand(c *commandContext) {
+    if len(c.args) < 2 {
+        c.reply("Usage: /track <username>", true)
         return
     }
 
-    tracker := m.Author.Username
-    trackedUserIdentifier := strings.TrimSpace(args[1])
+    tracker := c.username
+    trackedUserIdentifier := strings.TrimSpace(c.args[1])
 
     if trackedUserIdentifier == "" {
-        s.ChannelMessageSend(m.ChannelID, "Please provide a valid username to track.")
+        c.reply("Please provide a valid username to track.", true)
         return
     }
 
     // Find the user in the guild
-    trackedUser, err := findUserInGuild(s, guildID, trackedUserIdentifier)
+    trackedUser, err := findUserInGuild(c.s, guildID, trackedUserIdentifier)
     if err != nil {
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+        c.reply(fmt.Sprintf("Error: %v", err), true)
         return
     }
 
     // Use the unique username for tracking
-    err = addTracking(tracker, trackedUser.Username)
+    err = store.AddTracking(tracker, trackedUser.Username)
     if err != nil {
         log.Printf("Error adding tracking: %v", err)
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to track %s. Error: %v", trackedUser.Username, err))
+        c.reply(fmt.Sprintf("Failed to track %s. Error: %v", trackedUser.Username, err), true)
         return
     }
 
-    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You are now tracking %s.", trackedUser.Username))
+    recordAudit(AuditEvent{Action: "track", Actor: tracker, Target: trackedUser.Username})
+    c.reply(fmt.Sprintf("You are now tracking %s.", trackedUser.Username), true)
 }
 
 // handleUntrackCommand processes the /untrack <username> command.
-func handleUntrackCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
-    if len(args) < 2 {
-        s.ChannelMessageSend(m.ChannelID, "Usage: /untrack <username>")
+func handleUntrackCommand(c *commandContext) {
+    if len(c.args) < 2 {
+        c.reply("Usage: /untrack <username>", true)
         return
     }
 
-    tracker := m.Author.Username
-    trackedUserIdentifier := strings.TrimSpace(args[1])
+    tracker := c.username
+    trackedUserIdentifier := strings.TrimSpace(c.args[1])
 
     if trackedUserIdentifier == "" {
-        s.ChannelMessageSend(m.ChannelID, "Please provide a valid username to untrack.")
+        c.reply("Please provide a valid username to untrack.", true)
         return
     }
 
     // Find the user in the guild
-    trackedUser, err := findUserInGuild(s, guildID, trackedUserIdentifier)
+    trackedUser, err := findUserInGuild(c.s, guildID, trackedUserIdentifier)
     if err != nil {
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+        c.reply(fmt.Sprintf("Error: %v", err), true)
         return
     }
 
     // Use the unique username for untracking
-    err = removeTracking(tracker, trackedUser.Username)
+    err = store.RemoveTracking(tracker, trackedUser.Username)
     if err != nil {
         log.Printf("Error removing tracking: %v", err)
-        s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to untrack %s. Error: %v", trackedUser.Username, err))
+        c.reply(fmt.Sprintf("Failed to untrack %s. Error: %v", trackedUser.Username, err), true)
         return
     }
 
-    s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You have stopped tracking %s.", trackedUser.Username))
+    recordAudit(AuditEvent{Action: "untrack", Actor: tracker, Target: trackedUser.Username})
+    c.reply(fmt.Sprintf("You have stopped tracking %s.", trackedUser.Username), true)
+}
+
+// handleTrackingCommand processes the /tracking command, listing who the caller tracks.
+func handleTrackingCommand(c *commandContext) {
+    trackedMap, err := store.TrackedUsers()
+    if err != nil {
+        log.Printf("Error reading tracking data: %v", err)
+        c.reply("Failed to read your tracking list.", true)
+        return
+    }
+
+    var tracked []string
+    for trackedUser, trackers := range trackedMap {
+        for _, tracker := range trackers {
+            if tracker == c.username {
+                tracked = append(tracked, trackedUser)
+                break
+            }
+        }
+    }
+
+    if len(tracked) == 0 {
+        c.reply("You are not tracking anyone. Use /track <username> to start.", true)
+        return
+    }
+    sort.Strings(tracked)
+    c.reply(fmt.Sprintf("You are tracking: %s", strings.Join(tracked, ", ")), true)
 }
 
-func sendDM(s *discordgo.Session, tracker, trackedUser string) {
+func sendDM(s discordAPI, tracker, trackedUser string) {
     user, err := findUserInGuild(s, guildID, tracker)
     if err != nil {
         log.Printf("Failed to find user %s: %v", tracker, err)
@@ -1189,7 +1065,7 @@ func sendDM(s *discordgo.Session, tracker, trackedUser string) {
 }
 
 // Helper function to find a user in the guild
-func findUserInGuild(s *discordgo.Session, guildID string, userIdentifier string) (*discordgo.User, error) {
+func findUserInGuild(s discordAPI, guildID string, userIdentifier string) (*discordgo.User, error) {
     members, err := s.GuildMembers(guildID, "", 1000)
     if err != nil {
         return nil, fmt.Errorf("error fetching guild members: %v", err)
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// testBot holds the fake session and temporary room files of one test.
+type testBot struct {
+	fake *fakeDiscord
+	dir  string
+}
+
+// replace sets a global to value for the rest of the test and puts the old
+// value back when it ends.
+func replace[T any](t *testing.T, global *T, value T) {
+	saved := *global
+	*global = value
+	t.Cleanup(func() { *global = saved })
+}
+
+// newTestBot points the bot's globals at a fake Discord session, an in-memory
+// store and two rooms with status files in a temporary directory. Every global
+// a test may change is replaced here, so it is restored when the test ends.
+func newTestBot(t *testing.T) *testBot {
+	t.Helper()
+	dir := t.TempDir()
+	fake := newFakeDiscord()
+
+	// Discord and the store
+	replace[Store](t, &store, newMemStore())
+	replace[discordAPI](t, &discordSession, fake)
+	replace(t, &guildID, "guild")
+	replace(t, &displayNameCache, make(map[string]cachedName))
+
+	// Rooms, snapshots and history
+	replace(t, &roomsFileName, filepath.Join(dir, "rooms.json"))
+	replace(t, &rooms, nil)
+	replace(t, &roomsModTime, time.Time{})
+	replace(t, &prevSnapshots, nil)
+	replace(t, &notifiedTrackings, make(map[string]map[string]bool))
+	replace(t, &monitoredChannels, make(map[string]time.Time))
+	replace(t, &history, newHistoryIndex())
+	history.ready.Store(true)
+	// The test status lines are from 1970, keep them all
+	replace(t, &historyRetention, 100*365*24*time.Hour)
+	replace(t, &sessionOwnersFileName, filepath.Join(dir, "session_owners.jsonl"))
+
+	// Moderation and registration links
+	replace(t, &moderatorChannelID, "")
+	replace(t, &pendingRanges, make(map[string]*rangeRequest))
+	replace(t, &adminRoleIDs, nil)
+	replace(t, &auditLogFileName, filepath.Join(dir, "audit_log.jsonl"))
+	replace(t, &auditChannelID, "")
+	replace(t, &registrationLinkBaseURL, "")
+	replace(t, &trustedProxyHeader, "")
+	replace(t, &usedTokens, make(map[string]time.Time))
+	replace(t, &registrationRoleID, "")
+	replace(t, &minAccountAge, 0)
+	replace(t, &minMembershipAge, 0)
+
+	// Rate limits and alerts, the limits themselves are the defaults
+	limits := make(map[string]rateLimit)
+	for command, limit := range rateLimits {
+		limits[command] = limit
+	}
+	replace(t, &rateLimits, limits)
+	replace(t, &commandLimiter, newRateLimiter())
+	replace(t, &distinctIPAlertCount, distinctIPAlertCount)
+	replace(t, &distinctIPAlertWindow, distinctIPAlertWindow)
+	replace(t, &recentIPs, make(map[string][]seenIP))
+	replace(t, &distinctIPAlerted, make(map[string]time.Time))
+	resetBotMetrics()
+
+	// Room health
+	replace(t, &probeRoom, func(host string, port int) error { return nil })
+	replace(t, &probeHost, probeHost)
+	replace(t, &staleRoomAfter, 12*time.Hour)
+	replace(t, &roomDownReasons, make(map[string]string))
+	replace(t, &roomProbeFailures, make(map[string]int))
+	discordConnected.Store(false)
+
+	// Cleanups run last in first out, so the queue is drained before it is put back
+	dms := newDMQueue(dmQueueSize)
+	replace(t, &trackerDMs, dms)
+	go dms.run()
+	t.Cleanup(dms.closeAndWait)
+	audits := newAuditQueue(auditQueueSize)
+	replace(t, &auditMirror, audits)
+	go audits.run()
+	t.Cleanup(audits.closeAndWait)
+
+	roomsJSON := fmt.Sprintf(`[
+		{"name": "ROOM1", "port": 8888, "status_file": %q, "player_limit": 8},
+		{"name": "ROOM2", "port": 9999, "status_file": %q, "player_limit": 8}
+	]`, filepath.Join(dir, "room1.txt"), filepath.Join(dir, "room2.txt"))
+	if err := ioutil.WriteFile(roomsFileName, []byte(roomsJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testBot{fake: fake, dir: dir}
+}
+
+// appendStatus appends a status line to a room file, like VAMMultiplayerTCPServer.py does.
+func (b *testBot) appendStatus(t *testing.T, room string, timestamp int64, state string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(b.dir, room+".txt"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%d;%s\n", timestamp, state)
+}
+
+// command builds a text command context whose replies are recorded.
+func (b *testBot) command(userID, username string, isDM bool, text string, replies *[]string) *commandContext {
+	return &commandContext{
+		s:         b.fake,
+		userID:    userID,
+		username:  username,
+		channelID: "channel",
+		messageID: "message",
+		isDM:      isDM,
+		args:      strings.Fields(text),
+		reply: func(reply string, private bool) {
+			*replies = append(*replies, reply)
+		},
+	}
+}
+
+func TestHandleRegisterCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		isDM      bool
+		text      string
+		wantReply string
+		wantUser  string // expected owner of 8.8.8.8 afterwards, empty for none
+	}{
+		{"valid", true, "/register 8.8.8.8", "successfully registered", "alice"},
+		{"missing IP", true, "/register", "Please use /register", ""},
+		{"invalid IP", true, "/register not-an-ip", "Invalid IP address format", ""},
+		{"local IP", true, "/register 192.168.1.10", "Local IP addresses are not allowed", ""},
+		{"IPv6", true, "/register 2606:4700::1111", "successfully registered", ""},
+		{"link-local IPv6", true, "/register fe80::1", "Local IP addresses are not allowed", ""},
+		{"not in DM", false, "/register 8.8.8.8", "via DM only", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.fake.addMember("1", "alice", "")
+			var replies []string
+			handleRegisterCommand(b.command("1", "alice", tt.isDM, tt.text, &replies))
+
+			if len(replies) != 1 || !strings.Contains(replies[0], tt.wantReply) {
+				t.Errorf("replies = %q, want one containing %q", replies, tt.wantReply)
+			}
+			user, _ := usernameOf(store, "8.8.8.8")
+			if user != tt.wantUser {
+				t.Errorf("8.8.8.8 registered to %q, want %q", user, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestRegisterInChannelDeletesMessage(t *testing.T) {
+	b := newTestBot(t)
+	var replies []string
+	handleRegisterCommand(b.command("1", "alice", false, "/register 8.8.8.8", &replies))
+
+	if len(b.fake.deleted) != 1 || b.fake.deleted[0] != "message" {
+		t.Errorf("deleted messages = %v, want the /register message", b.fake.deleted)
+	}
+}
+
+func TestRegisterSlashDeviceWithoutIP(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	var replies []string
+	c := b.command("1", "alice", true, "", &replies)
+	c.messageID = ""
+	c.args = []string{"/register", "", "laptop"} // /register device:laptop
+	handleRegisterCommand(c)
+	if len(replies) != 1 || !strings.Contains(replies[0], "Please use /register") {
+		t.Errorf("replies = %q, want the usage", replies)
+	}
+
+	c.args = []string{"/register", "8.8.8.8", "laptop"}
+	handleRegisterCommand(c)
+	if registrations, _ := store.Registrations("alice"); len(registrations) != 1 || registrations[0].Device != "laptop" {
+		t.Errorf("registrations = %+v, want 8.8.8.8 for laptop", registrations)
+	}
+}
+
+func TestCleanupExpiredIPs(t *testing.T) {
+	newTestBot(t)
+	now := time.Now()
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, now.Add(-expirationTime-time.Hour))
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, now)
+
+	cleanupExpiredIPs()
+
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Errorf("expired registration of alice was kept")
+	}
+	if user, _ := usernameOf(store, "9.9.9.9"); user != "bob" {
+		t.Errorf("registration of bob was removed")
+	}
+}
+
+func TestGetCurrentGameStatus(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "Ally")
+	b.fake.addMember("2", "bob", "")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+
+	b.appendStatus(t, "room1", 1700000000, "")
+	b.appendStatus(t, "room1", 1700000100, "8.8.8.8:5000:Player1:Hotel,9.9.9.9:5001:@SPECTATOR@:Hotel")
+
+	status, err := getCurrentGameStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"ROOM1 1/8:",
+		"Ally controls Player1.",
+		"bob is SPECTATOR.",
+		"Players running scene: Hotel",
+		"ROOM2:\nNot running.",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("status missing %q:\n%s", want, status)
+		}
+	}
+	if strings.Contains(status, "8.8.8.8") {
+		t.Errorf("status exposes a player IP:\n%s", status)
+	}
+}
+
+func TestRenderPlayerDetailsUnknownIP(t *testing.T) {
+	newTestBot(t)
+	details := renderPlayerDetails([]PlayerPresence{{IP: "1.2.3.4", Port: "5000", Character: "Player1"}}, "now")
+	if !strings.Contains(details, "unknown controls Player1.") {
+		t.Errorf("details = %q, want unregistered IP shown as unknown", details)
+	}
+}
+
+func TestUpdatePlayerStatusNotifiesTrackers(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "Ally")
+	b.fake.addMember("3", "carol", "")
+	b.fake.addChannel("monitored", "vam-mp-bot", discordgo.ChannelTypeGuildText)
+	monitoredChannels["monitored"] = time.Now().Add(time.Hour)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.AddTracking("carol", "alice")
+
+	// alice joins
+	b.appendStatus(t, "room1", 1700000000, "8.8.8.8:5000:Player1")
+	updatePlayerStatus(b.fake)
+
+	dms := b.fake.waitForMessages(t, "dm-3", 1)
+	if len(dms) != 1 || !strings.Contains(dms[0], "alice") {
+		t.Fatalf("carol's DMs = %q, want one about alice joining", dms)
+	}
+	if monitored := b.fake.sentTo("monitored"); len(monitored) != 1 || !strings.Contains(monitored[0], "Ally controls Player1.") {
+		t.Errorf("monitored channel messages = %q", monitored)
+	}
+	if len(b.fake.customStatuses) != 1 {
+		t.Errorf("custom status updated %d times, want 1", len(b.fake.customStatuses))
+	}
+
+	// Nothing changed - no new notifications
+	updatePlayerStatus(b.fake)
+	if monitored := b.fake.sentTo("monitored"); len(monitored) != 1 {
+		t.Errorf("unchanged status was posted again: %q", monitored)
+	}
+
+	// alice switches character - still the same session, no new DM
+	b.appendStatus(t, "room1", 1700000010, "8.8.8.8:5000:Player2")
+	updatePlayerStatus(b.fake)
+
+	// alice leaves and comes back - carol is notified again
+	b.appendStatus(t, "room1", 1700000020, "")
+	updatePlayerStatus(b.fake)
+	if hasNotified("carol", "alice") {
+		t.Errorf("notification record of alice not reset after she left")
+	}
+	b.appendStatus(t, "room1", 1700000030, "8.8.8.8:5000:Player1")
+	updatePlayerStatus(b.fake)
+
+	dms = b.fake.waitForMessages(t, "dm-3", 2)
+	if len(dms) != 2 {
+		t.Errorf("carol's DMs = %q, want two join notifications", dms)
+	}
+}
+
+func TestHandleTrackCommands(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "Ally")
+
+	var replies []string
+	handleTrackCommand(b.command("3", "carol", true, "/track Ally", &replies))
+	handleTrackingCommand(b.command("3", "carol", true, "/tracking", &replies))
+	handleUntrackCommand(b.command("3", "carol", true, "/untrack alice", &replies))
+	handleTrackCommand(b.command("3", "carol", true, "/track nobody", &replies))
+
+	want := []string{
+		"You are now tracking alice.",
+		"You are tracking: alice",
+		"You have stopped tracking alice.",
+		"Error: user not found in guild",
+	}
+	if strings.Join(replies, "|") != strings.Join(want, "|") {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+}
+
+func TestMessageCreateIgnoresOtherChannels(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	b.fake.addChannel("general", "general", discordgo.ChannelTypeGuildText)
+	b.fake.addChannel("dm", "", discordgo.ChannelTypeDM)
+
+	message := func(channelID, content string) *discordgo.MessageCreate {
+		return &discordgo.MessageCreate{Message: &discordgo.Message{
+			ID: "m", ChannelID: channelID, Content: content,
+			Author: &discordgo.User{ID: "1", Username: "alice"},
+		}}
+	}
+
+	messageCreate(b.fake, "bot", message("general", "/state"), "vam-mp-bot")
+	if sent := b.fake.sent(); len(sent) != 0 {
+		t.Errorf("bot answered in a channel it should ignore: %v", sent)
+	}
+
+	messageCreate(b.fake, "bot", message("dm", "/register 8.8.8.8"), "vam-mp-bot")
+	if user, _ := usernameOf(store, "8.8.8.8"); user != "alice" {
+		t.Errorf("DM /register did not register alice")
+	}
+}
+
+func TestUpdatePlayerStatusSpectatorAndAwkwardNickname(t *testing.T) {
+	b := newTestBot(t)
+	// A nickname containing "controls" used to break the status parsing
+	b.fake.addMember("1", "alice", "alice controls everything")
+	b.fake.addMember("3", "carol", "")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.AddTracking("carol", "alice")
+
+	b.appendStatus(t, "room2", 1700000000, "8.8.8.8:5000:@SPECTATOR@")
+	updatePlayerStatus(b.fake)
+
+	dms := b.fake.waitForMessages(t, "dm-3", 1)
+	if len(dms) != 1 || !strings.Contains(dms[0], "alice") {
+		t.Errorf("carol's DMs = %q, want one about alice joining as spectator", dms)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	probeHost         = "127.0.0.1"            // the room servers run next to the bot
+	staleRoomAfter    = 12 * time.Hour         // 0 disables the check
+	watchdogInterval  = time.Minute            // how often the room servers are probed
+	probeTimeout      = 5 * time.Second        // how long a probe waits for the connection
+	watchdogFailures  = 2                      // failed probes in a row before a room is down
+	roomHealthChanged = make(chan struct{}, 1) // wakes the player state monitor when a room goes down or up
+	discordConnected  atomic.Bool              // whether the gateway connection is up, for /readyz
+	roomHealthMutex   sync.Mutex
+	roomDownReasons   = make(map[string]string) // room name -> why the room is down
+	roomProbeFailures = make(map[string]int)    // room name -> failed probes in a row
+)
+
+// probeRoom checks that the room server accepts TCP connections. The server
+// closes connections from IPs that are not on the allowlist, which is fine.
+var probeRoom = func(host string, port int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func init() {
+	metricsMux.HandleFunc("/healthz", handleHealthz)
+	metricsMux.HandleFunc("/readyz", handleReadyz)
+}
+
+// roomDownReason returns why the watchdog considers a room down, or "" if it is up.
+func roomDownReason(name string) string {
+	roomHealthMutex.Lock()
+	defer roomHealthMutex.Unlock()
+	return roomDownReasons[name]
+}
+
+// startRoomWatchdog probes the room servers every watchdogInterval.
+func startRoomWatchdog(ctx context.Context, s discordAPI) error {
+	checkRooms(s, time.Now())
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			checkRooms(s, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// checkRooms probes every room and looks at the age of its last status line.
+// Moderators are told when a room goes down or comes back, and the player
+// state monitor is woken up so the custom status shows it.
+func checkRooms(s discordAPI, now time.Time) {
+	changed := false
+	for _, room := range currentRooms() {
+		reason := checkRoom(room, now)
+
+		roomHealthMutex.Lock()
+		previous, known := roomDownReasons[room.Name]
+		if !known || previous != reason {
+			roomDownReasons[room.Name] = reason
+		}
+		roomHealthMutex.Unlock()
+
+		if known && previous == reason {
+			continue
+		}
+		changed = true
+		switch {
+		case reason != "" && (!known || previous == ""):
+			log.Printf("Room %s (port %d) is down: %s", room.Name, room.Port, reason)
+			// A room that was already down when the bot started is not news
+			if known {
+				alertModerators(s, fmt.Sprintf("Room %s (port %d) is down: %s.", room.Name, room.Port, reason))
+			}
+		case reason == "" && known:
+			log.Printf("Room %s (port %d) is back up", room.Name, room.Port)
+			alertModerators(s, fmt.Sprintf("Room %s (port %d) is back up.", room.Name, room.Port))
+		}
+	}
+
+	if changed {
+		select {
+		case roomHealthChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkRoom returns why a room is down, or "" if it looks fine.
+func checkRoom(room Room, now time.Time) string {
+	err := probeRoom(probeHost, room.Port)
+
+	roomHealthMutex.Lock()
+	if err != nil {
+		roomProbeFailures[room.Name]++
+	} else {
+		roomProbeFailures[room.Name] = 0
+	}
+	failures := roomProbeFailures[room.Name]
+	previous, known := roomDownReasons[room.Name]
+	roomHealthMutex.Unlock()
+
+	if err != nil {
+		// One failed probe is not enough for a room that was up
+		if failures >= watchdogFailures || previous != "" || !known {
+			return "not accepting connections"
+		}
+		log.Printf("Probing room %s (port %d) failed: %v", room.Name, room.Port, err)
+	}
+
+	if staleRoomAfter > 0 {
+		line, ok, err := lastStatusLine(room.StatusFile)
+		if err != nil || !ok {
+			return ""
+		}
+		updated, players, err := parseStatusLine(line)
+		if err == nil && len(players) > 0 && now.Sub(updated) > staleRoomAfter {
+			return fmt.Sprintf("no status update for %s", formatDuration(now.Sub(updated)))
+		}
+	}
+	return ""
+}
+
+// alertModerators posts a message to the moderator channel, if there is one.
+func alertModerators(s discordAPI, message string) {
+	channelID := moderatorChannel()
+	if channelID == "" || s == nil {
+		return
+	}
+	if _, err := s.ChannelMessageSend(channelID, message); err != nil {
+		log.Printf("Error sending alert to the moderator channel: %v", err)
+	}
+}
+
+// handleHealthz answers as long as the bot process is serving HTTP.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz answers 200 when the bot is connected to Discord and can read
+// its store, 503 with the problems otherwise. Rooms that are down are listed
+// but do not make the bot unready.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if !discordConnected.Load() {
+		problems = append(problems, "not connected to Discord")
+	}
+	if _, err := store.AllRegistrations(); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot read registrations: %v", err))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, problem := range problems {
+			fmt.Fprintln(w, problem)
+		}
+	} else {
+		fmt.Fprintln(w, "ready")
+	}
+	for _, room := range currentRooms() {
+		if reason := roomDownReason(room.Name); reason != "" {
+			fmt.Fprintf(w, "room %s is down: %s\n", room.Name, reason)
+		}
+	}
+}
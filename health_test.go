@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeRoom(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Like the room server for an IP that is not on the allowlist
+			conn.Close()
+		}
+	}()
+
+	if err := probeRoom("127.0.0.1", port); err != nil {
+		t.Errorf("probe of a listening port failed: %v", err)
+	}
+	listener.Close()
+	if err := probeRoom("127.0.0.1", port); err == nil {
+		t.Error("probe of a closed port succeeded")
+	}
+}
+
+func TestRoomWatchdog(t *testing.T) {
+	b := newTestBot(t)
+	moderatorChannelID = "mods"
+	down := map[int]bool{}
+	probeRoom = func(host string, port int) error {
+		if down[port] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	now := time.Now()
+	b.appendStatus(t, "room1", now.Add(-time.Minute).Unix(), "8.8.8.8:5000:Player1")
+
+	checkRooms(b.fake, now)
+	if got := b.fake.sentTo("mods"); len(got) != 0 {
+		t.Fatalf("alerts while all rooms are up: %q", got)
+	}
+	select {
+	case <-roomHealthChanged:
+	default:
+	}
+
+	// A single failed probe is not enough
+	down[8888] = true
+	checkRooms(b.fake, now)
+	if reason := roomDownReason("ROOM1"); reason != "" {
+		t.Fatalf("ROOM1 down after one failed probe: %q", reason)
+	}
+	checkRooms(b.fake, now)
+	if reason := roomDownReason("ROOM1"); reason != "not accepting connections" {
+		t.Fatalf("ROOM1 down reason = %q", reason)
+	}
+	checkRooms(b.fake, now)
+	alerts := b.fake.sentTo("mods")
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "Room ROOM1 (port 8888) is down: not accepting connections") {
+		t.Fatalf("alerts = %q", alerts)
+	}
+
+	// The players of the dead room are not shown
+	snap, err := readRoomSnapshot(currentRooms()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Players) != 0 || snap.Down == "" {
+		t.Errorf("snapshot of a down room = %+v", snap)
+	}
+	if got := renderRoomStatus(snap); got != "ROOM1:\nDown (not accepting connections)." {
+		t.Errorf("renderRoomStatus = %q", got)
+	}
+
+	// The monitor is woken up to refresh the custom status
+	select {
+	case <-roomHealthChanged:
+	default:
+		t.Error("roomHealthChanged was not signalled")
+	}
+
+	down[8888] = false
+	checkRooms(b.fake, now)
+	alerts = b.fake.sentTo("mods")
+	if len(alerts) != 2 || alerts[1] != "Room ROOM1 (port 8888) is back up." {
+		t.Fatalf("alerts = %q", alerts)
+	}
+	if reason := roomDownReason("ROOM1"); reason != "" {
+		t.Errorf("ROOM1 still down: %q", reason)
+	}
+}
+
+func TestRoomWatchdogStaleStatus(t *testing.T) {
+	b := newTestBot(t)
+	moderatorChannelID = "mods"
+	now := time.Now()
+	b.appendStatus(t, "room1", now.Add(-13*time.Hour).Unix(), "8.8.8.8:5000:Player1")
+	// An empty room does not need to write anything
+	b.appendStatus(t, "room2", now.Add(-48*time.Hour).Unix(), "")
+
+	checkRooms(b.fake, now)
+	if reason := roomDownReason("ROOM1"); !strings.HasPrefix(reason, "no status update for") {
+		t.Errorf("ROOM1 down reason = %q", reason)
+	}
+	if reason := roomDownReason("ROOM2"); reason != "" {
+		t.Errorf("ROOM2 down reason = %q", reason)
+	}
+	// Rooms that are down when the bot starts are not announced
+	if got := b.fake.sentTo("mods"); len(got) != 0 {
+		t.Errorf("alerts = %q", got)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	newTestBot(t)
+
+	rec := httptest.NewRecorder()
+	metricsMux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("/healthz = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	metricsMux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "not connected to Discord") {
+		t.Errorf("/readyz before connecting = %d %q", rec.Code, rec.Body.String())
+	}
+
+	discordConnected.Store(true)
+	roomDownReasons["ROOM2"] = "not accepting connections"
+	rec = httptest.NewRecorder()
+	metricsMux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ready\nroom ROOM2 is down: not accepting connections\n" {
+		t.Errorf("/readyz = %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// sessionOwnersFileName keeps who each session was matched to when its status
+	// line was first read, one JSON record per line. Replays use it instead of the
+	// registrations of the day, which may have expired or moved to someone else.
+	sessionOwnersFileName = "session_owners.jsonl"
+
+	// historyRetention is how long ended sessions are kept one by one. Older ones
+	// only count towards the all-time stats, longer than the longest leaderboard
+	// period and the weekly digest.
+	historyRetention = 45 * 24 * time.Hour
+	// historyCompactInterval is how often sessions older than historyRetention
+	// are summarized.
+	historyCompactInterval = time.Hour
+)
+
+// Session is a stretch of time a player spent in a room with the same character
+// and scene. Switching character or scene closes the session and opens a new one
+// marked as Continued, so a visit to a room is only counted once.
+type Session struct {
+	Username  string // unique Discord username, empty if the IP was not registered
+	Room      string
+	Character string // empty for spectators
+	Spectator bool
+	Scene     string
+	Joined    time.Time
+	Left      time.Time // zero while the player is still in the room
+	Continued bool      // follows a character or scene switch of the same visit
+}
+
+// duration returns how long the session lasted, counting open sessions up to
+// now. Sessions in a room that went down are ended by historyIndex.update.
+func (s Session) duration(now time.Time) time.Duration {
+	if s.Left.IsZero() {
+		return now.Sub(s.Joined)
+	}
+	return s.Left.Sub(s.Joined)
+}
+
+// roomHistory is the replay state of one room's status file.
+type roomHistory struct {
+	reader  *tailReader
+	players []PlayerPresence // players at the last status line
+	lastAt  time.Time        // time of the last status line
+	open    map[string]int   // IP:port of connected players -> index in sessions
+	peak    int              // most players connected at the same time
+	peakAt  time.Time
+}
+
+// historyIndex rebuilds player sessions from the timestamped status lines the game
+// servers append to current_players_portNNNN.txt. Each file is read once from the
+// start by load and then followed incrementally by update.
+type historyIndex struct {
+	ready    atomic.Bool // set once load replayed the status files
+	mu       sync.Mutex
+	rooms    map[string]*roomHistory // room name -> replay state
+	sessions []Session
+	byIP     map[string][]int // player IP -> indexes in sessions, for affinity
+
+	// Sessions that ended before historyRetention, summarized by compact
+	pastUsers   map[string]*sessionSummary // username -> summary, registered users only
+	pastRooms   map[string]*sessionSummary // room name -> summary
+	compactedAt time.Time
+
+	owners    map[sessionKey]string // saved owners, nil until sessionOwnersFileName is read
+	newOwners []sessionOwner        // owners found by this update, saved at its end
+}
+
+// sessionSummary adds up sessions that are no longer kept one by one.
+type sessionSummary struct {
+	Sessions      int // visits, switches within a visit not counted
+	Playtime      time.Duration
+	CharacterTime map[string]time.Duration
+	SceneTime     map[string]time.Duration
+	HourTime      [24]time.Duration // playtime by hour of the day (UTC)
+}
+
+// add adds a session to the summary, counting open sessions up to now.
+func (s *sessionSummary) add(session Session, now time.Time) {
+	if s.CharacterTime == nil {
+		s.CharacterTime = make(map[string]time.Duration)
+		s.SceneTime = make(map[string]time.Duration)
+	}
+	d := session.duration(now)
+	if !session.Continued {
+		s.Sessions++
+	}
+	s.Playtime += d
+	if !session.Spectator && session.Character != "" {
+		s.CharacterTime[session.Character] += d
+	}
+	if session.Scene != "" {
+		s.SceneTime[session.Scene] += d
+	}
+	addHourlyTime(&s.HourTime, session.Joined, session.Joined.Add(d))
+}
+
+// clone returns a copy of the summary that can be added to.
+func (s *sessionSummary) clone() sessionSummary {
+	c := sessionSummary{Sessions: s.Sessions, Playtime: s.Playtime, HourTime: s.HourTime}
+	c.CharacterTime = make(map[string]time.Duration, len(s.CharacterTime))
+	for character, d := range s.CharacterTime {
+		c.CharacterTime[character] = d
+	}
+	c.SceneTime = make(map[string]time.Duration, len(s.SceneTime))
+	for scene, d := range s.SceneTime {
+		c.SceneTime[scene] = d
+	}
+	return c
+}
+
+// sessionOwner is one line of sessionOwnersFileName.
+type sessionOwner struct {
+	Room     string `json:"room"`
+	Joined   int64  `json:"joined"` // unix time of the status line that opened the session
+	Player   string `json:"player"` // IP:port
+	Username string `json:"username"`
+}
+
+type sessionKey struct {
+	room   string
+	joined int64
+	player string
+}
+
+var history = newHistoryIndex()
+
+func newHistoryIndex() *historyIndex {
+	return &historyIndex{
+		rooms:     make(map[string]*roomHistory),
+		byIP:      make(map[string][]int),
+		pastUsers: make(map[string]*sessionSummary),
+		pastRooms: make(map[string]*sessionSummary),
+	}
+}
+
+// load replays the status files from the start and marks the history ready.
+// It runs as a task of its own, since a long history takes a while to replay.
+func (h *historyIndex) load() {
+	start := time.Now()
+	h.mu.Lock()
+	h.updateLocked(start)
+	sessions := len(h.sessions)
+	h.mu.Unlock()
+
+	h.ready.Store(true)
+	log.Printf("Loaded the session history in %s, %d recent sessions", time.Since(start).Round(time.Millisecond), sessions)
+}
+
+// update reads new status lines of every room into the index. It does nothing
+// until load is done, so status updates and commands don't wait for the replay.
+func (h *historyIndex) update() {
+	if !h.ready.Load() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.updateLocked(time.Now())
+}
+
+func (h *historyIndex) updateLocked(now time.Time) {
+	// Replaying a long history looks up the same IPs over and over, read the
+	// registrations once
+	registrations, err := store.AllRegistrations()
+	if err != nil {
+		log.Printf("Error reading registrations for the history: %v", err)
+	}
+	owners := make(map[string][]string) // IP -> users who registered it
+	ownersOf := func(ip string) []string {
+		usernames, looked := owners[ip]
+		if !looked {
+			usernames, _ = usernamesForIP(registrations, ip)
+			owners[ip] = usernames
+		}
+		return usernames
+	}
+	if h.owners == nil {
+		h.owners, err = readSessionOwners(sessionOwnersFileName)
+		if err != nil {
+			log.Printf("Error reading %s: %v", sessionOwnersFileName, err)
+		}
+	}
+
+	for _, room := range currentRooms() {
+		rh, exists := h.rooms[room.Name]
+		if !exists || rh.reader.path != room.StatusFile {
+			rh = &roomHistory{reader: newTailReaderFromStart(room.StatusFile), open: make(map[string]int)}
+			h.rooms[room.Name] = rh
+		}
+		err := rh.reader.PollFunc(func(line string) {
+			h.ingest(room.Name, rh, line, ownersOf)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error reading history of %s: %v", room.Name, err)
+		}
+
+		// Nobody plays in a room that crashed or stopped writing its status,
+		// end the sessions where the status file does
+		if len(rh.open) > 0 && roomDownReason(room.Name) != "" {
+			for _, player := range rh.players {
+				h.close(rh, player, rh.lastAt)
+			}
+			rh.players = nil
+		}
+	}
+
+	if len(h.newOwners) > 0 {
+		if err := appendSessionOwners(sessionOwnersFileName, h.newOwners); err != nil {
+			log.Printf("Error writing %s: %v", sessionOwnersFileName, err)
+		}
+		h.newOwners = nil
+	}
+
+	if now.Sub(h.compactedAt) >= historyCompactInterval {
+		h.compact(now)
+		h.compactedAt = now
+	}
+}
+
+// compact summarizes the sessions that ended before historyRetention and drops
+// them, so the history doesn't grow without bound. Dropped sessions no longer
+// count towards affinity.
+func (h *historyIndex) compact(now time.Time) {
+	cutoff := now.Add(-historyRetention)
+	moved := make([]int, len(h.sessions)) // old index -> new index, -1 if dropped
+	kept := make([]Session, 0, len(h.sessions))
+	for i, s := range h.sessions {
+		if s.Left.IsZero() || !s.Left.Before(cutoff) {
+			moved[i] = len(kept)
+			kept = append(kept, s)
+			continue
+		}
+		moved[i] = -1
+		summaryFor(h.pastRooms, s.Room).add(s, now)
+		if s.Username != "" {
+			summaryFor(h.pastUsers, s.Username).add(s, now)
+		}
+	}
+	if len(kept) == len(h.sessions) {
+		return
+	}
+
+	// Open sessions are always kept
+	for _, rh := range h.rooms {
+		for key, i := range rh.open {
+			rh.open[key] = moved[i]
+		}
+	}
+	for ip, indexes := range h.byIP {
+		var remaining []int
+		for _, i := range indexes {
+			if moved[i] >= 0 {
+				remaining = append(remaining, moved[i])
+			}
+		}
+		if len(remaining) == 0 {
+			delete(h.byIP, ip)
+		} else {
+			h.byIP[ip] = remaining
+		}
+	}
+	log.Printf("Summarized %d sessions older than %s", len(h.sessions)-len(kept), historyRetention)
+	h.sessions = kept
+}
+
+// summaryFor returns the summary of key, adding an empty one if there is none.
+func summaryFor(summaries map[string]*sessionSummary, key string) *sessionSummary {
+	summary, ok := summaries[key]
+	if !ok {
+		summary = &sessionSummary{}
+		summaries[key] = summary
+	}
+	return summary
+}
+
+// pastSummary returns a copy of the summary of key, empty if there is none.
+func pastSummary(summaries map[string]*sessionSummary, key string) sessionSummary {
+	if summary, ok := summaries[key]; ok {
+		return summary.clone()
+	}
+	return sessionSummary{}
+}
+
+// ingest replays one status line of a room. ownersOf returns the users who
+// registered an IP.
+func (h *historyIndex) ingest(room string, rh *roomHistory, line string, ownersOf func(ip string) []string) {
+	at, players, err := parseStatusLine(line)
+	if err != nil {
+		return
+	}
+	resolveUsernames(players, ownersOf, h.affinityLocked)
+
+	switched := make(map[string]bool) // players whose session was already split for this line
+	for _, event := range diffRoom(room, rh.players, players) {
+		switch event.Type {
+		case PlayerJoined:
+			h.open(room, rh, event.Player, at, false)
+		case PlayerLeft:
+			h.close(rh, event.Player, at)
+		case PlayerSwitchedCharacter, PlayerChangedScene:
+			// A switch and a scene change can both be reported for the same player
+			if !switched[connectionKey(event.Player)] {
+				switched[connectionKey(event.Player)] = true
+				h.close(rh, event.Before, at)
+				h.open(room, rh, event.Player, at, true)
+			}
+		}
+	}
+	rh.players = players
+	rh.lastAt = at
+
+	if len(players) > rh.peak {
+		rh.peak = len(players)
+		rh.peakAt = at
+	}
+}
+
+func (h *historyIndex) open(room string, rh *roomHistory, player PlayerPresence, at time.Time, continued bool) {
+	// The owner found the first time this line was read wins
+	key := sessionKey{room, at.Unix(), connectionKey(player)}
+	username, saved := h.owners[key]
+	if !saved {
+		username = player.Username
+		h.owners[key] = username
+		h.newOwners = append(h.newOwners, sessionOwner{Room: room, Joined: at.Unix(), Player: connectionKey(player), Username: username})
+	}
+
+	h.sessions = append(h.sessions, Session{
+		Username:  username,
+		Room:      room,
+		Character: player.Character,
+		Spectator: player.Spectator,
+		Scene:     player.Scene,
+		Joined:    at,
+		Continued: continued,
+	})
+	rh.open[connectionKey(player)] = len(h.sessions) - 1
+	h.byIP[player.IP] = append(h.byIP[player.IP], len(h.sessions)-1)
+}
+
+func (h *historyIndex) close(rh *roomHistory, player PlayerPresence, at time.Time) {
+	key := connectionKey(player)
+	if i, ok := rh.open[key]; ok {
+		h.sessions[i].Left = at
+		delete(rh.open, key)
+	}
+}
+
+// affinity scores how well player fits the sessions username played before from
+// the same IP: two points for every session with the same character, one for
+// the same scene. It tells apart users who registered the same IP.
+func (h *historyIndex) affinity(username string, player PlayerPresence) int {
+	// Status updates don't wait for the replay
+	if !h.ready.Load() {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.affinityLocked(username, player)
+}
+
+func (h *historyIndex) affinityLocked(username string, player PlayerPresence) int {
+	score := 0
+	for _, i := range h.byIP[player.IP] {
+		s := h.sessions[i]
+		if s.Username != username {
+			continue
+		}
+		if s.Spectator == player.Spectator && s.Character == player.Character {
+			score += 2
+		}
+		if player.Scene != "" && s.Scene == player.Scene {
+			score++
+		}
+	}
+	return score
+}
+
+// readSessionOwners reads the saved session owners, a missing file means none.
+func readSessionOwners(path string) (map[sessionKey]string, error) {
+	owners := make(map[sessionKey]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return owners, nil
+	}
+	if err != nil {
+		return owners, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var owner sessionOwner
+		if err := json.Unmarshal(scanner.Bytes(), &owner); err != nil {
+			continue // a line cut short by a crash
+		}
+		owners[sessionKey{owner.Room, owner.Joined, owner.Player}] = owner.Username
+	}
+	return owners, scanner.Err()
+}
+
+func appendSessionOwners(path string, owners []sessionOwner) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, owner := range owners {
+		line, err := json.Marshal(owner)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func connectionKey(player PlayerPresence) string {
+	return player.IP + ":" + player.Port
+}
+
+// userSessions returns the recent sessions of a user.
+func (h *historyIndex) userSessions(username string) []Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.userSessionsLocked(username)
+}
+
+func (h *historyIndex) userSessionsLocked(username string) []Session {
+	var result []Session
+	for _, s := range h.sessions {
+		if s.Username == username {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// userStats summarizes every session of a user, recent and summarized.
+func (h *historyIndex) userStats(username string, now time.Time) UserStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return computeUserStats(pastSummary(h.pastUsers, username), h.userSessionsLocked(username), now)
+}
+
+// roomSessions returns the recent sessions in a room along with its peak concurrency.
+func (h *historyIndex) roomSessions(room string) (sessions []Session, peak int, peakAt time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.roomSessionsLocked(room)
+}
+
+func (h *historyIndex) roomSessionsLocked(room string) (sessions []Session, peak int, peakAt time.Time) {
+	for _, s := range h.sessions {
+		if s.Room == room {
+			sessions = append(sessions, s)
+		}
+	}
+	if rh, ok := h.rooms[room]; ok {
+		peak, peakAt = rh.peak, rh.peakAt
+	}
+	return sessions, peak, peakAt
+}
+
+// roomStats summarizes every session in a room, recent and summarized.
+func (h *historyIndex) roomStats(room string, now time.Time) RoomStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions, peak, peakAt := h.roomSessionsLocked(room)
+	return computeRoomStats(pastSummary(h.pastRooms, room), sessions, peak, peakAt, now)
+}
+
+// UserStats summarizes the sessions of a user.
+type UserStats struct {
+	Playtime           time.Duration
+	Sessions           int // visits to a room, switches within a visit not counted
+	FavouriteCharacter string
+	FavouriteScene     string
+}
+
+// computeUserStats adds sessions to the summary of the older sessions of a user.
+func computeUserStats(past sessionSummary, sessions []Session, now time.Time) UserStats {
+	total := past.clone()
+	for _, s := range sessions {
+		total.add(s, now)
+	}
+	return UserStats{
+		Playtime:           total.Playtime,
+		Sessions:           total.Sessions,
+		FavouriteCharacter: longest(total.CharacterTime),
+		FavouriteScene:     longest(total.SceneTime),
+	}
+}
+
+// RoomStats summarizes the sessions of a room.
+type RoomStats struct {
+	Sessions     int
+	Playtime     time.Duration
+	Peak         int
+	PeakAt       time.Time
+	BusiestHours []int // hours of the day (UTC), busiest first
+}
+
+// computeRoomStats adds sessions to the summary of the older sessions of a room.
+func computeRoomStats(past sessionSummary, sessions []Session, peak int, peakAt time.Time, now time.Time) RoomStats {
+	total := past.clone()
+	for _, s := range sessions {
+		total.add(s, now)
+	}
+	return RoomStats{
+		Sessions:     total.Sessions,
+		Playtime:     total.Playtime,
+		Peak:         peak,
+		PeakAt:       peakAt,
+		BusiestHours: busiestHours(total.HourTime),
+	}
+}
+
+// busiestHours returns the hours of the day that had any activity, busiest first.
+func busiestHours(hourTime [24]time.Duration) []int {
+	var hours []int
+	for hour, d := range hourTime {
+		if d > 0 {
+			hours = append(hours, hour)
+		}
+	}
+	sort.SliceStable(hours, func(i, j int) bool {
+		return hourTime[hours[i]] > hourTime[hours[j]]
+	})
+	return hours
+}
+
+// addHourlyTime spreads the time between from and to over the UTC hours of the day.
+func addHourlyTime(hourTime *[24]time.Duration, from, to time.Time) {
+	from, to = from.UTC(), to.UTC()
+	for from.Before(to) {
+		next := from.Truncate(time.Hour).Add(time.Hour)
+		if next.After(to) {
+			next = to
+		}
+		hourTime[from.Hour()] += next.Sub(from)
+		from = next
+	}
+}
+
+// longest returns the key with the largest duration, ties broken alphabetically.
+func longest(times map[string]time.Duration) string {
+	best := ""
+	for key, d := range times {
+		if best == "" || d > times[best] || (d == times[best] && key < best) {
+			best = key
+		}
+	}
+	return best
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryRebuildsSessions(t *testing.T) {
+	b := newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+
+	b.appendStatus(t, "room1", 1000, "")
+	b.appendStatus(t, "room1", 1100, "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", 1200, "8.8.8.8:5000:Player1:Hotel,9.9.9.9:5001:@SPECTATOR@:Hotel")
+	b.appendStatus(t, "room1", 1500, "8.8.8.8:5002:Player2:Hotel,9.9.9.9:5001:@SPECTATOR@:Hotel")
+	b.appendStatus(t, "room1", 1600, "9.9.9.9:5001:@SPECTATOR@:Hotel")
+	history.update()
+
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	want := []Session{
+		{Username: "alice", Room: "ROOM1", Character: "Player1", Scene: "Hotel", Joined: at(1100), Left: at(1500)},
+		{Username: "alice", Room: "ROOM1", Character: "Player2", Scene: "Hotel", Joined: at(1500), Left: at(1600), Continued: true},
+	}
+	if got := history.userSessions("alice"); !reflect.DeepEqual(got, want) {
+		t.Errorf("alice sessions = %+v, want %+v", got, want)
+	}
+
+	bob := history.userSessions("bob")
+	if len(bob) != 1 || !bob[0].Spectator || !bob[0].Left.IsZero() {
+		t.Errorf("bob sessions = %+v, want one open spectator session", bob)
+	}
+
+	// New lines are picked up incrementally
+	b.appendStatus(t, "room1", 1700, "")
+	history.update()
+	if bob := history.userSessions("bob"); bob[0].Left != at(1700) {
+		t.Errorf("bob's session not closed by the new status line: %+v", bob)
+	}
+
+	sessions, peak, peakAt := history.roomSessions("ROOM1")
+	if len(sessions) != 3 || peak != 2 || peakAt != at(1200) {
+		t.Errorf("room sessions = %d, peak %d at %v", len(sessions), peak, peakAt)
+	}
+}
+
+func TestHistoryKeepsSessionOwners(t *testing.T) {
+	b := newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1000, "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", 1100, "")
+	history.update()
+
+	// alice's registration expired and bob registered the IP before the bot restarted
+	store.RevokeUser("alice")
+	store.RegisterIP("8.8.8.8", "", "bob", defaultDevice, time.Now())
+	history = newHistoryIndex()
+	b.appendStatus(t, "room1", 1200, "8.8.8.8:5001:Player2:Beach")
+	history.load()
+
+	if alice := history.userSessions("alice"); len(alice) != 1 || alice[0].Character != "Player1" {
+		t.Errorf("alice sessions after the replay = %+v", alice)
+	}
+	if bob := history.userSessions("bob"); len(bob) != 1 || bob[0].Character != "Player2" {
+		t.Errorf("bob sessions = %+v, want only the new one", bob)
+	}
+}
+
+func TestHistoryWaitsForLoad(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1000, "8.8.8.8:5000:Player1:Hotel")
+	history = newHistoryIndex()
+
+	// Status updates and commands don't replay the files themselves
+	history.update()
+	if got := history.affinity("alice", PlayerPresence{IP: "8.8.8.8", Character: "Player1"}); got != 0 {
+		t.Errorf("affinity before the load = %d", got)
+	}
+	var replies []string
+	handleStatsCommand(b.command("1", "alice", true, "/stats", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "still loading") {
+		t.Errorf("/stats before the load = %q", replies)
+	}
+	if alice := history.userSessions("alice"); len(alice) != 0 {
+		t.Errorf("sessions before the load = %+v", alice)
+	}
+
+	history.load()
+	if alice := history.userSessions("alice"); len(alice) != 1 {
+		t.Errorf("sessions after the load = %+v", alice)
+	}
+	b.appendStatus(t, "room1", 1100, "")
+	history.update()
+	if alice := history.userSessions("alice"); alice[0].Left != time.Unix(1100, 0) {
+		t.Errorf("session not closed by an update after the load: %+v", alice)
+	}
+}
+
+func TestHistoryCompactsOldSessions(t *testing.T) {
+	b := newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1000, "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", 4600, "9.9.9.9:5001:Player2:Beach")
+	b.appendStatus(t, "room1", 8200, "9.9.9.9:5001:Player2:Beach,8.8.8.8:5002:Player1:Hotel")
+	history.update()
+	now := time.Unix(9000, 0)
+	before := history.userStats("alice", now)
+	leaders := history.leaderboard(time.Time{}, now)
+
+	// Only alice's first session ended before the retention
+	historyRetention = time.Hour
+	history.mu.Lock()
+	history.compact(now)
+	history.mu.Unlock()
+
+	if alice := history.userSessions("alice"); len(alice) != 1 || alice[0].Joined != time.Unix(8200, 0) {
+		t.Errorf("alice sessions after compacting = %+v", alice)
+	}
+	if got := history.userStats("alice", now); !reflect.DeepEqual(got, before) {
+		t.Errorf("alice stats after compacting = %+v, want %+v", got, before)
+	}
+	if got := history.leaderboard(time.Time{}, now); !reflect.DeepEqual(got, leaders) {
+		t.Errorf("all-time leaderboard after compacting = %+v, want %+v", got, leaders)
+	}
+	if stats := history.roomStats("ROOM1", now); stats.Sessions != 3 || stats.Playtime != 3600*time.Second+4400*time.Second+800*time.Second {
+		t.Errorf("room stats after compacting = %+v", stats)
+	}
+	if got := history.affinity("alice", PlayerPresence{IP: "8.8.8.8", Character: "Player1"}); got != 2 {
+		t.Errorf("affinity after compacting = %d, want 2 for the kept session", got)
+	}
+
+	// The open sessions still end where the status file says
+	b.appendStatus(t, "room1", 9500, "")
+	history.update()
+	if alice := history.userSessions("alice"); alice[0].Left != time.Unix(9500, 0) {
+		t.Errorf("alice's open session after compacting = %+v", alice)
+	}
+	if bob := history.userSessions("bob"); len(bob) != 1 || bob[0].Left != time.Unix(9500, 0) {
+		t.Errorf("bob's open session after compacting = %+v", bob)
+	}
+}
+
+func TestHistoryEndsSessionsInDownRooms(t *testing.T) {
+	b := newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1000, "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", 1300, "8.8.8.8:5000:Player1:Hotel")
+	history.update()
+	if alice := history.userSessions("alice"); len(alice) != 1 || !alice[0].Left.IsZero() {
+		t.Fatalf("alice sessions = %+v, want one open session", alice)
+	}
+
+	roomDownReasons["ROOM1"] = "not accepting connections"
+	history.update()
+	if alice := history.userSessions("alice"); alice[0].Left != time.Unix(1300, 0) {
+		t.Errorf("session in the down room left at %v, want the last status line", alice[0].Left)
+	}
+
+	// Players still there when the room comes back start a new session
+	roomDownReasons["ROOM1"] = ""
+	b.appendStatus(t, "room1", 5000, "8.8.8.8:5000:Player1:Hotel")
+	history.update()
+	alice := history.userSessions("alice")
+	if len(alice) != 2 || alice[1].Joined != time.Unix(5000, 0) || alice[1].Continued || alice[0].Left != time.Unix(1300, 0) {
+		t.Errorf("alice sessions after the room came back = %+v", alice)
+	}
+}
+
+func TestHistoryAffinity(t *testing.T) {
+	newTestBot(t)
+	history.sessions = []Session{
+		{Username: "alice", Character: "Player1", Scene: "Hotel"},
+		{Username: "alice", Character: "Player1", Scene: "Beach"},
+		{Username: "bob", Spectator: true, Scene: "Hotel"},
+		{Username: "bob", Character: "Player1"}, // from another IP, doesn't count
+	}
+	history.byIP = map[string][]int{"8.8.8.8": {0, 1, 2}, "9.9.9.9": {3}}
+
+	tests := []struct {
+		username string
+		player   PlayerPresence
+		want     int
+	}{
+		{"alice", PlayerPresence{IP: "8.8.8.8", Character: "Player1", Scene: "Hotel"}, 5},
+		{"alice", PlayerPresence{IP: "8.8.8.8", Character: "Player2", Scene: "Beach"}, 1},
+		{"bob", PlayerPresence{IP: "8.8.8.8", Spectator: true}, 2},
+		{"bob", PlayerPresence{IP: "8.8.8.8", Character: "Player1"}, 0},
+	}
+	for _, tt := range tests {
+		if got := history.affinity(tt.username, tt.player); got != tt.want {
+			t.Errorf("affinity(%s, %+v) = %d, want %d", tt.username, tt.player, got, tt.want)
+		}
+	}
+}
+
+func TestComputeUserStats(t *testing.T) {
+	base := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+	sessions := []Session{
+		{Character: "Player1", Scene: "Hotel", Joined: base, Left: base.Add(time.Hour)},
+		{Character: "Player2", Scene: "Hotel", Joined: base.Add(time.Hour), Left: base.Add(90 * time.Minute), Continued: true},
+		{Character: "Player2", Scene: "Beach", Joined: base.Add(24 * time.Hour), Left: base.Add(24*time.Hour + 20*time.Minute)},
+		{Spectator: true, Scene: "Beach", Joined: base.Add(48 * time.Hour), Left: base.Add(50 * time.Hour)},
+	}
+
+	stats := computeUserStats(sessionSummary{}, sessions, base)
+	if stats.Playtime != 3*time.Hour+50*time.Minute {
+		t.Errorf("playtime = %v", stats.Playtime)
+	}
+	if stats.Sessions != 3 {
+		t.Errorf("sessions = %d, want 3 visits", stats.Sessions)
+	}
+	if stats.FavouriteCharacter != "Player1" || stats.FavouriteScene != "Beach" {
+		t.Errorf("favourites = %q, %q", stats.FavouriteCharacter, stats.FavouriteScene)
+	}
+}
+
+func TestComputeRoomStatsBusiestHours(t *testing.T) {
+	base := time.Date(2024, 6, 1, 20, 30, 0, 0, time.UTC)
+	sessions := []Session{
+		{Joined: base, Left: base.Add(2 * time.Hour)},                                // 20:30-22:30
+		{Joined: base.Add(30 * time.Minute), Left: base.Add(90 * time.Minute)},       // 21:00-22:00
+		{Joined: base.Add(24 * time.Hour), Left: base.Add(24*time.Hour + time.Hour)}, // 20:30-21:30
+	}
+
+	stats := computeRoomStats(sessionSummary{}, sessions, 2, base, base)
+	if stats.Sessions != 3 {
+		t.Errorf("sessions = %d", stats.Sessions)
+	}
+	if !reflect.DeepEqual(stats.BusiestHours, []int{21, 20, 22}) {
+		t.Errorf("busiest hours = %v, want [21 20 22]", stats.BusiestHours)
+	}
+}
+
+func TestHandleStatsCommand(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "Ally")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1000, "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", 4600, "")
+
+	var replies []string
+	handleStatsCommand(b.command("1", "alice", true, "/stats", &replies))
+	handleStatsCommand(b.command("2", "bob", true, "/stats Ally", &replies))
+	handleStatsCommand(b.command("2", "bob", true, "/stats room ROOM1", &replies))
+	handleStatsCommand(b.command("2", "bob", true, "/stats room ROOM9", &replies))
+
+	if len(replies) != 4 {
+		t.Fatalf("replies = %q", replies)
+	}
+	for _, want := range []string{"Total playtime: 1h 0m", "Favourite character: Player1", "Favourite scene: Hotel"} {
+		if !strings.Contains(replies[0], want) || !strings.Contains(replies[1], want) {
+			t.Errorf("user stats missing %q: %q", want, replies[:2])
+		}
+	}
+	if !strings.Contains(replies[2], "Peak: 1 players") {
+		t.Errorf("room stats = %q", replies[2])
+	}
+	if !strings.Contains(replies[3], "Unknown room") {
+		t.Errorf("unknown room reply = %q", replies[3])
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Largest CIDR ranges a member can register, for ISPs that rotate addresses within a block.
+const (
+	maxRangeBitsIPv4 = 8  // /24
+	maxRangeBitsIPv6 = 72 // /56
+)
+
+// reservedPrefixes are address ranges that can never reach the game server from the internet.
+var reservedPrefixes = []struct {
+	prefix netip.Prefix
+	reason string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "unspecified"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "carrier-grade NAT"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "IETF protocol assignments"},
+	{netip.MustParsePrefix("192.0.2.0/24"), "documentation"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking"},
+	{netip.MustParsePrefix("198.51.100.0/24"), "documentation"},
+	{netip.MustParsePrefix("203.0.113.0/24"), "documentation"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved"},
+	{netip.MustParsePrefix("::/128"), "unspecified"},
+	{netip.MustParsePrefix("::1/128"), "loopback"},
+	{netip.MustParsePrefix("::ffff:0:0/96"), "IPv4-mapped"},
+	{netip.MustParsePrefix("64:ff9b::/96"), "NAT64"},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "NAT64"},
+	{netip.MustParsePrefix("2001:db8::/32"), "documentation"},
+	{netip.MustParsePrefix("3fff::/20"), "documentation"},
+	{netip.MustParsePrefix("fc00::/7"), "unique local"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast"},
+}
+
+// parseRegistrationAddress parses an IPv4 or IPv6 address, or a CIDR range of either.
+// A single address is returned as a prefix covering only that address.
+func parseRegistrationAddress(text string) (netip.Prefix, error) {
+	text = strings.TrimSpace(text)
+	if strings.Contains(text, "/") {
+		prefix, err := netip.ParsePrefix(text)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Zone() != "" {
+			return netip.Prefix{}, fmt.Errorf("zoned addresses are not allowed")
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("zoned addresses are not allowed")
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// reservedReason returns why prefix overlaps a reserved range, or "" if it is public.
+func reservedReason(prefix netip.Prefix) string {
+	for _, r := range reservedPrefixes {
+		if r.prefix.Overlaps(prefix) {
+			return r.reason
+		}
+	}
+	return ""
+}
+
+// isRange reports whether prefix covers more than one address.
+func isRange(prefix netip.Prefix) bool {
+	return prefix.Bits() < prefix.Addr().BitLen()
+}
+
+// rangeTooLarge reports whether a CIDR range is larger than members may register.
+func rangeTooLarge(prefix netip.Prefix) bool {
+	return prefix.Addr().BitLen()-prefix.Bits() > maxRangeBits(prefix)
+}
+
+func maxRangeBits(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return maxRangeBitsIPv4
+	}
+	return maxRangeBitsIPv6
+}
+
+// allowlistEntry formats a prefix for allowlist.txt: a plain address for single
+// addresses, keeping the original format, CIDR notation for ranges.
+func allowlistEntry(prefix netip.Prefix) string {
+	if isRange(prefix) {
+		return prefix.String()
+	}
+	return prefix.Addr().String()
+}
+
+// entryContains reports whether an allowlist entry (address or CIDR range) covers ip.
+func entryContains(entry, ip string) bool {
+	if entry == ip {
+		return true
+	}
+	if !strings.Contains(entry, "/") {
+		return false
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return prefix.Contains(addr.Unmap())
+}
+
+// entriesOverlap reports whether two allowlist entries share an address, e.g. a
+// single address and a range containing it.
+func entriesOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	prefixA, errA := parseRegistrationAddress(a)
+	prefixB, errB := parseRegistrationAddress(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return prefixA.Overlaps(prefixB)
+}
+
+// maskIP hides the host part of an allowlist entry so it can be shown in
+// replies: 1.2.3.4 becomes 1.2.x.x, IPv6 addresses keep their first two groups.
+func maskIP(entry string) string {
+	prefix, err := parseRegistrationAddress(entry)
+	if err != nil {
+		return "hidden"
+	}
+
+	var masked string
+	if prefix.Addr().Is4() {
+		a := prefix.Addr().As4()
+		masked = fmt.Sprintf("%d.%d.x.x", a[0], a[1])
+	} else {
+		a := prefix.Addr().As16()
+		masked = fmt.Sprintf("%x:%x:…", uint16(a[0])<<8|uint16(a[1]), uint16(a[2])<<8|uint16(a[3]))
+	}
+	if isRange(prefix) {
+		masked += fmt.Sprintf("/%d", prefix.Bits())
+	}
+	return masked
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestParseRegistrationAddress(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantErr   bool
+		want      string // allowlist entry
+		wantRange bool
+		reserved  string
+		tooLarge  bool
+	}{
+		{text: "8.8.8.8", want: "8.8.8.8"},
+		{text: " 8.8.8.8 ", want: "8.8.8.8"},
+		{text: "2606:4700::1111", want: "2606:4700::1111"},
+		{text: "::ffff:8.8.8.8", want: "8.8.8.8"},
+		{text: "8.8.8.7/28", want: "8.8.8.0/28", wantRange: true},
+		{text: "8.8.0.0/16", want: "8.8.0.0/16", wantRange: true, tooLarge: true},
+		{text: "2606:4700::/56", want: "2606:4700::/56", wantRange: true},
+		{text: "2606:4700::/48", want: "2606:4700::/48", wantRange: true, tooLarge: true},
+		{text: "192.168.1.10", want: "192.168.1.10", reserved: "private"},
+		{text: "100.64.1.1", want: "100.64.1.1", reserved: "carrier-grade NAT"},
+		{text: "fe80::1", want: "fe80::1", reserved: "link-local"},
+		{text: "192.0.0.8", want: "192.0.0.8", reserved: "IETF protocol assignments"},
+		{text: "198.19.255.254", want: "198.19.255.254", reserved: "benchmarking"},
+		{text: "198.20.0.1", want: "198.20.0.1"},
+		{text: "203.0.113.7", want: "203.0.113.7", reserved: "documentation"},
+		{text: "64:ff9b::808:808", want: "64:ff9b::808:808", reserved: "NAT64"},
+		{text: "64:ff9b:1::1", want: "64:ff9b:1::1", reserved: "NAT64"},
+		{text: "2001:db8::1", want: "2001:db8::1", reserved: "documentation"},
+		{text: "3fff:fff::1", want: "3fff:fff::1", reserved: "documentation"},
+		{text: "3fff:1000::1", want: "3fff:1000::1"},
+		{text: "0.0.0.0/0", want: "0.0.0.0/0", wantRange: true, reserved: "unspecified", tooLarge: true},
+		{text: "fe80::1%eth0", wantErr: true},
+		{text: "not-an-ip", wantErr: true},
+		{text: "8.8.8.8/33", wantErr: true},
+		{text: "1.2.3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			prefix, err := parseRegistrationAddress(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseRegistrationAddress(%q) = %v, want error", tt.text, prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := allowlistEntry(prefix); got != tt.want {
+				t.Errorf("allowlistEntry = %q, want %q", got, tt.want)
+			}
+			if got := isRange(prefix); got != tt.wantRange {
+				t.Errorf("isRange = %v, want %v", got, tt.wantRange)
+			}
+			if got := reservedReason(prefix); got != tt.reserved {
+				t.Errorf("reservedReason = %q, want %q", got, tt.reserved)
+			}
+			if got := rangeTooLarge(prefix); got != tt.tooLarge {
+				t.Errorf("rangeTooLarge = %v, want %v", got, tt.tooLarge)
+			}
+		})
+	}
+}
+
+func TestEntryContains(t *testing.T) {
+	tests := []struct {
+		entry, ip string
+		want      bool
+	}{
+		{"8.8.8.8", "8.8.8.8", true},
+		{"8.8.8.8", "8.8.8.9", false},
+		{"8.8.8.0/28", "8.8.8.15", true},
+		{"8.8.8.0/28", "8.8.8.16", false},
+		{"8.8.8.0/28", "::ffff:8.8.8.1", true},
+		{"2606:4700::/56", "2606:4700:0:ff::1", true},
+		{"2606:4700::/56", "2606:4700:0:100::1", false},
+		{"2606:4700::/56", "not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := entryContains(tt.entry, tt.ip); got != tt.want {
+			t.Errorf("entryContains(%q, %q) = %v, want %v", tt.entry, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestMaskIP(t *testing.T) {
+	tests := map[string]string{
+		"8.8.4.4":         "8.8.x.x",
+		"8.8.8.0/28":      "8.8.x.x/28",
+		"2606:4700::1111": "2606:4700:…",
+		"2606:4700::/56":  "2606:4700:…/56",
+		"garbage":         "hidden",
+	}
+	for ip, want := range tests {
+		if got := maskIP(ip); got != want {
+			t.Errorf("maskIP(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
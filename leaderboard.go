@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	weeklyDigestEnabled       = false                     // posts the weekly digest in the always monitored channel (optional)
+	weeklyDigestStateFileName = "weekly_digest_state.txt" // start of the last week a digest was posted for
+	leaderboardSize           = 10
+)
+
+// leaderboardEntry is one member's activity in a period.
+type leaderboardEntry struct {
+	Username string
+	Playtime time.Duration
+	Sessions int
+}
+
+// allSessions returns a copy of every session in the history.
+func (h *historyIndex) allSessions() []Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Session(nil), h.sessions...)
+}
+
+// overlap returns how much of the session falls between from and to, counting
+// open sessions up to to.
+func (s Session) overlap(from, to time.Time) time.Duration {
+	start, end := s.Joined, s.Left
+	if end.IsZero() || end.After(to) {
+		end = to
+	}
+	if start.Before(from) {
+		start = from
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// leaderboard ranks registered users by playtime between from and to. The
+// summarized sessions only count for the all-time leaderboard, they ended before
+// any shorter period starts.
+func (h *historyIndex) leaderboard(from, to time.Time) []leaderboardEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var past map[string]*sessionSummary
+	if from.IsZero() {
+		past = h.pastUsers
+	}
+	return computeLeaderboard(past, h.sessions, from, to)
+}
+
+// computeLeaderboard ranks registered users by playtime between from and to, then
+// by sessions. past adds the summaries of older sessions, it can be nil.
+func computeLeaderboard(past map[string]*sessionSummary, sessions []Session, from, to time.Time) []leaderboardEntry {
+	byUser := make(map[string]*leaderboardEntry)
+	for username, summary := range past {
+		byUser[username] = &leaderboardEntry{Username: username, Playtime: summary.Playtime, Sessions: summary.Sessions}
+	}
+	for _, s := range sessions {
+		if s.Username == "" {
+			continue
+		}
+		d := s.overlap(from, to)
+		if d == 0 {
+			continue
+		}
+		entry, ok := byUser[s.Username]
+		if !ok {
+			entry = &leaderboardEntry{Username: s.Username}
+			byUser[s.Username] = entry
+		}
+		entry.Playtime += d
+		if !s.Continued {
+			entry.Sessions++
+		}
+	}
+
+	var entries []leaderboardEntry
+	for _, entry := range byUser {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Playtime != entries[j].Playtime {
+			return entries[i].Playtime > entries[j].Playtime
+		}
+		if entries[i].Sessions != entries[j].Sessions {
+			return entries[i].Sessions > entries[j].Sessions
+		}
+		return entries[i].Username < entries[j].Username
+	})
+	return entries
+}
+
+// leaderboardPeriodStart returns the start of a leaderboard period ending at now.
+func leaderboardPeriodStart(period string, now time.Time) (time.Time, bool) {
+	switch period {
+	case "week":
+		return now.Add(-7 * 24 * time.Hour), true
+	case "month":
+		return now.AddDate(0, -1, 0), true
+	case "all":
+		return time.Time{}, true
+	}
+	return time.Time{}, false
+}
+
+// handleLeaderboardCommand processes /leaderboard [week|month|all].
+func handleLeaderboardCommand(c *commandContext) {
+	period := "week"
+	if len(c.args) > 1 {
+		period = strings.ToLower(strings.TrimSpace(c.args[1]))
+	}
+	now := time.Now()
+	from, ok := leaderboardPeriodStart(period, now)
+	if !ok {
+		c.reply("Usage: /leaderboard [week|month|all]", true)
+		return
+	}
+
+	if !historyLoaded(c) {
+		return
+	}
+	history.update()
+	entries := history.leaderboard(from, now)
+	if len(entries) == 0 {
+		c.reply(fmt.Sprintf("Nobody played this %s yet.", period), false)
+		return
+	}
+
+	title := fmt.Sprintf("Leaderboard (last %s):\n", period)
+	if period == "all" {
+		title = "Leaderboard (all time):\n"
+	}
+	c.reply(title+renderLeaderboard(entries, leaderboardSize), false)
+}
+
+func renderLeaderboard(entries []leaderboardEntry, size int) string {
+	text := ""
+	for i, entry := range entries {
+		if i == size {
+			break
+		}
+		name, err := getProcessedUsername(discordSession, guildID, entry.Username)
+		if err != nil {
+			log.Println("Error getting nickname:", err)
+		}
+		text += fmt.Sprintf("%d. %s - %s in %d sessions\n", i+1, name, formatDuration(entry.Playtime), entry.Sessions)
+	}
+	return text
+}
+
+// weekStart returns the Monday 00:00 UTC that starts the week of t.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+}
+
+// renderWeeklyDigest summarizes activity between from and to: top players,
+// most played scenes and peak hours.
+func renderWeeklyDigest(sessions []Session, from, to time.Time) string {
+	text := fmt.Sprintf("**Weekly digest** %s - %s\n\n", from.Format("Jan 2"), to.Add(-time.Second).Format("Jan 2"))
+
+	entries := computeLeaderboard(nil, sessions, from, to)
+	if len(entries) == 0 {
+		return text + "Nobody played this week.\n"
+	}
+	text += "Top players:\n" + renderLeaderboard(entries, 5)
+
+	sceneTime := make(map[string]time.Duration)
+	var hourTime [24]time.Duration
+	for _, s := range sessions {
+		d := s.overlap(from, to)
+		if d == 0 {
+			continue
+		}
+		if s.Scene != "" {
+			sceneTime[s.Scene] += d
+		}
+		start := s.Joined
+		if start.Before(from) {
+			start = from
+		}
+		addHourlyTime(&hourTime, start, start.Add(d))
+	}
+
+	var scenes []string
+	for scene := range sceneTime {
+		scenes = append(scenes, scene)
+	}
+	sort.Slice(scenes, func(i, j int) bool {
+		if sceneTime[scenes[i]] != sceneTime[scenes[j]] {
+			return sceneTime[scenes[i]] > sceneTime[scenes[j]]
+		}
+		return scenes[i] < scenes[j]
+	})
+	if len(scenes) > 0 {
+		text += "\nMost played scenes:\n"
+		for i, scene := range scenes {
+			if i == 3 {
+				break
+			}
+			text += fmt.Sprintf("%d. %s - %s\n", i+1, scene, formatDuration(sceneTime[scene]))
+		}
+	}
+
+	if hours := busiestHours(hourTime); len(hours) > 0 {
+		text += fmt.Sprintf("\nPeak hours: %s\n", formatHours(hours, 3))
+	}
+	return text
+}
+
+// startWeeklyDigest posts the digest of the previous week to the always monitored
+// channel once a week, if weekly_digest is enabled in the config.
+func startWeeklyDigest(ctx context.Context, s discordAPI) error {
+	if !weeklyDigestEnabled {
+		return nil
+	}
+	if alwaysMonitoredChannel() == "" {
+		log.Println("Weekly digest enabled but always_monitor_channel is not set, not posting digests")
+		return nil
+	}
+	log.Println("Weekly digest enabled")
+
+	postWeeklyDigestIfDue(s, time.Now())
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			postWeeklyDigestIfDue(s, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// postWeeklyDigestIfDue posts the digest of the last full week unless it was already posted.
+func postWeeklyDigestIfDue(s discordAPI, now time.Time) {
+	thisWeek := weekStart(now)
+	if lastPosted, err := readWeeklyDigestState(); err == nil && !lastPosted.Before(thisWeek) {
+		return
+	}
+
+	if !history.ready.Load() {
+		log.Println("Session history not loaded yet, posting the weekly digest later")
+		return
+	}
+	history.update()
+	digest := renderWeeklyDigest(history.allSessions(), thisWeek.AddDate(0, 0, -7), thisWeek)
+	if _, err := s.ChannelMessageSend(alwaysMonitoredChannel(), digest); err != nil {
+		log.Println("Error posting weekly digest:", err)
+		return
+	}
+	if err := writeFileAtomic(weeklyDigestStateFileName, []string{strconv.FormatInt(thisWeek.Unix(), 10)}); err != nil {
+		log.Printf("Error writing %s: %v", weeklyDigestStateFileName, err)
+	}
+	log.Println("Posted weekly digest")
+}
+
+func readWeeklyDigestState() (time.Time, error) {
+	data, err := ioutil.ReadFile(weeklyDigestStateFileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(timestamp, 0), nil
+}
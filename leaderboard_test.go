@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeLeaderboard(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	weekAgo := now.Add(-7 * 24 * time.Hour)
+	sessions := []Session{
+		{Username: "alice", Joined: now.Add(-3 * time.Hour), Left: now.Add(-time.Hour)},
+		{Username: "bob", Joined: now.Add(-30 * time.Minute)}, // still playing
+		{Username: "bob", Joined: now.Add(-5 * time.Hour), Left: now.Add(-4 * time.Hour)},
+		{Username: "carol", Joined: weekAgo.Add(-2 * time.Hour), Left: weekAgo.Add(time.Hour)}, // mostly before the week
+		{Username: "dave", Joined: weekAgo.Add(-time.Hour * 48), Left: weekAgo.Add(-time.Hour * 47)},
+		{Username: "", Joined: now.Add(-10 * time.Hour), Left: now}, // unregistered IP
+	}
+
+	got := computeLeaderboard(nil, sessions, weekAgo, now)
+	want := []leaderboardEntry{
+		{Username: "alice", Playtime: 2 * time.Hour, Sessions: 1},
+		{Username: "bob", Playtime: 90 * time.Minute, Sessions: 2},
+		{Username: "carol", Playtime: time.Hour, Sessions: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("leaderboard = %+v, want %+v", got, want)
+	}
+
+	if all := computeLeaderboard(nil, sessions, time.Time{}, now); len(all) != 4 {
+		t.Errorf("all time leaderboard has %d entries, want 4", len(all))
+	}
+
+	// Summarized sessions add to the entries
+	past := map[string]*sessionSummary{"erin": {Sessions: 2, Playtime: 5 * time.Hour}, "alice": {Sessions: 1, Playtime: time.Hour}}
+	all := computeLeaderboard(past, sessions, time.Time{}, now)
+	if len(all) != 5 || all[0] != (leaderboardEntry{Username: "erin", Playtime: 5 * time.Hour, Sessions: 2}) || all[1] != (leaderboardEntry{Username: "alice", Playtime: 3 * time.Hour, Sessions: 2}) {
+		t.Errorf("all time leaderboard with summaries = %+v", all)
+	}
+}
+
+func TestWeekStart(t *testing.T) {
+	sunday := time.Date(2024, 6, 9, 23, 0, 0, 0, time.UTC)
+	if got := weekStart(sunday); !got.Equal(time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("weekStart(sunday) = %v", got)
+	}
+	monday := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+	if got := weekStart(monday); !got.Equal(monday) {
+		t.Errorf("weekStart(monday) = %v", got)
+	}
+}
+
+func TestPostWeeklyDigestIfDue(t *testing.T) {
+	b := newTestBot(t)
+	replace(t, &weeklyDigestStateFileName, filepath.Join(b.dir, "weekly_digest_state.txt"))
+	replace(t, &alwaysMonitorChannelID, "always")
+
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	monday := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+	lastWeek := monday.AddDate(0, 0, -5).Add(20 * time.Hour)
+	b.appendStatus(t, "room1", lastWeek.Unix(), "8.8.8.8:5000:Player1:Hotel")
+	b.appendStatus(t, "room1", lastWeek.Add(2*time.Hour).Unix(), "")
+
+	postWeeklyDigestIfDue(b.fake, monday.Add(time.Hour))
+	postWeeklyDigestIfDue(b.fake, monday.Add(2*time.Hour))
+
+	posted := b.fake.sentTo("always")
+	if len(posted) != 1 {
+		t.Fatalf("digest posted %d times, want once per week", len(posted))
+	}
+	for _, want := range []string{"1. alice - 2h 0m in 1 sessions", "1. Hotel - 2h 0m", "Peak hours: 20:00-21:00, 21:00-22:00 UTC"} {
+		if !strings.Contains(posted[0], want) {
+			t.Errorf("digest missing %q:\n%s", want, posted[0])
+		}
+	}
+
+	// Next week gets its own digest
+	postWeeklyDigestIfDue(b.fake, monday.AddDate(0, 0, 7))
+	if posted := b.fake.sentTo("always"); len(posted) != 2 || !strings.Contains(posted[1], "Nobody played") {
+		t.Errorf("second digest = %q", posted)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	registrationRoleID = ""          // ID of the role members need to register (optional)
+	minAccountAge      time.Duration // minimum age of the Discord account (optional)
+	minMembershipAge   time.Duration // minimum time since joining the server (optional)
+)
+
+// eligibilityError is returned when someone who may not register tries to.
+type eligibilityError struct {
+	reason string // shown to the user
+}
+
+func (e *eligibilityError) Error() string {
+	return e.reason
+}
+
+// checkEligibility returns why userID may not register at now, or nil if they
+// may. They must be a member of the guild and meet the configured role and age
+// requirements. Without a guild ID there is nothing to check against.
+func checkEligibility(s discordAPI, userID string, now time.Time) error {
+	if guildID == "" {
+		return nil
+	}
+	member, err := s.GuildMember(guildID, userID)
+	if err != nil {
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+			return &eligibilityError{"Only members of the VaM multiplayer Discord server can register. Please join the server first."}
+		}
+		log.Printf("Error fetching guild member %s: %v", userID, err)
+		return &eligibilityError{"Could not check your server membership, please try again later."}
+	}
+
+	if registrationRoleID != "" && !hasRole(member, registrationRoleID) {
+		return &eligibilityError{"You don't have the role needed to register yet. Please ask a moderator."}
+	}
+	if minAccountAge > 0 {
+		created, err := discordgo.SnowflakeTimestamp(userID)
+		if err == nil && now.Sub(created) < minAccountAge {
+			return &eligibilityError{fmt.Sprintf("Your Discord account needs to be at least %d days old to register.", int(minAccountAge.Hours()/24))}
+		}
+	}
+	if minMembershipAge > 0 && now.Sub(member.JoinedAt) < minMembershipAge {
+		return &eligibilityError{fmt.Sprintf("You can register once you have been on the Discord server for %d days, <t:%d:R>.",
+			int(minMembershipAge.Hours()/24), member.JoinedAt.Add(minMembershipAge).Unix())}
+	}
+	return nil
+}
+
+func hasRole(member *discordgo.Member, roleID string) bool {
+	for _, role := range member.Roles {
+		if role == roleID {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMemberRemove revokes the registrations of members who leave the guild,
+// so their IPs leave the allowlist right away.
+func handleMemberRemove(m *discordgo.GuildMemberRemove) {
+	if m.Member == nil || m.User == nil || m.GuildID != guildID {
+		return
+	}
+
+	removed, dropped, err := store.RevokeUser(m.User.Username)
+	if err != nil {
+		log.Printf("Error revoking registrations of %s after they left: %v", m.User.Username, err)
+		return
+	}
+	if len(removed) == 0 {
+		return
+	}
+	log.Printf("%s left the server, revoked %d registrations, removed from allowlist: %v", m.User.Username, len(removed), dropped)
+	auditRemoved("revoke", auditBot, "left the server", removed)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// snowflakeAt returns a Discord ID created at t.
+func snowflakeAt(t time.Time) string {
+	return strconv.FormatInt((t.UnixMilli()-1420070400000)<<22, 10)
+}
+
+func TestCheckEligibility(t *testing.T) {
+	b := newTestBot(t)
+	now := time.Now()
+	oldID, newID := snowflakeAt(now.Add(-365*24*time.Hour)), snowflakeAt(now.Add(-time.Hour))
+	b.fake.addMember(oldID, "alice", "")
+	b.fake.addMember(newID, "bob", "")
+	b.fake.setRoles(oldID, "verified")
+	alice, _ := b.fake.GuildMember(guildID, oldID)
+	alice.JoinedAt = now.Add(-30 * 24 * time.Hour)
+	bob, _ := b.fake.GuildMember(guildID, newID)
+	bob.JoinedAt = now.Add(-time.Hour)
+
+	reason := func(userID string) string {
+		if err := checkEligibility(b.fake, userID, now); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	if got := reason("999"); !strings.Contains(got, "Only members") {
+		t.Errorf("non-member: %q", got)
+	}
+	if got := reason(newID); got != "" {
+		t.Errorf("member without requirements: %q", got)
+	}
+
+	registrationRoleID = "verified"
+	if got := reason(newID); !strings.Contains(got, "role needed to register") {
+		t.Errorf("member without the role: %q", got)
+	}
+	b.fake.setRoles(newID, "verified")
+
+	minAccountAge = 7 * 24 * time.Hour
+	if got := reason(newID); !strings.Contains(got, "at least 7 days old") {
+		t.Errorf("new account: %q", got)
+	}
+	minAccountAge = 0
+
+	minMembershipAge = 2 * 24 * time.Hour
+	if got := reason(newID); !strings.Contains(got, "for 2 days") {
+		t.Errorf("new member: %q", got)
+	}
+	if got := reason(oldID); got != "" {
+		t.Errorf("old member meeting every requirement: %q", got)
+	}
+}
+
+func TestRegisterRequiresMembership(t *testing.T) {
+	b := newTestBot(t)
+	var replies []string
+	handleRegisterCommand(b.command("1", "alice", true, "/register 8.8.8.8", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "Only members") {
+		t.Errorf("replies = %q", replies)
+	}
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Errorf("non-member registered 8.8.8.8")
+	}
+}
+
+func TestEligibilityWithoutGuild(t *testing.T) {
+	b := newTestBot(t)
+	guildID = ""
+	registrationRoleID = "verified"
+	if err := checkEligibility(b.fake, "1", time.Now()); err != nil {
+		t.Errorf("checkEligibility without a guild: %v", err)
+	}
+}
+
+func TestMemberRemoveRevokesRegistrations(t *testing.T) {
+	newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, time.Now())
+
+	handleMemberRemove(&discordgo.GuildMemberRemove{Member: &discordgo.Member{
+		GuildID: "other", User: &discordgo.User{ID: "1", Username: "alice"},
+	}})
+	if user, _ := usernameOf(store, "8.8.8.8"); user != "alice" {
+		t.Fatalf("leaving another guild revoked alice's registration")
+	}
+
+	handleMemberRemove(&discordgo.GuildMemberRemove{Member: &discordgo.Member{
+		GuildID: guildID, User: &discordgo.User{ID: "1", Username: "alice"},
+	}})
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Errorf("8.8.8.8 still registered after alice left")
+	}
+	if user, _ := usernameOf(store, "9.9.9.9"); user != "bob" {
+		t.Errorf("bob's registration was revoked too")
+	}
+	events, _ := readAuditEvents(auditLogFileName, "alice", 10)
+	if len(events) != 1 || events[0].Detail != "left the server" {
+		t.Errorf("audit events = %+v", events)
+	}
+}
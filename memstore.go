@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is an in-memory Store, used by tests and as a reference for the
+// behaviour expected from other implementations.
+type memStore struct {
+	mu            sync.Mutex
+	registrations []Registration      // in registration order, like usernames_ips.txt
+	trackedMap    map[string][]string // tracked user -> trackers
+	reminders     map[string]string   // username -> Discord user ID
+	reminded      map[string]int64    // "<username> <device>" -> registration time last reminded about
+	bans          []Ban
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		trackedMap: make(map[string][]string),
+		reminders:  make(map[string]string),
+		reminded:   make(map[string]int64),
+	}
+}
+
+func (ms *memStore) RegisterIP(ip, userID, username, device string, now time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	updated, err := addRegistration(ms.registrations, Registration{IP: ip, UserID: userID, Username: username, Device: device, Registered: now})
+	if err != nil {
+		return err
+	}
+	ms.registrations = updated
+	return nil
+}
+
+func (ms *memStore) Registrations(username string) ([]Registration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return userRegistrations(ms.registrations, username), nil
+}
+
+func (ms *memStore) Unregister(username, device string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	updated, removed := removeRegistration(ms.registrations, username, device)
+	if removed == nil {
+		return "", errDeviceNotFound
+	}
+	ms.registrations = updated
+	return removed.IP, nil
+}
+
+func (ms *memStore) RemoveExpired(now time.Time, ttl time.Duration) ([]Registration, []string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept, removed, dropped := removeExpired(ms.registrations, now, ttl)
+	ms.registrations = kept
+	return removed, dropped, nil
+}
+
+func (ms *memStore) UsernamesForIP(ip string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return usernamesForIP(ms.registrations, ip)
+}
+
+func (ms *memStore) AllRegistrations() ([]Registration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return append([]Registration(nil), ms.registrations...), nil
+}
+
+func (ms *memStore) RevokeUser(username string) ([]Registration, []string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept, removed, dropped := revokeUser(ms.registrations, username)
+	ms.registrations = kept
+	return removed, dropped, nil
+}
+
+func (ms *memStore) RevokeUserID(userID string) ([]Registration, []string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept, removed, dropped := revokeUserID(ms.registrations, userID)
+	ms.registrations = kept
+	return removed, dropped, nil
+}
+
+func (ms *memStore) ExtendRegistrations(username string, d time.Duration) ([]Registration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return extendRegistrations(ms.registrations, username, d), nil
+}
+
+func (ms *memStore) RevokeIP(entry string) ([]Registration, []string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept, removed, dropped := revokeIP(ms.registrations, entry)
+	ms.registrations = kept
+	return removed, dropped, nil
+}
+
+func (ms *memStore) Bans() ([]Ban, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return append([]Ban(nil), ms.bans...), nil
+}
+
+func (ms *memStore) AddBan(ban Ban) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.bans, _ = removeBans(ms.bans, ban.sameTarget)
+	ms.bans = append(ms.bans, ban)
+	return nil
+}
+
+func (ms *memStore) RemoveBan(target string) ([]Ban, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var removed []Ban
+	ms.bans, removed = removeBans(ms.bans, func(ban Ban) bool { return ban.hasTarget(target) })
+	return removed, nil
+}
+
+func (ms *memStore) Reminders() (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	result := make(map[string]string, len(ms.reminders))
+	for username, userID := range ms.reminders {
+		result[username] = userID
+	}
+	return result, nil
+}
+
+func (ms *memStore) SetReminder(username, userID string, enabled bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if enabled {
+		ms.reminders[username] = userID
+	} else {
+		delete(ms.reminders, username)
+		for key := range ms.reminded {
+			if strings.HasPrefix(key, username+" ") {
+				delete(ms.reminded, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *memStore) MarkReminded(username, device string, registered time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := username + " " + device
+	if _, ok := ms.reminders[username]; !ok || ms.reminded[key] == registered.Unix() {
+		return false, nil
+	}
+	ms.reminded[key] = registered.Unix()
+	return true, nil
+}
+
+func (ms *memStore) TrackedUsers() (map[string][]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	result := make(map[string][]string, len(ms.trackedMap))
+	for trackedUser, trackers := range ms.trackedMap {
+		result[trackedUser] = append([]string(nil), trackers...)
+	}
+	return result, nil
+}
+
+func (ms *memStore) AddTracking(tracker, trackedUser string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.trackedMap[trackedUser] = appendIfMissing(ms.trackedMap[trackedUser], tracker)
+	return nil
+}
+
+func (ms *memStore) RemoveTracking(tracker, trackedUser string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if !removeTracker(ms.trackedMap, tracker, trackedUser) {
+		return fmt.Errorf("you are not tracking %s", trackedUser)
+	}
+	return nil
+}
+
+// Close waits for a change in progress. The memory store has nothing to flush.
+func (ms *memStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return nil
+}
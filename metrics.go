@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricsListenAddress = "127.0.0.1:8091"   // for the Prometheus scraper, never published
+	metricsMux           = http.NewServeMux() // /metrics and the health checks
+)
+
+// statusUpdateBuckets are the upper bounds in seconds of the status update
+// duration histogram.
+var statusUpdateBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// botMetrics holds the counters exported on /metrics. Gauges such as the number
+// of registrations are read when scraped.
+var botMetrics = struct {
+	mu            sync.Mutex
+	registrations map[string]uint64 // register or refresh -> count
+	expired       uint64
+	discordErrors map[string]uint64 // API method -> failed calls
+
+	statusUpdateBuckets []uint64 // counts per bucket, not cumulative
+	statusUpdateCount   uint64
+	statusUpdateSum     float64
+}{
+	registrations:       make(map[string]uint64),
+	discordErrors:       make(map[string]uint64),
+	statusUpdateBuckets: make([]uint64, len(statusUpdateBuckets)),
+}
+
+func init() {
+	metricsMux.HandleFunc("/metrics", handleMetrics)
+}
+
+// startMetricsServer serves metricsMux on its own address, so publishing the
+// dashboard and registration links through a reverse proxy never publishes
+// the metrics or the health checks.
+func startMetricsServer(ctx context.Context) error {
+	return serveHTTP(ctx, metricsListenAddress, metricsMux)
+}
+
+// countRegistration counts a successful /register; action is register or refresh.
+func countRegistration(action string) {
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+	botMetrics.registrations[action]++
+}
+
+// countExpired counts registrations removed by the cleanup.
+func countExpired(n int) {
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+	botMetrics.expired += uint64(n)
+}
+
+// countDiscordError counts a failed Discord API call, err may be nil.
+func countDiscordError(method string, err error) {
+	if err == nil {
+		return
+	}
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+	botMetrics.discordErrors[method]++
+}
+
+// observeStatusUpdate records how long reading the status files and updating
+// the bot status took.
+func observeStatusUpdate(d time.Duration) {
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+	seconds := d.Seconds()
+	for i, bound := range statusUpdateBuckets {
+		if seconds <= bound {
+			botMetrics.statusUpdateBuckets[i]++
+			break
+		}
+	}
+	botMetrics.statusUpdateCount++
+	botMetrics.statusUpdateSum += seconds
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, time.Now())
+}
+
+// writeMetrics writes every metric in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, now time.Time) {
+	registrations, err := store.AllRegistrations()
+	if err != nil {
+		log.Printf("Metrics: error reading registrations: %v", err)
+	} else {
+		writeMetric(w, "vammp_registrations", "gauge", "Active registrations, one per device.", nil, float64(len(registrations)))
+		writeMetric(w, "vammp_allowlist_entries", "gauge", "IPs and ranges on the allowlist.", nil, float64(len(deriveAllowlist(registrations))))
+	}
+
+	snaps, err := currentSnapshots()
+	if err != nil {
+		log.Printf("Metrics: error reading room status: %v", err)
+	}
+	writeHeader(w, "vammp_room_up", "gauge", "Whether the room server has written a status line and accepts connections.")
+	for _, snap := range snaps {
+		up := 0.0
+		if snap.Running && snap.Down == "" {
+			up = 1
+		}
+		writeSample(w, "vammp_room_up", roomLabel(snap), up)
+	}
+	writeHeader(w, "vammp_room_players", "gauge", "Players in the room, spectators included.")
+	for _, snap := range snaps {
+		writeSample(w, "vammp_room_players", roomLabel(snap), float64(len(snap.Players)))
+	}
+	writeHeader(w, "vammp_room_spectators", "gauge", "Spectators in the room.")
+	for _, snap := range snaps {
+		spectators := 0
+		for _, player := range snap.Players {
+			if player.Spectator {
+				spectators++
+			}
+		}
+		writeSample(w, "vammp_room_spectators", roomLabel(snap), float64(spectators))
+	}
+	writeHeader(w, "vammp_room_status_age_seconds", "gauge", "Age of the last line of the room status file.")
+	for _, snap := range snaps {
+		if !snap.Updated.IsZero() {
+			writeSample(w, "vammp_room_status_age_seconds", roomLabel(snap), now.Sub(snap.Updated).Seconds())
+		}
+	}
+
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+
+	writeHeader(w, "vammp_registrations_total", "counter", "Successful registrations by action (register or refresh).")
+	for _, action := range sortedKeys(botMetrics.registrations) {
+		writeSample(w, "vammp_registrations_total", map[string]string{"action": action}, float64(botMetrics.registrations[action]))
+	}
+	writeMetric(w, "vammp_registration_expiries_total", "counter", "Registrations removed because they expired.", nil, float64(botMetrics.expired))
+	writeHeader(w, "vammp_discord_api_errors_total", "counter", "Failed Discord API calls by method.")
+	for _, method := range sortedKeys(botMetrics.discordErrors) {
+		writeSample(w, "vammp_discord_api_errors_total", map[string]string{"method": method}, float64(botMetrics.discordErrors[method]))
+	}
+
+	writeHeader(w, "vammp_status_update_duration_seconds", "histogram", "Time to read the room status files and update the bot status.")
+	var cumulative uint64
+	for i, bound := range statusUpdateBuckets {
+		cumulative += botMetrics.statusUpdateBuckets[i]
+		writeSample(w, "vammp_status_update_duration_seconds_bucket", map[string]string{"le": fmt.Sprint(bound)}, float64(cumulative))
+	}
+	writeSample(w, "vammp_status_update_duration_seconds_bucket", map[string]string{"le": "+Inf"}, float64(botMetrics.statusUpdateCount))
+	writeSample(w, "vammp_status_update_duration_seconds_sum", nil, botMetrics.statusUpdateSum)
+	writeSample(w, "vammp_status_update_duration_seconds_count", nil, float64(botMetrics.statusUpdateCount))
+}
+
+func roomLabel(snap RoomSnapshot) map[string]string {
+	return map[string]string{"room": snap.Room.Name}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, labels map[string]string, value float64) {
+	writeHeader(w, name, kind, help)
+	writeSample(w, name, labels, value)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one sample line, e.g. `vammp_room_players{room="ROOM1"} 3`.
+func writeSample(w io.Writer, name string, labels map[string]string, value float64) {
+	var pairs []string
+	for _, key := range sortedKeys(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, escapeLabelValue(labels[key])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+// escapeLabelValue prepares a label value for %q: Prometheus only knows the
+// escapes \\, \" and \n, so other control characters are dropped.
+func escapeLabelValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetBotMetrics zeroes the counters between tests.
+func resetBotMetrics() {
+	botMetrics.mu.Lock()
+	defer botMetrics.mu.Unlock()
+	botMetrics.registrations = make(map[string]uint64)
+	botMetrics.expired = 0
+	botMetrics.discordErrors = make(map[string]uint64)
+	botMetrics.statusUpdateBuckets = make([]uint64, len(statusUpdateBuckets))
+	botMetrics.statusUpdateCount, botMetrics.statusUpdateSum = 0, 0
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	discordSession = meteredDiscord{b.fake}
+
+	registerIP("8.8.8.8", "1", "alice", defaultDevice)
+	registerIP("8.8.8.8", "1", "alice", defaultDevice)
+	// Not a member, the failed lookup counts as an API error
+	checkEligibility(discordSession, "2", time.Now())
+	store.RegisterIP("7.7.7.7", "", "carol", defaultDevice, time.Now().Add(-8*24*time.Hour))
+	cleanupExpiredIPs()
+
+	now := time.Now()
+	b.appendStatus(t, "room1", now.Add(-30*time.Second).Unix(), "8.8.8.8:5000:Player1:Hotel,6.6.6.6:5001:@SPECTATOR@")
+	observeStatusUpdate(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metricsMux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("status = %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+
+	// The server the reverse proxy publishes doesn't serve them
+	public := httptest.NewRecorder()
+	httpMux.ServeHTTP(public, httptest.NewRequest("GET", "/metrics", nil))
+	if public.Code != http.StatusNotFound {
+		t.Errorf("/metrics on the dashboard server = %d, want 404", public.Code)
+	}
+
+	for _, want := range []string{
+		"# TYPE vammp_registrations gauge\nvammp_registrations 1\n",
+		"vammp_allowlist_entries 1\n",
+		`vammp_room_up{room="ROOM1"} 1`,
+		`vammp_room_up{room="ROOM2"} 0`,
+		`vammp_room_players{room="ROOM1"} 2`,
+		`vammp_room_spectators{room="ROOM1"} 1`,
+		`vammp_registrations_total{action="refresh"} 1`,
+		`vammp_registrations_total{action="register"} 1`,
+		"vammp_registration_expiries_total 1\n",
+		`vammp_discord_api_errors_total{method="GuildMember"} 1`,
+		`vammp_status_update_duration_seconds_bucket{le="0.01"} 0`,
+		`vammp_status_update_duration_seconds_bucket{le="0.025"} 1`,
+		`vammp_status_update_duration_seconds_bucket{le="+Inf"} 1`,
+		"vammp_status_update_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(body, `vammp_room_status_age_seconds{room="ROOM1"} 3`) {
+		t.Errorf("room status age not around 30s:\n%s", body)
+	}
+	if strings.Contains(body, `vammp_room_status_age_seconds{room="ROOM2"}`) {
+		t.Errorf("status age reported for a room without status line")
+	}
+	if strings.Contains(body, "8.8.8.8") {
+		t.Errorf("metrics expose IPs")
+	}
+}
+
+func TestWriteSampleEscapesLabels(t *testing.T) {
+	var b strings.Builder
+	writeSample(&b, "vammp_room_up", map[string]string{"room": "a \"b\"\\\n\tc"}, 1)
+	if got, want := b.String(), `vammp_room_up{room="a \"b\"\\\nc"} 1`+"\n"; got != want {
+		t.Errorf("writeSample = %q, want %q", got, want)
+	}
+}
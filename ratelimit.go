@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// rateLimits are the command limits per user. A user can send Burst commands
+	// in a row, after that one more every Every. "*" applies to every other command.
+	rateLimits = map[string]rateLimit{
+		"/register":    {Burst: 5, Every: 2 * time.Minute},
+		"/track":       {Burst: 5, Every: time.Minute}, // looks up the whole member list
+		"/untrack":     {Burst: 5, Every: time.Minute},
+		"/stats":       {Burst: 10, Every: 20 * time.Second},
+		"/leaderboard": {Burst: 10, Every: 20 * time.Second},
+		"*":            {Burst: 10, Every: 10 * time.Second},
+	}
+	commandLimiter = newRateLimiter()
+
+	// Moderators are alerted when a user registers this many different IPs within
+	// the window, set by the distinctIPsLimit entry of rate_limits
+	distinctIPsLimit      = "distinct_ips"
+	distinctIPAlertCount  = 4
+	distinctIPAlertWindow = time.Hour
+	recentIPs             = make(map[string][]seenIP)  // user ID -> IPs registered within the window
+	distinctIPAlerted     = make(map[string]time.Time) // user ID -> time of the last alert
+	recentIPsMutex        sync.Mutex
+)
+
+// maxBuckets is the number of buckets after which full ones are dropped.
+const maxBuckets = 1000
+
+type rateLimit struct {
+	Burst int
+	Every time.Duration
+}
+
+// tokenBucket holds the commands a user has left, refilled by one every limit.Every.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // user ID + command -> bucket
+}
+
+type seenIP struct {
+	ip string
+	at time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of userID and command. If there is none
+// left, it returns false and how long until there is.
+func (l *rateLimiter) allow(userID, command string, now time.Time) (bool, time.Duration) {
+	limit, ok := rateLimits[command]
+	if !ok {
+		command = "*"
+		limit, ok = rateLimits[command]
+	}
+	if !ok || limit.Burst <= 0 || limit.Every <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := userID + " " + command
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill for the time since the last command, up to the burst
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(limit.Every)
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(limit.Every))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have been refilled completely, they are the same
+// as no bucket at all.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		limit, ok := rateLimits[key[strings.Index(key, " ")+1:]]
+		if !ok || now.Sub(bucket.last) >= time.Duration(limit.Burst)*limit.Every {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimited reports whether c goes over the user's limit for its command, and
+// if so tells the user when to try again.
+func rateLimited(c *commandContext) bool {
+	// /register in a channel only deletes the message, which has to happen so the IP doesn't stay public
+	if c.args[0] == "/register" && !c.isDM && c.messageID != "" {
+		return false
+	}
+
+	ok, wait := commandLimiter.allow(c.userID, c.args[0], time.Now())
+	if ok {
+		return false
+	}
+	log.Printf("Rate limited %s for %s", c.args[0], c.username)
+	c.reply(fmt.Sprintf("You're using %s a bit too often. Please try again <t:%d:R>.", c.args[0], time.Now().Add(wait).Unix()+1), true)
+	return true
+}
+
+// parseRateLimit parses "<count> <interval>" such as "5 2m".
+func parseRateLimit(text string) (rateLimit, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return rateLimit{}, fmt.Errorf("%q is not a limit like \"5 2m\"", text)
+	}
+	count, err1 := strconv.Atoi(fields[0])
+	interval, err2 := time.ParseDuration(fields[1])
+	if err1 != nil || err2 != nil || count < 0 || interval < 0 {
+		return rateLimit{}, fmt.Errorf("%q is not a limit like \"5 2m\"", text)
+	}
+	return rateLimit{Burst: count, Every: interval}, nil
+}
+
+func (l *rateLimit) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("rate limits are strings like \"5 2m\": %s", data)
+	}
+	limit, err := parseRateLimit(text)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// noteRegisteredIP remembers that userID registered ip and alerts the moderators
+// when they registered too many different IPs within distinctIPAlertWindow.
+func noteRegisteredIP(userID, username, ip string, now time.Time) {
+	if distinctIPAlertCount <= 0 {
+		return
+	}
+
+	recentIPsMutex.Lock()
+	var seen []seenIP
+	for _, s := range recentIPs[userID] {
+		if now.Sub(s.at) < distinctIPAlertWindow && s.ip != ip {
+			seen = append(seen, s)
+		}
+	}
+	seen = append(seen, seenIP{ip: ip, at: now})
+	recentIPs[userID] = seen
+
+	alert := len(seen) >= distinctIPAlertCount && now.Sub(distinctIPAlerted[userID]) >= distinctIPAlertWindow
+	if alert {
+		distinctIPAlerted[userID] = now
+	}
+	recentIPsMutex.Unlock()
+
+	if !alert {
+		return
+	}
+	ips := make([]string, len(seen))
+	for i, s := range seen {
+		ips[i] = s.ip
+	}
+	message := fmt.Sprintf("%s (%s) registered %d different IPs within %s: %s", username, userID, len(seen), formatDuration(distinctIPAlertWindow), strings.Join(ips, ", "))
+	log.Println("Alert:", message)
+	alertModerators(discordSession, "Possible abuse: "+message+". `/admin audit` shows the details.")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	newTestBot(t)
+	rateLimits["/register"] = rateLimit{Burst: 2, Every: time.Minute}
+	l := newRateLimiter()
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("1", "/register", now); !ok {
+			t.Fatalf("command %d within the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.allow("1", "/register", now)
+	if ok || wait != time.Minute {
+		t.Errorf("third command: ok = %v, wait %v; want limited for 1m", ok, wait)
+	}
+	// Other users and commands have their own buckets
+	if ok, _ := l.allow("2", "/register", now); !ok {
+		t.Errorf("another user was limited")
+	}
+	if ok, _ := l.allow("1", "/state", now); !ok {
+		t.Errorf("another command was limited")
+	}
+
+	if ok, _ := l.allow("1", "/register", now.Add(time.Minute)); !ok {
+		t.Errorf("command after the refill was limited")
+	}
+	if ok, _ := l.allow("1", "/register", now.Add(time.Minute)); ok {
+		t.Errorf("refill gave more than one command")
+	}
+}
+
+func TestRateLimitedCommandReply(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("2", "bob", "")
+	rateLimits["/track"] = rateLimit{Burst: 1, Every: time.Hour}
+
+	var replies []string
+	dispatchCommand(b.command("1", "alice", true, "/track bob", &replies))
+	dispatchCommand(b.command("1", "alice", true, "/track bob", &replies))
+	if len(replies) != 2 || !strings.Contains(replies[1], "a bit too often") {
+		t.Errorf("replies = %q", replies)
+	}
+}
+
+func TestDistinctIPAlert(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	moderatorChannelID = "mods"
+	distinctIPAlertCount, distinctIPAlertWindow = 3, time.Hour
+
+	// Refreshing the same IP doesn't count
+	for _, ip := range []string{"8.8.8.8", "8.8.8.8", "8.8.4.4"} {
+		registerIP(ip, "1", "alice", defaultDevice)
+	}
+	if alerts := b.fake.sentTo("mods"); len(alerts) != 0 {
+		t.Fatalf("alert after two IPs: %q", alerts)
+	}
+
+	registerIP("9.9.9.9", "1", "alice", defaultDevice)
+	registerIP("1.1.1.1", "1", "alice", defaultDevice)
+	alerts := b.fake.sentTo("mods")
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "alice (1) registered 3 different IPs within 1h 0m: 8.8.8.8, 8.8.4.4, 9.9.9.9") {
+		t.Errorf("alerts = %q, want one", alerts)
+	}
+}
+
+func TestRateLimitsFromConfig(t *testing.T) {
+	newTestBot(t)
+	keepSettings(t)
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "bot_channel": "vam-mp-bot", "rate_limits": {"/register": "3 5m", "distinct_ips": "6 2h"}}`,
+	})
+	t.Setenv("VAMMP_RATE_LIMITS", "/register 3 5m, distinct_ips 6 2h, * 20 5s")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(cfg)
+	if got := rateLimits["/register"]; got != (rateLimit{Burst: 3, Every: 5 * time.Minute}) {
+		t.Errorf("/register limit = %+v", got)
+	}
+	if got := rateLimits["*"]; got != (rateLimit{Burst: 20, Every: 5 * time.Second}) {
+		t.Errorf("* limit = %+v", got)
+	}
+	if got := rateLimits["/track"]; got != (rateLimit{Burst: 5, Every: time.Minute}) {
+		t.Errorf("/track limit = %+v, want the default", got)
+	}
+	if distinctIPAlertCount != 6 || distinctIPAlertWindow != 2*time.Hour {
+		t.Errorf("distinct IP alert = %d in %v", distinctIPAlertCount, distinctIPAlertWindow)
+	}
+
+	t.Setenv("VAMMP_RATE_LIMITS", "/track lots 1m")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), `VAMMP_RATE_LIMITS: /track: "lots 1m" is not a limit`) {
+		t.Errorf("loadConfig with an invalid limit = %v", err)
+	}
+	t.Setenv("VAMMP_RATE_LIMITS", "track 1 1m")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), `rate_limits: "track" is not a command`) {
+		t.Errorf("loadConfig with an unknown command = %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	registrationLinkBaseURL = "" // public URL of the HTTP server, enables registration links (optional)
+	trustedProxyHeader      = "" // header with the client IP set by the reverse proxy (optional), e.g. X-Forwarded-For
+
+	registrationTokenTTL = 10 * time.Minute // how long a registration link works
+	registrationSecret   = newRegistrationSecret()
+
+	usedTokensMutex sync.Mutex
+	usedTokens      = make(map[string]time.Time) // nonce of used tokens -> expiry
+)
+
+var (
+	errTokenInvalid = errors.New("invalid registration link")
+	errTokenExpired = errors.New("registration link expired")
+	errTokenUsed    = errors.New("registration link already used")
+)
+
+// registrationToken is the content of a signed registration link.
+type registrationToken struct {
+	UserID   string
+	Username string
+	Device   string
+	Expires  time.Time
+	Nonce    string
+}
+
+func init() {
+	httpMux.HandleFunc("/register", handleRegistrationLink)
+}
+
+// newRegistrationSecret returns the key that signs registration links. It only
+// lives in memory, so links sent before a restart stop working.
+func newRegistrationSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate registration link secret: %v", err)
+	}
+	return secret
+}
+
+// registrationLinksEnabled reports whether /register without an IP sends a link.
+func registrationLinksEnabled() bool {
+	return registrationLinkBaseURL != ""
+}
+
+// sendRegistrationLink DMs the member a one-time link that registers the IP it is
+// opened from for the given device.
+func sendRegistrationLink(c *commandContext, device string) {
+	token := newRegistrationToken(c.userID, c.username, device, time.Now())
+	message := fmt.Sprintf("Open this link on the PC you play VaM on to register its IP address:\n%s/register?token=%s\n"+
+		"The link works once and expires in %d minutes. Don't share it.",
+		registrationLinkBaseURL, token, int(registrationTokenTTL.Minutes()))
+
+	if c.isDM {
+		c.reply(message, true)
+		return
+	}
+	if err := sendUserDM(c.s, c.userID, message); err != nil {
+		c.reply("I couldn't send you a DM. Please allow DMs from server members or send /register to me directly.", true)
+		return
+	}
+	c.reply("I've sent you a registration link via DM.", true)
+}
+
+// newRegistrationToken signs a token for a device of userID that expires after registrationTokenTTL.
+func newRegistrationToken(userID, username, device string, now time.Time) string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	payload := strings.Join([]string{
+		userID,
+		username,
+		device,
+		strconv.FormatInt(now.Add(registrationTokenTTL).Unix(), 10),
+		base64.RawURLEncoding.EncodeToString(nonce),
+	}, "\n")
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signRegistrationPayload(encoded))
+}
+
+func signRegistrationPayload(encoded string) []byte {
+	mac := hmac.New(sha256.New, registrationSecret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// parseRegistrationToken checks the signature and expiry of a token. It does not
+// mark the token as used, see useRegistrationToken.
+func parseRegistrationToken(token string, now time.Time) (registrationToken, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return registrationToken{}, errTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signRegistrationPayload(encoded)) {
+		return registrationToken{}, errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return registrationToken{}, errTokenInvalid
+	}
+	parts := strings.Split(string(payload), "\n")
+	if len(parts) != 5 {
+		return registrationToken{}, errTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return registrationToken{}, errTokenInvalid
+	}
+
+	parsed := registrationToken{UserID: parts[0], Username: parts[1], Device: parts[2], Expires: time.Unix(expires, 0), Nonce: parts[4]}
+	if !now.Before(parsed.Expires) {
+		return parsed, errTokenExpired
+	}
+
+	usedTokensMutex.Lock()
+	_, used := usedTokens[parsed.Nonce]
+	usedTokensMutex.Unlock()
+	if used {
+		return parsed, errTokenUsed
+	}
+	return parsed, nil
+}
+
+// useRegistrationToken validates a token and marks it as used, so it works only once.
+func useRegistrationToken(token string, now time.Time) (registrationToken, error) {
+	parsed, err := parseRegistrationToken(token, now)
+	if err != nil {
+		return parsed, err
+	}
+
+	usedTokensMutex.Lock()
+	defer usedTokensMutex.Unlock()
+	// Forget used tokens once they would have expired anyway
+	for nonce, expires := range usedTokens {
+		if !now.Before(expires) {
+			delete(usedTokens, nonce)
+		}
+	}
+	if _, used := usedTokens[parsed.Nonce]; used {
+		return parsed, errTokenUsed
+	}
+	usedTokens[parsed.Nonce] = parsed.Expires
+	return parsed, nil
+}
+
+// releaseRegistrationToken makes a token usable again after the registration it
+// was used for failed.
+func releaseRegistrationToken(parsed registrationToken) {
+	usedTokensMutex.Lock()
+	defer usedTokensMutex.Unlock()
+	delete(usedTokens, parsed.Nonce)
+}
+
+// requestClientIP returns the IP of the visitor. Behind a reverse proxy it takes
+// the last address of the trusted header, which is the one the proxy added
+// itself; anything before it could have been sent by the client.
+func requestClientIP(r *http.Request) string {
+	if trustedProxyHeader != "" {
+		if values := r.Header.Values(trustedProxyHeader); len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var registrationTemplate = template.Must(template.New("register").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>VaM Multiplayer registration</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #1e1f22; color: #dbdee1; }
+button { font-size: 1.1em; padding: 0.5em 1.5em; }
+.muted { color: #949ba4; }
+</style>
+</head>
+<body>
+<h1>VaM Multiplayer registration</h1>
+<p>{{.Message}}</p>
+{{if .Confirm}}<form method="post" action="/register">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Register {{.IP}}</button>
+</form>
+<p class="muted">Open this page on the PC you play VaM on. If you use a VPN, turn it off first.</p>
+{{end}}
+</body>
+</html>
+`))
+
+type registrationPage struct {
+	Message string
+	Confirm bool
+	Token   string
+	IP      string
+}
+
+// handleRegistrationLink serves the page behind a registration link. Opening it
+// only shows the detected IP; the IP is registered when the visitor confirms
+// with a POST, so link previews in chat apps can't use up the token.
+func handleRegistrationLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		token := r.URL.Query().Get("token")
+		parsed, err := parseRegistrationToken(token, time.Now())
+		if err != nil {
+			renderRegistrationPage(w, http.StatusBadRequest, registrationPage{Message: registrationTokenProblem(err)})
+			return
+		}
+		ip := requestClientIP(r)
+		renderRegistrationPage(w, http.StatusOK, registrationPage{
+			Message: fmt.Sprintf("Register %s for %s%s?", ip, parsed.Username, deviceSuffix(parsed.Device)),
+			Confirm: true,
+			Token:   token,
+			IP:      ip,
+		})
+	case http.MethodPost:
+		token := r.PostFormValue("token")
+		parsed, err := parseRegistrationToken(token, time.Now())
+		if err != nil {
+			renderRegistrationPage(w, http.StatusBadRequest, registrationPage{Message: registrationTokenProblem(err)})
+			return
+		}
+
+		prefix, problem := checkRegistrationAddress(requestClientIP(r))
+		if problem != "" {
+			renderRegistrationPage(w, http.StatusBadRequest, registrationPage{Message: problem + " Use /register <IP> in Discord instead."})
+			return
+		}
+		ip := allowlistEntry(prefix)
+		// The link can be opened long after /register checked the member
+		if discordSession != nil {
+			if err := checkEligibility(discordSession, parsed.UserID, time.Now()); err != nil {
+				renderRegistrationPage(w, http.StatusForbidden, registrationPage{Message: registerErrorMessage(err)})
+				return
+			}
+		}
+
+		// Hold the link while registering so it can't be used twice at once, a
+		// failed registration gives it back
+		if _, err := useRegistrationToken(token, time.Now()); err != nil {
+			renderRegistrationPage(w, http.StatusBadRequest, registrationPage{Message: registrationTokenProblem(err)})
+			return
+		}
+		if err := registerIP(ip, parsed.UserID, parsed.Username, parsed.Device); err != nil {
+			releaseRegistrationToken(parsed)
+			status := http.StatusInternalServerError
+			var banned *banError
+			if errors.As(err, &banned) {
+				status = http.StatusForbidden
+			}
+			renderRegistrationPage(w, status, registrationPage{Message: registerErrorMessage(err)})
+			return
+		}
+
+		message := fmt.Sprintf("Your IP address %s has been successfully registered/refreshed%s. You can now connect to the game.", ip, deviceSuffix(parsed.Device))
+		renderRegistrationPage(w, http.StatusOK, registrationPage{Message: message})
+		if discordSession != nil {
+			sendUserDM(discordSession, parsed.UserID, message)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// registrationTokenProblem explains to the visitor why a link doesn't work.
+func registrationTokenProblem(err error) string {
+	switch err {
+	case errTokenExpired:
+		return "This registration link has expired. Send /register to the bot to get a new one."
+	case errTokenUsed:
+		return "This registration link was already used. Send /register to the bot to get a new one."
+	default:
+		return "This registration link is not valid. Send /register to the bot to get a new one."
+	}
+}
+
+func renderRegistrationPage(w http.ResponseWriter, status int, page registrationPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := registrationTemplate.Execute(w, page); err != nil {
+		log.Println("Error rendering registration page:", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistrationToken(t *testing.T) {
+	newTestBot(t)
+	now := time.Unix(1700000000, 0)
+	token := newRegistrationToken("1", "alice", "laptop", now)
+
+	parsed, err := parseRegistrationToken(token, now)
+	if err != nil || parsed.UserID != "1" || parsed.Username != "alice" || parsed.Device != "laptop" {
+		t.Fatalf("parseRegistrationToken = %+v, %v", parsed, err)
+	}
+	if _, err := parseRegistrationToken(token, now.Add(registrationTokenTTL)); err != errTokenExpired {
+		t.Errorf("expired token error = %v, want %v", err, errTokenExpired)
+	}
+
+	// Flipping a character of the payload breaks the signature
+	tampered := "A" + token[1:]
+	if tampered == token {
+		tampered = "B" + token[1:]
+	}
+	if _, err := parseRegistrationToken(tampered, now); err != errTokenInvalid {
+		t.Errorf("tampered token error = %v, want %v", err, errTokenInvalid)
+	}
+	if _, err := parseRegistrationToken("garbage", now); err != errTokenInvalid {
+		t.Errorf("garbage token error = %v, want %v", err, errTokenInvalid)
+	}
+
+	if _, err := useRegistrationToken(token, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useRegistrationToken(token, now); err != errTokenUsed {
+		t.Errorf("second use error = %v, want %v", err, errTokenUsed)
+	}
+}
+
+func TestRequestClientIP(t *testing.T) {
+	newTestBot(t)
+	r := httptest.NewRequest(http.MethodGet, "/register", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 8.8.8.8")
+
+	if got := requestClientIP(r); got != "127.0.0.1" {
+		t.Errorf("without a trusted header, client IP = %q", got)
+	}
+	trustedProxyHeader = "X-Forwarded-For"
+	if got := requestClientIP(r); got != "8.8.8.8" {
+		t.Errorf("with a trusted header, client IP = %q, want the address added by the proxy", got)
+	}
+}
+
+func TestRegistrationLinkFlow(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	registrationLinkBaseURL = "https://vammp.example.com"
+	trustedProxyHeader = "X-Forwarded-For"
+
+	// /register without an IP in a channel sends the link via DM only
+	var replies []string
+	handleRegisterCommand(b.command("1", "alice", false, "/register", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "via DM") {
+		t.Fatalf("replies = %q", replies)
+	}
+	dms := b.fake.sentTo("dm-1")
+	if len(dms) != 1 {
+		t.Fatalf("DMs = %q, want the link", dms)
+	}
+	start := strings.Index(dms[0], "https://vammp.example.com/register?token=")
+	if start < 0 {
+		t.Fatalf("DM has no link: %q", dms[0])
+	}
+	link, err := url.Parse(strings.Fields(dms[0][start:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+
+	// Opening the link only asks for confirmation
+	get := httptest.NewRequest(http.MethodGet, "/register?token="+url.QueryEscape(token), nil)
+	get.Header.Set("X-Forwarded-For", "8.8.8.8")
+	rec := httptest.NewRecorder()
+	httpMux.ServeHTTP(rec, get)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Register 8.8.8.8 for alice?") {
+		t.Fatalf("GET = %d %q", rec.Code, rec.Body.String())
+	}
+	if _, err := usernameOf(store, "8.8.8.8"); err == nil {
+		t.Fatalf("IP registered before confirmation")
+	}
+
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Forwarded-For", "8.8.8.8")
+		rec := httptest.NewRecorder()
+		httpMux.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := post(); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "successfully registered") {
+		t.Fatalf("POST = %d %q", rec.Code, rec.Body.String())
+	}
+	if user, err := usernameOf(store, "8.8.8.8"); err != nil || user != "alice" {
+		t.Errorf("UsernameForIP(8.8.8.8) = %q, %v; want alice", user, err)
+	}
+	if dms := b.fake.sentTo("dm-1"); len(dms) != 2 || !strings.Contains(dms[1], "8.8.8.8") {
+		t.Errorf("DMs = %q, want a confirmation", dms)
+	}
+
+	if rec := post(); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "already used") {
+		t.Errorf("second POST = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRegistrationLinkRejectsLocalIP(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	token := newRegistrationToken("1", "alice", defaultDevice, time.Now())
+
+	post := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		httpMux.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := post("192.168.1.10:40000"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Local IP addresses are not allowed") {
+		t.Errorf("POST = %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A failed registration doesn't use up the link
+	if rec := post("8.8.8.8:40000"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "successfully registered") {
+		t.Errorf("POST from a public IP = %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	activeConfig   Config       // the configuration in use, replaced by reloads
+	botChannelName string       // channel the bot answers commands in
+	settingsMutex  sync.RWMutex // guards activeConfig and the settings a reload changes
+
+	// reloadableSettings are the config keys SIGHUP applies, the others need a restart.
+	reloadableSettings = map[string]bool{
+		"bot_channel":            true,
+		"always_monitor_channel": true,
+		"moderator_channel":      true,
+		"audit_channel":          true,
+		"admin_roles":            true,
+		"expiration":             true,
+	}
+)
+
+// botChannel returns the name of the channel the bot answers commands in.
+func botChannel() string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return botChannelName
+}
+
+// alwaysMonitoredChannel returns the ID of the always monitored channel, or "".
+func alwaysMonitoredChannel() string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return alwaysMonitorChannelID
+}
+
+// moderatorChannel returns the ID of the moderator channel, or "".
+func moderatorChannel() string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return moderatorChannelID
+}
+
+// auditChannel returns the ID of the channel audit events are mirrored to, or "".
+func auditChannel() string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return auditChannelID
+}
+
+// adminRoles returns the IDs of the roles allowed to use /admin.
+func adminRoles() []string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return adminRoleIDs
+}
+
+// registrationTTL returns how long a registration lasts.
+func registrationTTL() time.Duration {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return expirationTime
+}
+
+// watchReloadSignal reloads the configuration on every SIGHUP until ctx is done.
+func watchReloadSignal(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading configuration")
+			reloadConfig()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// reloadConfig re-reads the configuration and rooms.json and applies the
+// reloadable settings and the rooms together. If anything is invalid nothing
+// changes. Registrations, monitored channels, tracking notifications and the
+// last room snapshots stay as they are.
+func reloadConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Printf("Invalid configuration, keeping the current one:\n%v", err)
+		return err
+	}
+	newRooms, roomsModTime, err := readRoomsFile()
+	if err != nil {
+		log.Printf("Invalid rooms, keeping the current configuration: %v", err)
+		return err
+	}
+	commandsBefore := slashCommands()
+
+	settingsMutex.Lock()
+	previous := activeConfig
+	applied := previous
+	oldFields, newFields, appliedFields := configFields(&previous), configFields(&cfg), configFields(&applied)
+	for i, field := range newFields {
+		if reflect.DeepEqual(field.value.Interface(), oldFields[i].value.Interface()) {
+			continue
+		}
+		if !reloadableSettings[field.name] {
+			log.Printf("%s changed, restart the bot to apply it", field.name)
+			continue
+		}
+		appliedFields[i].value.Set(field.value)
+		log.Printf("%s changed", field.name)
+	}
+	activeConfig = applied
+	botChannelName = applied.BotChannel
+	alwaysMonitorChannelID = applied.AlwaysMonitorChannel
+	moderatorChannelID = applied.ModeratorChannel
+	auditChannelID = applied.AuditChannel
+	adminRoleIDs = applied.AdminRoles
+	expirationTime = applied.Expiration.Duration
+	// Rooms go in before the settings are released, so no reader sees one without the other
+	setRooms(newRooms, roomsModTime)
+	settingsMutex.Unlock()
+
+	if previous.AlwaysMonitorChannel != applied.AlwaysMonitorChannel {
+		mu.Lock()
+		delete(monitoredChannels, previous.AlwaysMonitorChannel)
+		mu.Unlock()
+		alwaysMonitorChannel()
+	}
+	// Command descriptions mention settings such as the registration lifetime
+	if discordSession != nil && !reflect.DeepEqual(slashCommands(), commandsBefore) {
+		registerSlashCommands(discordSession)
+	}
+	log.Println("Configuration reloaded")
+	return nil
+}
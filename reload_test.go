@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepSettings restores the globals applyConfig sets when the test ends.
+func keepSettings(t *testing.T) {
+	replace(t, &activeConfig, activeConfig)
+	replace(t, &token, token)
+	replace(t, &botChannelName, botChannelName)
+	replace(t, &alwaysMonitorChannelID, alwaysMonitorChannelID)
+	replace(t, &expirationTime, expirationTime)
+	replace(t, &monitorMaxHours, monitorMaxHours)
+	replace(t, &cleanupInterval, cleanupInterval)
+	replace(t, &statusPollInterval, statusPollInterval)
+	replace(t, &legacyTextCommands, legacyTextCommands)
+	replace(t, &weeklyDigestEnabled, weeklyDigestEnabled)
+	replace(t, &httpListenAddress, httpListenAddress)
+	replace(t, &metricsListenAddress, metricsListenAddress)
+}
+
+func TestReloadConfig(t *testing.T) {
+	b := newTestBot(t)
+	keepSettings(t)
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "guild_id": "111", "bot_channel": "vam-mp-bot",
+			"always_monitor_channel": "100", "admin_roles": ["1"]}`,
+	})
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(cfg)
+	alwaysMonitorChannel()
+	monitoredChannels["200"] = time.Now().Add(time.Hour) // /monitor 1
+	notifiedTrackings["alice"] = map[string]bool{"bob": true}
+
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "guild_id": "999", "bot_channel": "vam-mp-bot-2",
+			"always_monitor_channel": "101", "admin_roles": ["2"], "expiration": "48h"}`,
+		roomsFileName: `[{"name": "MAIN", "port": 7777}]`,
+	})
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if botChannel() != "vam-mp-bot-2" || alwaysMonitoredChannel() != "101" || registrationTTL() != 48*time.Hour {
+		t.Errorf("bot channel %q, always monitored %q, expiration %v", botChannel(), alwaysMonitoredChannel(), registrationTTL())
+	}
+	if !reflect.DeepEqual(adminRoles(), []string{"2"}) {
+		t.Errorf("admin roles = %q", adminRoles())
+	}
+	// The guild can't change while running
+	if guildID != "111" || activeConfig.GuildID != "111" {
+		t.Errorf("guild ID = %q, active config %q", guildID, activeConfig.GuildID)
+	}
+	if _, ok := monitoredChannels["100"]; ok {
+		t.Error("the old always monitored channel is still monitored")
+	}
+	if _, ok := monitoredChannels["101"]; !ok {
+		t.Error("the new always monitored channel is not monitored")
+	}
+	if _, ok := monitoredChannels["200"]; !ok {
+		t.Error("a /monitor channel was dropped")
+	}
+	if !notifiedTrackings["alice"]["bob"] {
+		t.Error("tracking notifications were reset")
+	}
+	if got := currentRooms(); len(got) != 1 || got[0].Name != "MAIN" || got[0].StatusFile != "current_players_port7777.txt" {
+		t.Errorf("rooms = %+v", got)
+	}
+
+	// The /register description shows the new expiry, commands are only
+	// registered again when they changed
+	if len(b.fake.commandSets) != 1 || !strings.Contains(b.fake.commandSets[0][0].Description, "valid for 2 days") {
+		t.Errorf("registered commands = %+v", b.fake.commandSets)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.fake.commandSets) != 1 {
+		t.Errorf("commands registered %d times, want once", len(b.fake.commandSets))
+	}
+}
+
+func TestReloadConfigRejectsInvalidChanges(t *testing.T) {
+	newTestBot(t)
+	keepSettings(t)
+	inTempDir(t)
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "bot_channel": "vam-mp-bot", "moderator_channel": "300"}`,
+	})
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(cfg)
+	roomsBefore := currentRooms()
+
+	// One bad value keeps the valid changes out too
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "bot_channel": "vam-mp-bot-2", "moderator_channel": "mods"}`,
+	})
+	if err := reloadConfig(); err == nil {
+		t.Error("reloadConfig accepted an invalid moderator channel")
+	}
+	if botChannel() != "vam-mp-bot" || moderatorChannel() != "300" {
+		t.Errorf("bot channel %q, moderator channel %q", botChannel(), moderatorChannel())
+	}
+
+	writeFiles(t, map[string]string{
+		"config.json": `{"token": "secret", "bot_channel": "vam-mp-bot-2", "moderator_channel": "301"}`,
+		roomsFileName: `[{"name": "MAIN", "port": 7777}, {"name": "MAIN", "port": 7778}]`,
+	})
+	if err := reloadConfig(); err == nil {
+		t.Error("reloadConfig accepted duplicate rooms")
+	}
+	if botChannel() != "vam-mp-bot" || moderatorChannel() != "300" {
+		t.Errorf("bot channel %q, moderator channel %q", botChannel(), moderatorChannel())
+	}
+	if got := currentRooms(); !reflect.DeepEqual(got, roomsBefore) {
+		t.Errorf("rooms = %+v, want %+v", got, roomsBefore)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	reminderLeadTime = 24 * time.Hour   // how long before expiry the reminder is sent
+	reminderInterval = 15 * time.Minute // how often registrations are checked for reminders
+)
+
+// Custom ID of the renew button, followed by the device name.
+const renewPrefix = "renew:"
+
+// registrationExpiry returns when cleanupExpiredIPs starts treating a registration as expired.
+func registrationExpiry(r Registration) time.Time {
+	return r.expiry(registrationTTL())
+}
+
+// handleWhoamiCommand processes the /whoami command.
+func handleWhoamiCommand(c *commandContext) {
+	registrations, err := store.Registrations(c.username)
+	if err != nil {
+		log.Printf("Error reading registrations: %v", err)
+		c.reply("Failed to read your registrations.", true)
+		return
+	}
+	reminders, err := store.Reminders()
+	if err != nil {
+		log.Printf("Error reading reminders: %v", err)
+	}
+	_, remindersOn := reminders[c.username]
+
+	var b strings.Builder
+	if len(registrations) == 0 {
+		b.WriteString("You are not registered. Use /register <IP> to register.\n")
+	} else {
+		b.WriteString("Your registrations:\n")
+		for _, r := range registrations {
+			// Discord shows the timestamps in the reader's own time zone
+			expiry := registrationExpiry(r)
+			fmt.Fprintf(&b, "- %s: %s, registered <t:%d:f>, expires <t:%d:f> (<t:%d:R>)\n",
+				r.Device, maskIP(r.IP), r.Registered.Unix(), expiry.Unix(), expiry.Unix())
+		}
+	}
+	if remindersOn {
+		b.WriteString("Renewal reminders are on, you get a DM a day before a registration expires. Turn them off with /reminders off.")
+	} else {
+		b.WriteString("Renewal reminders are off. Use /reminders on to get a DM a day before a registration expires.")
+	}
+	c.reply(b.String(), true)
+}
+
+// handleRemindersCommand processes the /reminders [on|off] command.
+func handleRemindersCommand(c *commandContext) {
+	if len(c.args) < 2 {
+		c.reply("Please use /reminders on or /reminders off. /whoami shows whether they are on.", true)
+		return
+	}
+
+	var enabled bool
+	switch strings.ToLower(c.args[1]) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		c.reply("Please use /reminders on or /reminders off.", true)
+		return
+	}
+
+	if err := store.SetReminder(c.username, c.userID, enabled); err != nil {
+		log.Printf("Error saving reminder setting of %s: %v", c.username, err)
+		c.reply("Failed to save your reminder setting.", true)
+		return
+	}
+	if enabled {
+		c.reply(fmt.Sprintf("You will get a DM %d hours before a registration expires, with a button to renew it.", int(reminderLeadTime.Hours())), true)
+	} else {
+		c.reply("Renewal reminders turned off.", true)
+	}
+}
+
+// startRenewalReminders periodically DMs opted-in users whose registrations expire soon.
+func startRenewalReminders(ctx context.Context, s discordAPI) error {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			sendRenewalReminders(s, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendRenewalReminders sends a reminder for every registration of an opted-in
+// user that expires within reminderLeadTime and wasn't reminded about yet. The
+// store remembers the registration time reminded about, so restarts don't send
+// the reminders again and a renewed registration gets a new one later.
+func sendRenewalReminders(s discordAPI, now time.Time) {
+	reminders, err := store.Reminders()
+	if err != nil {
+		log.Printf("Error reading reminders: %v", err)
+		return
+	}
+
+	for username, userID := range reminders {
+		registrations, err := store.Registrations(username)
+		if err != nil {
+			log.Printf("Error reading registrations of %s: %v", username, err)
+			continue
+		}
+		for _, r := range registrations {
+			expiry := registrationExpiry(r)
+			if r.Registered.IsZero() || now.Before(expiry.Add(-reminderLeadTime)) {
+				continue
+			}
+
+			due, err := store.MarkReminded(username, r.Device, r.Registered)
+			if err != nil {
+				log.Printf("Error saving the reminder of %s: %v", username, err)
+				continue
+			}
+			if !due {
+				continue
+			}
+
+			if err := sendRenewalReminder(s, userID, r); err != nil {
+				log.Printf("Failed to send renewal reminder to %s: %v", username, err)
+				continue
+			}
+			log.Printf("Sent renewal reminder to %s for %s", username, r.Device)
+		}
+	}
+}
+
+// sendRenewalReminder DMs a reminder with a button that renews the registration.
+func sendRenewalReminder(s discordAPI, userID string, r Registration) error {
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		return err
+	}
+	expiry := registrationExpiry(r)
+	_, err = s.ChannelMessageSendComplex(channel.ID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("Your registration%s (%s) expires <t:%d:R>. Renew it to keep playing without registering again.",
+			deviceSuffix(r.Device), maskIP(r.IP), expiry.Unix()),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Renew", Style: discordgo.PrimaryButton, CustomID: renewPrefix + r.Device},
+			}},
+		},
+	})
+	return err
+}
+
+// handleRenewButton renews the registration of a device when its reminder button is clicked.
+func handleRenewButton(s discordAPI, i *discordgo.InteractionCreate, device string) {
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil {
+		return
+	}
+
+	var outcome string
+	registrations, err := store.Registrations(user.Username)
+	if eligibilityErr := checkEligibility(s, user.ID, time.Now()); eligibilityErr != nil {
+		outcome = registerErrorMessage(eligibilityErr)
+	} else if err != nil {
+		log.Printf("Error reading registrations of %s: %v", user.Username, err)
+		outcome = "Failed to read your registrations, please try again later."
+	} else {
+		outcome = fmt.Sprintf("Your registration%s has already expired. Use /register to register again.", deviceSuffix(device))
+		for _, r := range registrations {
+			if r.Device != device {
+				continue
+			}
+			if err := registerIP(r.IP, user.ID, user.Username, device); err != nil {
+				outcome = registerErrorMessage(err)
+				break
+			}
+			outcome = fmt.Sprintf("Your registration%s has been renewed and now expires <t:%d:f>.",
+				deviceSuffix(device), time.Now().Add(registrationTTL()).Unix())
+			break
+		}
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    outcome,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		log.Println("Error responding to interaction:", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestWhoamiAndReminderSetting(t *testing.T) {
+	b := newTestBot(t)
+	registered := time.Unix(1700000000, 0)
+	store.RegisterIP("8.8.4.4", "", "alice", "laptop", registered)
+
+	run := func(text string) string {
+		t.Helper()
+		var replies []string
+		dispatchCommand(b.command("1", "alice", false, text, &replies))
+		if len(replies) != 1 {
+			t.Fatalf("%s: replies = %q", text, replies)
+		}
+		return replies[0]
+	}
+
+	got := run("/whoami")
+	for _, want := range []string{"laptop: 8.8.x.x", "registered <t:1700000000:f>", "expires <t:1700604800:f>", "reminders are off"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/whoami = %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "8.8.4.4") {
+		t.Errorf("/whoami shows the full IP: %q", got)
+	}
+
+	if got := run("/reminders on"); !strings.Contains(got, "24 hours before") {
+		t.Errorf("/reminders on = %q", got)
+	}
+	if reminders, _ := store.Reminders(); reminders["alice"] != "1" {
+		t.Errorf("reminders = %v, want alice with her user ID", reminders)
+	}
+	if got := run("/whoami"); !strings.Contains(got, "reminders are on") {
+		t.Errorf("/whoami after /reminders on = %q", got)
+	}
+	if got := run("/reminders maybe"); !strings.Contains(got, "/reminders on or /reminders off") {
+		t.Errorf("/reminders maybe = %q", got)
+	}
+}
+
+func TestRenewalReminderAndRenewButton(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	registered := time.Now().Add(-expirationTime + 12*time.Hour)
+	store.RegisterIP("8.8.4.4", "", "alice", "laptop", registered)
+	store.RegisterIP("9.9.9.9", "", "bob", defaultDevice, registered)
+	store.SetReminder("alice", "1", true)
+
+	// Nothing is due two days before the reminder window
+	sendRenewalReminders(b.fake, registered)
+	if len(b.fake.complexMessages) != 0 {
+		t.Fatalf("reminders sent too early: %d", len(b.fake.complexMessages))
+	}
+
+	// Only alice opted in, and she is reminded once
+	sendRenewalReminders(b.fake, time.Now())
+	sendRenewalReminders(b.fake, time.Now())
+	if got := b.fake.sentTo("dm-1"); len(got) != 1 || !strings.Contains(got[0], "for your device laptop") {
+		t.Fatalf("reminders to alice = %q", got)
+	}
+	if len(b.fake.complexMessages) != 1 {
+		t.Fatalf("reminders sent = %d, want 1", len(b.fake.complexMessages))
+	}
+	button := b.fake.complexMessages[0].Components[0].(discordgo.ActionsRow).Components[0].(discordgo.Button)
+
+	interactionCreate(b.fake, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		Type: discordgo.InteractionMessageComponent,
+		User: &discordgo.User{ID: "1", Username: "alice"},
+		Data: discordgo.MessageComponentInteractionData{CustomID: button.CustomID},
+	}}, "bot-channel")
+
+	registrations, _ := store.Registrations("alice")
+	if len(registrations) != 1 || !registrations[0].Registered.After(registered) {
+		t.Errorf("registration not renewed: %+v", registrations)
+	}
+	if len(b.fake.responses) != 1 || !strings.Contains(b.fake.responses[0].Data.Content, "has been renewed") {
+		t.Errorf("responses = %+v", b.fake.responses)
+	}
+}
+
+func TestUnregisterWithoutDevice(t *testing.T) {
+	b := newTestBot(t)
+	store.RegisterIP("8.8.4.4", "", "alice", defaultDevice, time.Now())
+
+	var replies []string
+	handleUnregisterCommand(b.command("1", "alice", true, "/unregister", &replies))
+	if len(replies) != 1 || !strings.Contains(replies[0], "registration has been removed") {
+		t.Errorf("replies = %q", replies)
+	}
+	if _, err := usernameOf(store, "8.8.4.4"); err == nil {
+		t.Errorf("8.8.4.4 still registered")
+	}
+}
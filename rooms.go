@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Room describes one game server room, as listed in rooms.json.
+type Room struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	StatusFile  string `json:"status_file"`  // current_players file written by the room's server
+	PlayerLimit int    `json:"player_limit"` // max controlled players, spectators not included
+	Description string `json:"description"`
+}
+
+var (
+	roomsFileName = "rooms.json" // room definitions (optional, defaults to the two original rooms)
+	roomsMutex    sync.Mutex     // protects rooms and roomsModTime
+	rooms         []Room
+	roomsModTime  time.Time // modification time of rooms.json when it was last loaded
+)
+
+// defaultRooms are used when rooms.json does not exist.
+func defaultRooms() []Room {
+	return []Room{
+		{Name: "ROOM1", Port: 8888, StatusFile: "current_players_port8888.txt", PlayerLimit: 8},
+		{Name: "ROOM2", Port: 9999, StatusFile: "current_players_port9999.txt", PlayerLimit: 8},
+	}
+}
+
+// currentRooms returns the room definitions, reloading rooms.json first if it changed
+// on disk. Rooms can therefore be added or removed while the bot is running.
+func currentRooms() []Room {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	info, err := os.Stat(roomsFileName)
+	switch {
+	case os.IsNotExist(err):
+		// Fall back to the defaults on first use, or when the file was deleted
+		if !roomsModTime.IsZero() {
+			log.Printf("%s removed, using default rooms", roomsFileName)
+		}
+		if rooms == nil || !roomsModTime.IsZero() {
+			rooms = defaultRooms()
+			roomsModTime = time.Time{}
+		}
+	case err != nil:
+		log.Printf("Failed to stat %s: %v", roomsFileName, err)
+	case !info.ModTime().Equal(roomsModTime):
+		loaded, err := loadRooms(roomsFileName)
+		if err != nil {
+			// Keep serving the previous definitions until the file is fixed
+			log.Printf("Failed to load %s, keeping previous rooms: %v", roomsFileName, err)
+			if rooms == nil {
+				rooms = defaultRooms()
+			}
+		} else {
+			rooms = loaded
+			log.Printf("Loaded %d rooms from %s", len(rooms), roomsFileName)
+		}
+		roomsModTime = info.ModTime()
+	}
+
+	result := make([]Room, len(rooms))
+	copy(result, rooms)
+	return result
+}
+
+// readRoomsFile reads the room definitions like currentRooms, without using them.
+func readRoomsFile() ([]Room, time.Time, error) {
+	info, err := os.Stat(roomsFileName)
+	if os.IsNotExist(err) {
+		return defaultRooms(), time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	loaded, err := loadRooms(roomsFileName)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", roomsFileName, err)
+	}
+	return loaded, info.ModTime(), nil
+}
+
+// setRooms replaces the room definitions read by readRoomsFile.
+func setRooms(defs []Room, modTime time.Time) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+	rooms, roomsModTime = defs, modTime
+}
+
+// loadRooms reads and validates room definitions from a JSON file.
+func loadRooms(filename string) ([]Room, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []Room
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, err
+	}
+	if err := validateRooms(loaded); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// validateRooms checks the room definitions and fills in the default status file name.
+func validateRooms(defs []Room) error {
+	if len(defs) == 0 {
+		return fmt.Errorf("no rooms defined")
+	}
+
+	names := make(map[string]bool)
+	ports := make(map[int]bool)
+	for i := range defs {
+		room := &defs[i]
+		if room.Name == "" {
+			return fmt.Errorf("room %d has no name", i+1)
+		}
+		if names[room.Name] {
+			return fmt.Errorf("duplicate room name %s", room.Name)
+		}
+		names[room.Name] = true
+		if room.Port <= 0 || room.Port > 65535 {
+			return fmt.Errorf("room %s has invalid port %d", room.Name, room.Port)
+		}
+		if ports[room.Port] {
+			return fmt.Errorf("duplicate room port %d", room.Port)
+		}
+		ports[room.Port] = true
+		if room.PlayerLimit < 0 {
+			return fmt.Errorf("room %s has negative player limit", room.Name)
+		}
+		if room.StatusFile == "" {
+			// Same naming as VAMMultiplayerTCPServer.py
+			room.StatusFile = fmt.Sprintf("current_players_port%d.txt", room.Port)
+		}
+	}
+	return nil
+}
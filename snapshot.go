@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spectatorCharacter is the player name VAMMultiplayerTCPServer.py reports for spectators.
+const spectatorCharacter = "@SPECTATOR@"
+
+// PlayerPresence is one client connected to a room, as reported in the room's status file.
+type PlayerPresence struct {
+	IP        string
+	Port      string
+	Username  string // unique Discord username registered for IP, empty if unknown
+	Character string // controlled Person atom, empty for spectators
+	Spectator bool
+	Scene     string   // empty if the client did not report one
+	Owners    []string // users sharing IP, when it couldn't be worked out which of them this is
+}
+
+// identity identifies the player across status lines: the registered user,
+// or the IP when the user is unknown.
+func (p PlayerPresence) identity() string {
+	if p.Username != "" {
+		return p.Username
+	}
+	return p.IP
+}
+
+// RoomSnapshot is the state of a room according to the last line of its status file.
+type RoomSnapshot struct {
+	Room    Room
+	Running bool      // false if the status file is missing or empty
+	Updated time.Time // timestamp of the status line
+	Players []PlayerPresence
+	Problem string // set when the status line could not be parsed
+	Down    string // set when the watchdog considers the room server down
+}
+
+var (
+	errStatusFormat    = errors.New("invalid game status format")
+	errStatusTimestamp = errors.New("invalid status timestamp")
+)
+
+// PlayerEventType is the kind of change between two snapshots of a room.
+type PlayerEventType int
+
+const (
+	PlayerJoined PlayerEventType = iota
+	PlayerLeft
+	PlayerSwitchedCharacter
+	PlayerChangedScene
+)
+
+func (t PlayerEventType) String() string {
+	switch t {
+	case PlayerJoined:
+		return "joined"
+	case PlayerLeft:
+		return "left"
+	case PlayerSwitchedCharacter:
+		return "switched character"
+	case PlayerChangedScene:
+		return "changed scene"
+	}
+	return "unknown"
+}
+
+// PlayerEvent is a change of one player between two snapshots of a room.
+type PlayerEvent struct {
+	Type   PlayerEventType
+	Room   string
+	Player PlayerPresence // state after the event, before it for PlayerLeft
+	Before PlayerPresence // previous state for switches and scene changes
+}
+
+// currentSnapshots reads a snapshot of every room defined in rooms.json.
+func currentSnapshots() ([]RoomSnapshot, error) {
+	var snaps []RoomSnapshot
+	for _, room := range currentRooms() {
+		snap, err := readRoomSnapshot(room)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// readRoomSnapshot builds the snapshot of a room from the last line of its status file.
+func readRoomSnapshot(room Room) (RoomSnapshot, error) {
+	snap := RoomSnapshot{Room: room, Down: roomDownReason(room.Name)}
+
+	lastLine, ok, err := lastStatusLine(room.StatusFile)
+	if err != nil {
+		return snap, err
+	}
+	if !ok {
+		// server for this room has not written anything yet
+		return snap, nil
+	}
+	snap.Running = true
+
+	snap.Updated, snap.Players, err = parseStatusLine(lastLine)
+	switch err {
+	case nil:
+	case errStatusTimestamp:
+		snap.Problem = "Error parsing timestamp."
+		return snap, nil
+	default:
+		snap.Problem = "Invalid game status format in file."
+		return snap, nil
+	}
+	if snap.Down != "" {
+		// The players of a dead server are long gone
+		snap.Players = nil
+		return snap, nil
+	}
+	resolveUsernames(snap.Players, registeredUsernames, history.affinity)
+	return snap, nil
+}
+
+// parseStatusLine parses a status file line of the form
+// "<unix timestamp>;<ip>:<port>:<character>[:<scene>],...", see parsePlayerEntry.
+// Malformed player entries are skipped.
+func parseStatusLine(line string) (time.Time, []PlayerPresence, error) {
+	parts := strings.SplitN(line, ";", 2)
+	if len(parts) != 2 {
+		return time.Time{}, nil, errStatusFormat
+	}
+
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, nil, errStatusTimestamp
+	}
+
+	var players []PlayerPresence
+	if parts[1] == "" {
+		return time.Unix(timestamp, 0), players, nil
+	}
+	for _, info := range strings.Split(parts[1], ",") {
+		player, ok := parsePlayerEntry(info)
+		if !ok {
+			continue // Skip invalid entries
+		}
+		players = append(players, player)
+	}
+	return time.Unix(timestamp, 0), players, nil
+}
+
+// parsePlayerEntry parses "<ip>:<port>:<character>[:<scene>]". IPv6 addresses
+// are bracketed, e.g. "[2001:db8::1]:5000:Player1".
+func parsePlayerEntry(info string) (PlayerPresence, bool) {
+	var player PlayerPresence
+	if strings.HasPrefix(info, "[") {
+		end := strings.Index(info, "]:")
+		if end < 0 {
+			return player, false
+		}
+		player.IP = info[1:end]
+		info = info[end+2:]
+	} else {
+		ip, rest, found := strings.Cut(info, ":")
+		if !found {
+			return player, false
+		}
+		player.IP = ip
+		info = rest
+	}
+
+	playerParts := strings.Split(info, ":")
+	if len(playerParts) < 2 || len(playerParts) > 3 {
+		return player, false
+	}
+	player.Port = playerParts[0]
+	player.Character = playerParts[1]
+	if player.Character == spectatorCharacter {
+		player.Spectator = true
+		player.Character = ""
+	}
+	if len(playerParts) == 3 {
+		player.Scene = playerParts[2]
+	}
+	return player, true
+}
+
+// registeredUsernames returns the users who registered ip, nil if nobody did.
+func registeredUsernames(ip string) []string {
+	usernames, _ := store.UsernamesForIP(ip)
+	return usernames
+}
+
+// resolveUsernames fills in the registered username of each player's IP, as
+// returned by ownersOf. When several users registered the same IP, players are
+// matched to them by how well their character and scene fit what each user
+// played before (see historyIndex.affinity). Players that can't be told apart
+// keep the candidates in Owners.
+func resolveUsernames(players []PlayerPresence, ownersOf func(ip string) []string, affinity func(username string, player PlayerPresence) int) {
+	owners := make(map[string][]string) // IP -> users who registered it
+	byIP := make(map[string][]int)      // IP -> indexes of its players
+	for i := range players {
+		ip := players[i].IP
+		if _, looked := owners[ip]; !looked {
+			owners[ip] = ownersOf(ip)
+		}
+		byIP[ip] = append(byIP[ip], i)
+	}
+	for ip, indexes := range byIP {
+		assignOwners(players, indexes, owners[ip], affinity)
+	}
+}
+
+// assignOwners matches the players connected from one IP to the users who registered it.
+func assignOwners(players []PlayerPresence, indexes []int, owners []string, affinity func(username string, player PlayerPresence) int) {
+	if len(owners) == 1 {
+		for _, i := range indexes {
+			players[i].Username = owners[0]
+		}
+		return
+	}
+	if len(owners) == 0 {
+		return
+	}
+
+	// Best fitting player and owner pairs first, each player and owner used once
+	type match struct {
+		index int
+		owner string
+		score int
+	}
+	var matches []match
+	for _, i := range indexes {
+		for _, owner := range owners {
+			if score := affinity(owner, players[i]); score > 0 {
+				matches = append(matches, match{i, owner, score})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+	assigned := make(map[string]bool)
+	for _, m := range matches {
+		if players[m.index].Username == "" && !assigned[m.owner] {
+			players[m.index].Username = m.owner
+			assigned[m.owner] = true
+		}
+	}
+
+	var remaining []string
+	for _, owner := range owners {
+		if !assigned[owner] {
+			remaining = append(remaining, owner)
+		}
+	}
+	for _, i := range indexes {
+		if players[i].Username != "" {
+			continue
+		}
+		switch len(remaining) {
+		case 0:
+			players[i].Owners = owners
+		case 1:
+			players[i].Username = remaining[0]
+		default:
+			players[i].Owners = remaining
+		}
+	}
+}
+
+// diffSnapshots returns the player events that turn prev into cur. Players are
+// matched by connection (IP and port) first, then by identity so that a player
+// who reconnects with another character counts as a switch rather than leave and join.
+func diffSnapshots(prev, cur []RoomSnapshot) []PlayerEvent {
+	prevByRoom := make(map[string][]PlayerPresence)
+	for _, snap := range prev {
+		prevByRoom[snap.Room.Name] = snap.Players
+	}
+
+	var events []PlayerEvent
+	seenRooms := make(map[string]bool)
+	for _, snap := range cur {
+		seenRooms[snap.Room.Name] = true
+		events = append(events, diffRoom(snap.Room.Name, prevByRoom[snap.Room.Name], snap.Players)...)
+	}
+	// Rooms removed from rooms.json - everyone in them left
+	for _, snap := range prev {
+		if !seenRooms[snap.Room.Name] {
+			events = append(events, diffRoom(snap.Room.Name, snap.Players, nil)...)
+		}
+	}
+	return events
+}
+
+func diffRoom(room string, prev, cur []PlayerPresence) []PlayerEvent {
+	var events []PlayerEvent
+	matchedPrev := make([]bool, len(prev))
+	matchedCur := make([]bool, len(cur))
+
+	match := func(same func(a, b PlayerPresence) bool) {
+		for i, before := range prev {
+			if matchedPrev[i] {
+				continue
+			}
+			for j, after := range cur {
+				if matchedCur[j] || !same(before, after) {
+					continue
+				}
+				matchedPrev[i], matchedCur[j] = true, true
+				if before.Character != after.Character || before.Spectator != after.Spectator {
+					events = append(events, PlayerEvent{Type: PlayerSwitchedCharacter, Room: room, Player: after, Before: before})
+				}
+				if before.Scene != after.Scene {
+					events = append(events, PlayerEvent{Type: PlayerChangedScene, Room: room, Player: after, Before: before})
+				}
+				break
+			}
+		}
+	}
+	match(func(a, b PlayerPresence) bool { return a.IP == b.IP && a.Port == b.Port })
+	match(func(a, b PlayerPresence) bool { return a.identity() == b.identity() })
+
+	for i, before := range prev {
+		if !matchedPrev[i] {
+			events = append(events, PlayerEvent{Type: PlayerLeft, Room: room, Player: before})
+		}
+	}
+	for j, after := range cur {
+		if !matchedCur[j] {
+			events = append(events, PlayerEvent{Type: PlayerJoined, Room: room, Player: after})
+		}
+	}
+	return events
+}
+
+// presentUsers returns the registered users connected to any of the rooms.
+func presentUsers(snaps []RoomSnapshot) map[string]bool {
+	users := make(map[string]bool)
+	for _, snap := range snaps {
+		for _, player := range snap.Players {
+			if player.Username != "" {
+				users[player.Username] = true
+			}
+		}
+	}
+	return users
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStatusLine(t *testing.T) {
+	updated, players, err := parseStatusLine("1700000000;1.1.1.1:5000:Player1:Hotel,2.2.2.2:5001:@SPECTATOR@,bad-entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("updated = %v", updated)
+	}
+	want := []PlayerPresence{
+		{IP: "1.1.1.1", Port: "5000", Character: "Player1", Scene: "Hotel"},
+		{IP: "2.2.2.2", Port: "5001", Spectator: true},
+	}
+	if !reflect.DeepEqual(players, want) {
+		t.Errorf("players = %+v, want %+v", players, want)
+	}
+
+	_, players, err = parseStatusLine("1700000000;[2606:4700::1111]:5000:Player2:Hotel,[::1:5000:Player3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []PlayerPresence{{IP: "2606:4700::1111", Port: "5000", Character: "Player2", Scene: "Hotel"}}
+	if !reflect.DeepEqual(players, want) {
+		t.Errorf("IPv6 players = %+v, want %+v", players, want)
+	}
+
+	if _, players, err := parseStatusLine("1700000000;"); err != nil || len(players) != 0 {
+		t.Errorf("empty room parsed as %+v, %v", players, err)
+	}
+	if _, _, err := parseStatusLine("no separator"); err != errStatusFormat {
+		t.Errorf("missing separator error = %v", err)
+	}
+	if _, _, err := parseStatusLine("abc;1.1.1.1:5000:Player1"); err != errStatusTimestamp {
+		t.Errorf("bad timestamp error = %v", err)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	room := Room{Name: "ROOM1"}
+	snap := func(players ...PlayerPresence) []RoomSnapshot {
+		return []RoomSnapshot{{Room: room, Running: true, Players: players}}
+	}
+	alice := PlayerPresence{IP: "1.1.1.1", Port: "5000", Username: "alice", Character: "Player1", Scene: "Hotel"}
+	bob := PlayerPresence{IP: "2.2.2.2", Port: "5001", Spectator: true}
+
+	aliceSwitched := alice
+	aliceSwitched.Port = "5002" // reconnected to pick another character
+	aliceSwitched.Character = "Player2"
+
+	aliceNewScene := alice
+	aliceNewScene.Scene = "Beach"
+
+	tests := []struct {
+		name      string
+		prev, cur []RoomSnapshot
+		want      []PlayerEventType
+	}{
+		{"join", snap(), snap(alice, bob), []PlayerEventType{PlayerJoined, PlayerJoined}},
+		{"leave", snap(alice, bob), snap(bob), []PlayerEventType{PlayerLeft}},
+		{"no change", snap(alice), snap(alice), nil},
+		{"switch character", snap(alice), snap(aliceSwitched), []PlayerEventType{PlayerSwitchedCharacter}},
+		{"scene change", snap(alice), snap(aliceNewScene), []PlayerEventType{PlayerChangedScene}},
+		{"room removed", snap(alice), nil, []PlayerEventType{PlayerLeft}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []PlayerEventType
+			for _, event := range diffSnapshots(tt.prev, tt.cur) {
+				got = append(got, event.Type)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveUsernamesSharedIP(t *testing.T) {
+	newTestBot(t)
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	store.RegisterIP("8.8.8.8", "", "bob", defaultDevice, time.Now())
+	store.RegisterIP("9.9.9.9", "", "carol", defaultDevice, time.Now())
+
+	// alice usually plays Player1, bob Player2 in the Hotel
+	affinity := func(username string, player PlayerPresence) int {
+		switch {
+		case username == "alice" && player.Character == "Player1":
+			return 2
+		case username == "bob" && player.Scene == "Hotel":
+			return 1
+		}
+		return 0
+	}
+
+	players := []PlayerPresence{
+		{IP: "8.8.8.8", Port: "1", Character: "Player2", Scene: "Hotel"},
+		{IP: "8.8.8.8", Port: "2", Character: "Player1", Scene: "Hotel"},
+		{IP: "9.9.9.9", Port: "3", Character: "Player3"},
+	}
+	resolveUsernames(players, registeredUsernames, affinity)
+	for i, want := range []string{"bob", "alice", "carol"} {
+		if players[i].Username != want {
+			t.Errorf("player %d resolved to %q, want %q", i, players[i].Username, want)
+		}
+	}
+
+	// Nothing to go by: the player could be either of them
+	players = []PlayerPresence{{IP: "8.8.8.8", Port: "1", Character: "Player4"}}
+	resolveUsernames(players, registeredUsernames, affinity)
+	if players[0].Username != "" || !reflect.DeepEqual(players[0].Owners, []string{"alice", "bob"}) {
+		t.Errorf("ambiguous player resolved to %q, owners %v", players[0].Username, players[0].Owners)
+	}
+	if got := displayName(players[0]); got != "alice or bob" {
+		t.Errorf("displayName = %q, want %q", got, "alice or bob")
+	}
+
+	// Once alice is matched, the other player must be bob
+	players = []PlayerPresence{
+		{IP: "8.8.8.8", Port: "1", Character: "Player1"},
+		{IP: "8.8.8.8", Port: "2", Character: "Player4"},
+	}
+	resolveUsernames(players, registeredUsernames, affinity)
+	if players[0].Username != "alice" || players[1].Username != "bob" {
+		t.Errorf("players resolved to %q and %q, want alice and bob", players[0].Username, players[1].Username)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// handleStatsCommand processes /stats [user] and /stats room [name].
+func handleStatsCommand(c *commandContext) {
+	args := c.args[1:]
+	if len(args) > 0 && args[0] == "room" {
+		handleRoomStats(c, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "user" {
+		args = args[1:]
+	}
+
+	username := c.username
+	if len(args) > 0 {
+		// Find the user in the guild
+		user, err := findUserInGuild(c.s, guildID, strings.TrimSpace(args[0]))
+		if err != nil {
+			c.reply(fmt.Sprintf("Error: %v", err), true)
+			return
+		}
+		username = user.Username
+	}
+
+	if !historyLoaded(c) {
+		return
+	}
+	history.update()
+	stats := history.userStats(username, time.Now())
+	if stats.Sessions == 0 {
+		c.reply(fmt.Sprintf("No sessions found for %s.", username), false)
+		return
+	}
+
+	text := fmt.Sprintf("Stats for %s:\nTotal playtime: %s\nSessions: %d\n", username, formatDuration(stats.Playtime), stats.Sessions)
+	if stats.FavouriteCharacter != "" {
+		text += fmt.Sprintf("Favourite character: %s\n", stats.FavouriteCharacter)
+	}
+	if stats.FavouriteScene != "" {
+		text += fmt.Sprintf("Favourite scene: %s\n", stats.FavouriteScene)
+	}
+	c.reply(text, false)
+}
+
+// handleRoomStats shows peak concurrency and busiest hours of one or all rooms.
+func handleRoomStats(c *commandContext, args []string) {
+	if !historyLoaded(c) {
+		return
+	}
+	history.update()
+
+	now := time.Now()
+	text := ""
+	found := false
+	for _, room := range currentRooms() {
+		if len(args) > 0 && !strings.EqualFold(args[0], room.Name) {
+			continue
+		}
+		found = true
+
+		stats := history.roomStats(room.Name, now)
+		text += fmt.Sprintf("%s:\nSessions: %d\nTotal playtime: %s\n", room.Name, stats.Sessions, formatDuration(stats.Playtime))
+		if stats.Peak > 0 {
+			text += fmt.Sprintf("Peak: %d players on %s\n", stats.Peak, stats.PeakAt.Format(time.RFC1123))
+		}
+		if len(stats.BusiestHours) > 0 {
+			text += fmt.Sprintf("Busiest hours: %s\n", formatHours(stats.BusiestHours, 3))
+		}
+		text += "\n"
+	}
+
+	if !found {
+		c.reply(fmt.Sprintf("Unknown room %s.", args[0]), true)
+		return
+	}
+	c.reply(text, false)
+}
+
+// historyLoaded reports whether the session history is loaded, and asks the
+// user to try again later if it isn't.
+func historyLoaded(c *commandContext) bool {
+	if history.ready.Load() {
+		return true
+	}
+	c.reply("The play history is still loading, please try again in a minute.", true)
+	return false
+}
+
+// formatDuration formats a duration as hours and minutes, e.g. "12h 5m".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// formatHours formats up to max hours of the day as UTC ranges.
+func formatHours(hours []int, max int) string {
+	var ranges []string
+	for i, hour := range hours {
+		if i == max {
+			break
+		}
+		ranges = append(ranges, fmt.Sprintf("%02d:00-%02d:00", hour, (hour+1)%24))
+	}
+	return strings.Join(ranges, ", ") + " UTC"
+}
@@ -0,0 +1,977 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store persists IP registrations, IP to username mappings and trackings.
+// All command handlers and background jobs go through it.
+type Store interface {
+	// RegisterIP adds or refreshes the registration of ip by the named device of
+	// username, whose Discord user ID is userID, replacing the IP the device had
+	// registered before. Other users' registrations of the same IP are left
+	// alone. A user can hold at most maxDevicesPerUser devices.
+	RegisterIP(ip, userID, username, device string, now time.Time) error
+	// Registrations returns the devices registered by username.
+	Registrations(username string) ([]Registration, error)
+	// Unregister removes a device of username and returns its IP.
+	Unregister(username, device string) (string, error)
+	// RemoveExpired removes registrations older than ttl. It returns the removed
+	// registrations and the IPs that dropped off the allowlist because nobody
+	// else registered them.
+	RemoveExpired(now time.Time, ttl time.Duration) ([]Registration, []string, error)
+	// UsernamesForIP returns the unique usernames of everyone who registered
+	// ip. Registrations of the address itself win over CIDR ranges containing it.
+	UsernamesForIP(ip string) ([]string, error)
+
+	// AllRegistrations returns every registration.
+	AllRegistrations() ([]Registration, error)
+	// RevokeUser removes every registration of username. It returns the removed
+	// registrations and the IPs that dropped off the allowlist.
+	RevokeUser(username string) ([]Registration, []string, error)
+	// RevokeUserID removes every registration made by the Discord user userID,
+	// like RevokeUser.
+	RevokeUserID(userID string) ([]Registration, []string, error)
+	// ExtendRegistrations delays the expiry of every registration of username by
+	// d and returns them. The registration time stays as it is.
+	ExtendRegistrations(username string, d time.Duration) ([]Registration, error)
+
+	// RevokeIP removes every registration of an IP or range overlapping entry.
+	// It returns the removed registrations and the IPs that dropped off the allowlist.
+	RevokeIP(entry string) ([]Registration, []string, error)
+
+	// Bans returns every ban, including expired ones.
+	Bans() ([]Ban, error)
+	// AddBan adds a ban, replacing an earlier ban of the same user ID and IP.
+	AddBan(ban Ban) error
+	// RemoveBan lifts the bans of a Discord user ID or of an IP or range and
+	// returns them.
+	RemoveBan(target string) ([]Ban, error)
+
+	// Reminders returns the users who want a DM before their registrations
+	// expire, mapped to their Discord user IDs.
+	Reminders() (map[string]string, error)
+	// SetReminder turns renewal reminders on or off for username.
+	SetReminder(username, userID string, enabled bool) error
+	// MarkReminded records that username was reminded about the registration of
+	// device made at registered. It reports false if that was recorded already or
+	// username has reminders off, so a registration is reminded about only once.
+	MarkReminded(username, device string, registered time.Time) (bool, error)
+
+	// TrackedUsers returns a map of tracked users to their trackers.
+	TrackedUsers() (map[string][]string, error)
+	// AddTracking adds tracker to the trackers of trackedUser.
+	AddTracking(tracker, trackedUser string) error
+	// RemoveTracking removes tracker from the trackers of trackedUser.
+	RemoveTracking(tracker, trackedUser string) error
+
+	// Close waits for a write in progress and makes later writes fail, so the
+	// files are complete when the bot exits.
+	Close() error
+}
+
+// Registration is an IP address or range a user registered for one of their devices.
+type Registration struct {
+	IP         string
+	UserID     string // Discord user ID, empty for registrations made before it was recorded
+	Username   string
+	Device     string
+	Registered time.Time     // last registration or refresh
+	Extended   time.Duration // added to the lifetime by /admin extend, reset by a refresh
+}
+
+// expiry returns when the registration expires if registrations last ttl.
+func (r Registration) expiry(ttl time.Duration) time.Time {
+	return r.Registered.Add(ttl + r.Extended)
+}
+
+// Ban keeps a Discord user, an IP address or range, or both from registering.
+type Ban struct {
+	UserID   string // Discord user ID, empty for a ban of only an IP or a username
+	Username string // username of the banned user when the ban was issued, banned by itself without a user ID
+	IP       string // banned address or CIDR range, empty for a ban of only a user
+	Reason   string // shown to moderators
+	By       string // moderator who issued the ban
+	Created  time.Time
+	Until    time.Time // zero for a permanent ban
+}
+
+// active reports whether the ban is in effect at now.
+func (b Ban) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+// sameTarget reports whether other bans the same user ID and IP as b.
+func (b Ban) sameTarget(other Ban) bool {
+	return b.UserID == other.UserID && b.IP == other.IP && (b.UserID != "" || b.Username == other.Username)
+}
+
+// hasTarget reports whether b bans target, a user ID, IP, range or, for bans
+// without a user ID, a username.
+func (b Ban) hasTarget(target string) bool {
+	return b.UserID == target || b.IP == target || (b.UserID == "" && b.Username != "" && b.Username == target)
+}
+
+var (
+	defaultDevice     = "default"  // device name of registrations made without one
+	legacyUsername    = "(legacy)" // owner of allowlist IPs that had no usernames_ips.txt line, e.g. added by hand
+	maxDevicesPerUser = 3
+
+	errTooManyDevices = fmt.Errorf("you can register at most %d devices", maxDevicesPerUser)
+	errDeviceNotFound = errors.New("no such device")
+	errStoreClosed    = errors.New("the bot is shutting down")
+)
+
+// fileStore keeps the original text file formats:
+//
+//	allowlist.txt      "<ip or CIDR range> <unix timestamp>" (also read by VAMMultiplayerTCPServer.py)
+//	usernames_ips.txt  "<ip or CIDR range> <username> <device> <unix timestamp> [<extension in seconds> [<Discord user ID>]]"
+//	tracking.txt       "<tracked user> <tracker>,<tracker>..."
+//	reminders.txt      "<username> <Discord user ID> [<device>:<unix timestamp>,...]" of users who opted in
+//	                   to renewal reminders, with the registration time of each device last reminded about
+//	bans.txt           "<user ID> <ip or CIDR range> <until, 0 if permanent> <created> <moderator> <username> <reason>",
+//	                   with "-" for a missing user ID, IP or username
+//
+// usernames_ips.txt holds one line per registration and is the source of truth;
+// allowlist.txt is rewritten from it with the latest registration of each IP.
+// Older usernames_ips.txt lines have no device, meaning "default", and no
+// timestamp, which is then taken from the allowlist. Allowlist IPs without any
+// usernames_ips.txt line are imported as registrations of legacyUsername by the
+// first read, so the first rewrite doesn't drop them.
+//
+// Files are rewritten through a temporary file and a rename, so a crash mid-write
+// leaves either the old or the new version on disk, never a truncated one.
+type fileStore struct {
+	allowlistPath string
+	usernamesPath string
+	trackingPath  string
+	remindersPath string
+	bansPath      string
+	mu            sync.Mutex // serializes all reads and rewrites of the files
+	closed        bool       // set by Close, guarded by mu
+	imported      bool       // the allowlist-only IPs were imported, guarded by mu
+}
+
+func newFileStore(allowlistPath, usernamesPath, trackingPath, remindersPath, bansPath string) *fileStore {
+	return &fileStore{
+		allowlistPath: allowlistPath,
+		usernamesPath: usernamesPath,
+		trackingPath:  trackingPath,
+		remindersPath: remindersPath,
+		bansPath:      bansPath,
+	}
+}
+
+func (fs *fileStore) RegisterIP(ip, userID, username, device string, now time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return fmt.Errorf("error reading usernames file: %v", err)
+	}
+	updated, err := addRegistration(registrations, Registration{IP: ip, UserID: userID, Username: username, Device: device, Registered: now})
+	if err != nil {
+		return err
+	}
+	return fs.writeRegistrations(updated)
+}
+
+func (fs *fileStore) Registrations(username string) ([]Registration, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, err
+	}
+	return userRegistrations(registrations, username), nil
+}
+
+func (fs *fileStore) Unregister(username, device string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return "", fmt.Errorf("error reading usernames file: %v", err)
+	}
+	updated, removed := removeRegistration(registrations, username, device)
+	if removed == nil {
+		return "", errDeviceNotFound
+	}
+	return removed.IP, fs.writeRegistrations(updated)
+}
+
+func (fs *fileStore) RemoveExpired(now time.Time, ttl time.Duration) ([]Registration, []string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading usernames file: %v", err)
+	}
+	kept, removed, dropped := removeExpired(registrations, now, ttl)
+
+	// No need to rewrite anything if nothing expired
+	if len(removed) == 0 {
+		return nil, nil, nil
+	}
+	return removed, dropped, fs.writeRegistrations(kept)
+}
+
+func (fs *fileStore) UsernamesForIP(ip string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, err
+	}
+	return usernamesForIP(registrations, ip)
+}
+
+func (fs *fileStore) AllRegistrations() ([]Registration, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.readRegistrations()
+}
+
+func (fs *fileStore) RevokeUser(username string) ([]Registration, []string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading usernames file: %v", err)
+	}
+	kept, removed, dropped := revokeUser(registrations, username)
+	if len(removed) == 0 {
+		return nil, nil, nil
+	}
+	return removed, dropped, fs.writeRegistrations(kept)
+}
+
+func (fs *fileStore) RevokeUserID(userID string) ([]Registration, []string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading usernames file: %v", err)
+	}
+	kept, removed, dropped := revokeUserID(registrations, userID)
+	if len(removed) == 0 {
+		return nil, nil, nil
+	}
+	return removed, dropped, fs.writeRegistrations(kept)
+}
+
+func (fs *fileStore) ExtendRegistrations(username string, d time.Duration) ([]Registration, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, fmt.Errorf("error reading usernames file: %v", err)
+	}
+	extended := extendRegistrations(registrations, username, d)
+	if len(extended) == 0 {
+		return nil, nil
+	}
+	return extended, fs.writeRegistrations(registrations)
+}
+
+func (fs *fileStore) RevokeIP(entry string) ([]Registration, []string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	registrations, err := fs.readRegistrations()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading usernames file: %v", err)
+	}
+	kept, removed, dropped := revokeIP(registrations, entry)
+	if len(removed) == 0 {
+		return nil, nil, nil
+	}
+	return removed, dropped, fs.writeRegistrations(kept)
+}
+
+func (fs *fileStore) Bans() ([]Ban, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.readBans()
+}
+
+func (fs *fileStore) AddBan(ban Ban) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	bans, err := fs.readBans()
+	if err != nil {
+		return err
+	}
+	bans, _ = removeBans(bans, ban.sameTarget)
+	return fs.writeBans(append(bans, ban))
+}
+
+func (fs *fileStore) RemoveBan(target string) ([]Ban, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	bans, err := fs.readBans()
+	if err != nil {
+		return nil, err
+	}
+	bans, removed := removeBans(bans, func(ban Ban) bool { return ban.hasTarget(target) })
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, fs.writeBans(bans)
+}
+
+// readBans parses bans.txt, a missing file means nobody is banned.
+func (fs *fileStore) readBans() ([]Ban, error) {
+	lines, err := readLines(fs.bansPath)
+	if err != nil {
+		return nil, err
+	}
+	var bans []Ban
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 7)
+		if len(parts) < 6 {
+			continue
+		}
+		until, err1 := strconv.ParseInt(parts[2], 10, 64)
+		created, err2 := strconv.ParseInt(parts[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		ban := Ban{
+			UserID:   banField(parts[0]),
+			IP:       banField(parts[1]),
+			Created:  time.Unix(created, 0),
+			By:       parts[4],
+			Username: banField(parts[5]),
+		}
+		if until != 0 {
+			ban.Until = time.Unix(until, 0)
+		}
+		if len(parts) == 7 {
+			ban.Reason = parts[6]
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (fs *fileStore) writeBans(bans []Ban) error {
+	lines := make([]string, 0, len(bans))
+	for _, ban := range bans {
+		var until int64
+		if !ban.Until.IsZero() {
+			until = ban.Until.Unix()
+		}
+		// The reason is the last field, so it may contain spaces but no line breaks
+		reason := strings.Join(strings.Fields(ban.Reason), " ")
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf("%s %s %d %d %s %s %s",
+			orDash(ban.UserID), orDash(ban.IP), until, ban.Created.Unix(), ban.By, orDash(ban.Username), reason)))
+	}
+	return fs.write(fs.bansPath, lines)
+}
+
+// banField reads an optional bans.txt field, "-" meaning empty.
+func banField(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+func orDash(field string) string {
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// reminder is the reminders.txt line of a user.
+type reminder struct {
+	userID   string
+	reminded map[string]int64 // device -> registration time last reminded about
+}
+
+func (fs *fileStore) Reminders() (map[string]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	reminders, err := fs.readReminders()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(reminders))
+	for username, r := range reminders {
+		result[username] = r.userID
+	}
+	return result, nil
+}
+
+func (fs *fileStore) SetReminder(username, userID string, enabled bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	reminders, err := fs.readReminders()
+	if err != nil {
+		return err
+	}
+	if enabled {
+		r, ok := reminders[username]
+		if !ok {
+			r.reminded = make(map[string]int64)
+		}
+		r.userID = userID
+		reminders[username] = r
+	} else {
+		delete(reminders, username)
+	}
+	return fs.writeReminders(reminders)
+}
+
+func (fs *fileStore) MarkReminded(username, device string, registered time.Time) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	reminders, err := fs.readReminders()
+	if err != nil {
+		return false, err
+	}
+	r, ok := reminders[username]
+	if !ok || r.reminded[device] == registered.Unix() {
+		return false, nil
+	}
+	r.reminded[device] = registered.Unix()
+	return true, fs.writeReminders(reminders)
+}
+
+// readReminders parses reminders.txt, a missing file means nobody opted in.
+func (fs *fileStore) readReminders() (map[string]reminder, error) {
+	lines, err := readLines(fs.remindersPath)
+	if err != nil {
+		return nil, err
+	}
+	reminders := make(map[string]reminder)
+	for _, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) != 2 && len(parts) != 3 {
+			continue
+		}
+		r := reminder{userID: parts[1], reminded: make(map[string]int64)}
+		if len(parts) == 3 {
+			for _, entry := range strings.Split(parts[2], ",") {
+				device, timestamp, _ := strings.Cut(entry, ":")
+				if ts, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+					r.reminded[device] = ts
+				}
+			}
+		}
+		reminders[parts[0]] = r
+	}
+	return reminders, nil
+}
+
+func (fs *fileStore) writeReminders(reminders map[string]reminder) error {
+	var lines []string
+	for username, r := range reminders {
+		line := fmt.Sprintf("%s %s", username, r.userID)
+		var entries []string
+		for _, device := range sortedKeys(r.reminded) {
+			entries = append(entries, fmt.Sprintf("%s:%d", device, r.reminded[device]))
+		}
+		if len(entries) > 0 {
+			line += " " + strings.Join(entries, ",")
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return fs.write(fs.remindersPath, lines)
+}
+
+func (fs *fileStore) TrackedUsers() (map[string][]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.readTracking()
+}
+
+func (fs *fileStore) AddTracking(tracker, trackedUser string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	trackedMap, err := fs.readTracking()
+	if err != nil {
+		return err
+	}
+	trackedMap[trackedUser] = appendIfMissing(trackedMap[trackedUser], tracker)
+	return fs.writeTracking(trackedMap)
+}
+
+func (fs *fileStore) RemoveTracking(tracker, trackedUser string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	trackedMap, err := fs.readTracking()
+	if err != nil {
+		return err
+	}
+	if !removeTracker(trackedMap, tracker, trackedUser) {
+		return fmt.Errorf("you are not tracking %s", trackedUser)
+	}
+	return fs.writeTracking(trackedMap)
+}
+
+// readRegistrations parses usernames_ips.txt. Lines written before devices
+// existed have no device name and belong to the default device, lines written
+// before registrations had their own timestamp use the one in the allowlist.
+func (fs *fileStore) readRegistrations() ([]Registration, error) {
+	lines, err := readLines(fs.usernamesPath)
+	if err != nil {
+		return nil, err
+	}
+	var registrations []Registration
+	var allowlist map[string]time.Time
+	for _, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) < 2 || len(parts) > 6 {
+			continue
+		}
+		r := Registration{IP: parts[0], Username: parts[1], Device: defaultDevice}
+		if len(parts) >= 3 {
+			r.Device = parts[2]
+		}
+		if len(parts) >= 4 {
+			timestamp, err := strconv.ParseInt(parts[3], 10, 64)
+			if err != nil {
+				continue
+			}
+			r.Registered = time.Unix(timestamp, 0)
+			if len(parts) >= 5 {
+				extension, err := strconv.ParseInt(parts[4], 10, 64)
+				if err != nil {
+					continue
+				}
+				r.Extended = time.Duration(extension) * time.Second
+			}
+			if len(parts) == 6 {
+				r.UserID = parts[5]
+			}
+		} else {
+			if allowlist == nil {
+				if allowlist, err = fs.readAllowlist(); err != nil {
+					return nil, fmt.Errorf("error reading allowlist file: %v", err)
+				}
+			}
+			registered, ok := allowlist[r.IP]
+			if !ok {
+				// Not allowed anymore, the registration already expired
+				continue
+			}
+			r.Registered = registered
+		}
+		registrations = append(registrations, r)
+	}
+	if !fs.imported {
+		return fs.importAllowlist(registrations)
+	}
+	return registrations, nil
+}
+
+// importAllowlist adds the allowlist IPs nobody registered to registrations as
+// registrations of legacyUsername and saves them to usernames_ips.txt. They
+// keep their allowlist time, so they expire like before.
+func (fs *fileStore) importAllowlist(registrations []Registration) ([]Registration, error) {
+	allowlist, err := fs.readAllowlist()
+	if err != nil {
+		return nil, fmt.Errorf("error reading allowlist file: %v", err)
+	}
+	registered := make(map[string]bool)
+	for _, r := range registrations {
+		registered[r.IP] = true
+	}
+	imported := false
+	for _, ip := range sortedKeys(allowlist) {
+		if registered[ip] {
+			continue
+		}
+		log.Printf("%s is in the allowlist without a registration, keeping it as a registration of %s", ip, legacyUsername)
+		registrations = append(registrations, Registration{IP: ip, Username: legacyUsername, Device: defaultDevice, Registered: allowlist[ip]})
+		imported = true
+	}
+	if imported {
+		// Tried again by the next read if this fails
+		if err := fs.write(fs.usernamesPath, registrationLines(registrations)); err != nil {
+			log.Printf("Error saving the imported allowlist IPs: %v", err)
+			return registrations, nil
+		}
+	}
+	fs.imported = true
+	return registrations, nil
+}
+
+// readAllowlist parses allowlist.txt into IPs and their registration times.
+func (fs *fileStore) readAllowlist() (map[string]time.Time, error) {
+	lines, err := readLines(fs.allowlistPath)
+	if err != nil {
+		return nil, err
+	}
+	allowlist := make(map[string]time.Time)
+	for _, line := range lines {
+		parts := strings.Split(line, " ")
+		if len(parts) != 2 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		allowlist[parts[0]] = time.Unix(timestamp, 0)
+	}
+	return allowlist, nil
+}
+
+// writeRegistrations rewrites the allowlist derived from registrations, then
+// usernames_ips.txt. If usernames_ips.txt can't be written the previous
+// allowlist is put back, so the two files don't disagree.
+func (fs *fileStore) writeRegistrations(registrations []Registration) error {
+	previous, err := readLines(fs.allowlistPath)
+	if err != nil {
+		return fmt.Errorf("error reading allowlist file: %w", err)
+	}
+	var lines []string
+	for _, entry := range deriveAllowlist(registrations) {
+		lines = append(lines, fmt.Sprintf("%s %d", entry.ip, entry.registered.Unix()))
+	}
+	if err := fs.write(fs.allowlistPath, lines); err != nil {
+		return fmt.Errorf("error writing allowlist file: %w", err)
+	}
+
+	if err := fs.write(fs.usernamesPath, registrationLines(registrations)); err != nil {
+		if err := fs.write(fs.allowlistPath, previous); err != nil {
+			log.Printf("Error restoring the allowlist file: %v", err)
+		}
+		return fmt.Errorf("error writing usernames file: %w", err)
+	}
+	return nil
+}
+
+// registrationLines formats registrations as usernames_ips.txt lines.
+func registrationLines(registrations []Registration) []string {
+	lines := make([]string, 0, len(registrations))
+	for _, r := range registrations {
+		line := fmt.Sprintf("%s %s %s %d", r.IP, r.Username, r.Device, r.Registered.Unix())
+		if r.Extended > 0 || r.UserID != "" {
+			line += fmt.Sprintf(" %d", int64(r.Extended.Seconds()))
+		}
+		if r.UserID != "" {
+			line += " " + r.UserID
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// allowlistLine is a line of allowlist.txt.
+type allowlistLine struct {
+	ip         string
+	registered time.Time
+}
+
+// deriveAllowlist lists every registered IP once, with its latest registration
+// time, in the order the IPs were first registered.
+func deriveAllowlist(registrations []Registration) []allowlistLine {
+	var allowlist []allowlistLine
+	index := make(map[string]int)
+	for _, r := range registrations {
+		i, exists := index[r.IP]
+		if !exists {
+			index[r.IP] = len(allowlist)
+			allowlist = append(allowlist, allowlistLine{ip: r.IP, registered: r.Registered})
+			continue
+		}
+		if r.Registered.After(allowlist[i].registered) {
+			allowlist[i].registered = r.Registered
+		}
+	}
+	return allowlist
+}
+
+// addRegistration adds reg to registrations or updates the IP of the same device.
+// If the user already registered the IP for another device, that entry is
+// renamed instead of duplicated, so each user registers an IP only once.
+func addRegistration(registrations []Registration, reg Registration) ([]Registration, error) {
+	var updated []Registration
+	devices := 0
+	for _, r := range registrations {
+		if r.Username == reg.Username && (r.Device == reg.Device || r.IP == reg.IP) {
+			continue
+		}
+		if r.Username == reg.Username {
+			devices++
+		}
+		updated = append(updated, r)
+	}
+	if devices >= maxDevicesPerUser {
+		return nil, errTooManyDevices
+	}
+	return append(updated, reg), nil
+}
+
+// removeRegistration removes a device of username. It returns nil if there is no such device.
+func removeRegistration(registrations []Registration, username, device string) ([]Registration, *Registration) {
+	var updated []Registration
+	var removed *Registration
+	for i, r := range registrations {
+		if r.Username == username && r.Device == device {
+			removed = &registrations[i]
+			continue
+		}
+		updated = append(updated, r)
+	}
+	return updated, removed
+}
+
+// removeExpired drops registrations older than ttl. It returns the remaining and
+// removed registrations and the IPs nobody has registered anymore.
+func removeExpired(registrations []Registration, now time.Time, ttl time.Duration) ([]Registration, []Registration, []string) {
+	return revokeMatching(registrations, func(r Registration) bool {
+		return now.Unix()-r.Registered.Unix() > int64((ttl + r.Extended).Seconds())
+	})
+}
+
+// revokeUser drops every registration of username. It returns the remaining and
+// removed registrations and the IPs nobody has registered anymore.
+func revokeUser(registrations []Registration, username string) ([]Registration, []Registration, []string) {
+	return revokeMatching(registrations, func(r Registration) bool { return r.Username == username })
+}
+
+// revokeUserID drops every registration made by userID, like revokeUser.
+func revokeUserID(registrations []Registration, userID string) ([]Registration, []Registration, []string) {
+	return revokeMatching(registrations, func(r Registration) bool { return userID != "" && r.UserID == userID })
+}
+
+// revokeIP drops every registration of an IP or range overlapping entry, like revokeUser.
+func revokeIP(registrations []Registration, entry string) ([]Registration, []Registration, []string) {
+	return revokeMatching(registrations, func(r Registration) bool { return entriesOverlap(r.IP, entry) })
+}
+
+func revokeMatching(registrations []Registration, match func(Registration) bool) ([]Registration, []Registration, []string) {
+	var kept, removed []Registration
+	live := make(map[string]bool)
+	for _, r := range registrations {
+		if match(r) {
+			removed = append(removed, r)
+			continue
+		}
+		kept = append(kept, r)
+		live[r.IP] = true
+	}
+
+	var dropped []string
+	for _, r := range removed {
+		if !live[r.IP] {
+			dropped = appendIfMissing(dropped, r.IP)
+		}
+	}
+	return kept, removed, dropped
+}
+
+// extendRegistrations adds d to the lifetime of the registrations of username in
+// place and returns copies of the updated registrations.
+func extendRegistrations(registrations []Registration, username string, d time.Duration) []Registration {
+	var extended []Registration
+	for i := range registrations {
+		if registrations[i].Username == username {
+			registrations[i].Extended += d
+			extended = append(extended, registrations[i])
+		}
+	}
+	return extended
+}
+
+// removeBans drops the bans matching match and returns the remaining and removed bans.
+func removeBans(bans []Ban, match func(Ban) bool) ([]Ban, []Ban) {
+	var kept, removed []Ban
+	for _, ban := range bans {
+		if match(ban) {
+			removed = append(removed, ban)
+			continue
+		}
+		kept = append(kept, ban)
+	}
+	return kept, removed
+}
+
+// userRegistrations returns the registrations of username.
+func userRegistrations(registrations []Registration, username string) []Registration {
+	var result []Registration
+	for _, r := range registrations {
+		if r.Username == username {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// usernamesForIP finds everyone who registered ip. Exact addresses win over ranges.
+func usernamesForIP(registrations []Registration, ip string) ([]string, error) {
+	for _, exact := range []bool{true, false} {
+		var usernames []string
+		for _, r := range registrations {
+			if (exact && r.IP == ip) || (!exact && r.IP != ip && entryContains(r.IP, ip)) {
+				usernames = appendIfMissing(usernames, r.Username)
+			}
+		}
+		if len(usernames) > 0 {
+			return usernames, nil
+		}
+	}
+	return nil, fmt.Errorf("IP %s not found", ip)
+}
+
+// readTracking parses tracking.txt, a missing file means nobody is tracked.
+func (fs *fileStore) readTracking() (map[string][]string, error) {
+	trackedMap := make(map[string][]string)
+
+	lines, err := readLines(fs.trackingPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		trackers := strings.Split(parts[1], ",")
+		for i, tracker := range trackers {
+			trackers[i] = strings.TrimSpace(tracker)
+		}
+		trackedMap[parts[0]] = trackers
+	}
+	return trackedMap, nil
+}
+
+func (fs *fileStore) writeTracking(trackedMap map[string][]string) error {
+	var lines []string
+	for trackedUser, trackers := range trackedMap {
+		lines = append(lines, fmt.Sprintf("%s %s", trackedUser, strings.Join(trackers, ",")))
+	}
+	sort.Strings(lines)
+	return fs.write(fs.trackingPath, lines)
+}
+
+// removeTracker removes tracker from trackedUser's trackers, dropping the entry when
+// nobody tracks the user anymore. It reports whether tracker was tracking trackedUser.
+func removeTracker(trackedMap map[string][]string, tracker, trackedUser string) bool {
+	trackers, exists := trackedMap[trackedUser]
+	if !exists {
+		return false
+	}
+	updated := removeFromSlice(trackers, tracker)
+	if len(updated) == len(trackers) {
+		return false
+	}
+	if len(updated) == 0 {
+		delete(trackedMap, trackedUser)
+	} else {
+		trackedMap[trackedUser] = updated
+	}
+	return true
+}
+
+// readLines returns the lines of a text file. A missing file has no lines.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// Close waits for the write in progress, if any, and rejects later writes.
+func (fs *fileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closed = true
+	return nil
+}
+
+// write replaces one of the store's files unless the store was closed. The
+// caller holds fs.mu.
+func (fs *fileStore) write(path string, lines []string) error {
+	if fs.closed {
+		return errStoreClosed
+	}
+	return writeFileAtomic(path, lines)
+}
+
+// writeFileAtomic replaces path with the given lines. The content is written to a
+// temporary file in the same directory, synced and then renamed over path, so readers
+// (including the game servers reading the allowlist) never see a partial file.
+func writeFileAtomic(path string, lines []string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file if anything below fails
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		if _, err := writer.WriteString(line + "\n"); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeFactories lets the same behaviour tests run against every Store implementation.
+var storeFactories = map[string]func(t *testing.T) Store{
+	"file": func(t *testing.T) Store {
+		dir := t.TempDir()
+		return newFileStore(filepath.Join(dir, "allowlist.txt"), filepath.Join(dir, "usernames_ips.txt"), filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+	},
+	"memory": func(t *testing.T) Store {
+		return newMemStore()
+	},
+}
+
+// usernameOf returns the users who registered ip, comma separated.
+func usernameOf(s Store, ip string) (string, error) {
+	usernames, err := s.UsernamesForIP(ip)
+	return strings.Join(usernames, ","), err
+}
+
+func TestStoreRegisterIP(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RegisterIP("2.2.2.2", "", "bob", defaultDevice, now); err != nil {
+				t.Fatal(err)
+			}
+			// Re-registering moves alice to her new IP
+			if err := s.RegisterIP("3.3.3.3", "", "alice", defaultDevice, now); err != nil {
+				t.Fatal(err)
+			}
+
+			if user, err := usernameOf(s, "3.3.3.3"); err != nil || user != "alice" {
+				t.Errorf("UsernameForIP(3.3.3.3) = %q, %v; want alice", user, err)
+			}
+			if user, err := usernameOf(s, "2.2.2.2"); err != nil || user != "bob" {
+				t.Errorf("UsernameForIP(2.2.2.2) = %q, %v; want bob", user, err)
+			}
+			if _, err := usernameOf(s, "1.1.1.1"); err == nil {
+				t.Errorf("UsernameForIP(1.1.1.1) found a user after alice re-registered")
+			}
+		})
+	}
+}
+
+func TestStoreDevices(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			for _, device := range []struct{ ip, name string }{{"1.1.1.1", "desktop"}, {"2.2.2.2", "laptop"}, {"3.3.3.3", "phone"}} {
+				if err := s.RegisterIP(device.ip, "", "alice", device.name, now); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+				if user, err := usernameOf(s, ip); err != nil || user != "alice" {
+					t.Errorf("UsernameForIP(%s) = %q, %v; want alice", ip, user, err)
+				}
+			}
+			if err := s.RegisterIP("4.4.4.4", "", "alice", "tablet", now); err != errTooManyDevices {
+				t.Errorf("registering a fourth device: err = %v, want %v", err, errTooManyDevices)
+			}
+
+			// A known device moves to its new IP, the old one is dropped
+			if err := s.RegisterIP("5.5.5.5", "", "alice", "laptop", now.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := usernameOf(s, "2.2.2.2"); err == nil {
+				t.Errorf("old laptop IP still registered")
+			}
+			registrations, err := s.Registrations("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices := make(map[string]Registration)
+			for _, r := range registrations {
+				devices[r.Device] = r
+			}
+			if len(devices) != 3 || devices["laptop"].IP != "5.5.5.5" || !devices["laptop"].Registered.Equal(now.Add(time.Hour)) {
+				t.Errorf("Registrations = %+v", registrations)
+			}
+
+			ip, err := s.Unregister("alice", "desktop")
+			if err != nil || ip != "1.1.1.1" {
+				t.Errorf("Unregister = %q, %v; want 1.1.1.1", ip, err)
+			}
+			if _, err := usernameOf(s, "1.1.1.1"); err == nil {
+				t.Errorf("unregistered IP still registered")
+			}
+			if _, err := s.Unregister("alice", "desktop"); err != errDeviceNotFound {
+				t.Errorf("Unregister of a missing device: err = %v, want %v", err, errDeviceNotFound)
+			}
+
+			// Expired IPs are gone from the allowlist too, so RemoveExpired doesn't report them
+			_, removed, err := s.RemoveExpired(now.Add(30*24*time.Hour), 7*24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(removed)
+			if strings.Join(removed, ",") != "3.3.3.3,5.5.5.5" {
+				t.Errorf("RemoveExpired removed %v, want [3.3.3.3 5.5.5.5]", removed)
+			}
+		})
+	}
+}
+
+func TestStoreSharedIP(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, now.Add(-6*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RegisterIP("1.1.1.1", "", "bob", defaultDevice, now.Add(-8*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if users, err := usernameOf(s, "1.1.1.1"); err != nil || users != "alice,bob" {
+				t.Errorf("UsernamesForIP(1.1.1.1) = %q, %v; want alice,bob", users, err)
+			}
+
+			// Bob's registration expires, alice keeps the IP on the allowlist
+			_, removed, err := s.RemoveExpired(now, 7*24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(removed) != 0 {
+				t.Errorf("RemoveExpired removed %v from the allowlist, alice still uses it", removed)
+			}
+			if users, err := usernameOf(s, "1.1.1.1"); err != nil || users != "alice" {
+				t.Errorf("UsernamesForIP(1.1.1.1) = %q, %v; want alice", users, err)
+			}
+			if registrations, _ := s.Registrations("bob"); len(registrations) != 0 {
+				t.Errorf("bob still registered: %+v", registrations)
+			}
+
+			// Alice unregistering leaves the IP to nobody
+			if _, err := s.Unregister("alice", defaultDevice); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.UsernamesForIP("1.1.1.1"); err == nil {
+				t.Errorf("1.1.1.1 still registered after both owners left")
+			}
+		})
+	}
+}
+
+func TestFileStoreDerivesAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	s := newFileStore(allowlistPath, filepath.Join(dir, "usernames_ips.txt"), filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+	now := time.Unix(1700000000, 0)
+
+	s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, now)
+	s.RegisterIP("2.2.2.2", "", "alice", "laptop", now.Add(time.Minute))
+	s.RegisterIP("1.1.1.1", "", "bob", defaultDevice, now.Add(time.Hour))
+	s.Unregister("alice", "laptop")
+
+	// One line per IP with its latest registration
+	allowlist, _ := ioutil.ReadFile(allowlistPath)
+	if string(allowlist) != "1.1.1.1 1700003600\n" {
+		t.Errorf("allowlist.txt = %q", allowlist)
+	}
+}
+
+func TestStoreRangeRegistration(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			if err := s.RegisterIP("8.8.8.0/28", "", "alice", defaultDevice, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RegisterIP("8.8.8.3", "", "bob", defaultDevice, now); err != nil {
+				t.Fatal(err)
+			}
+
+			// An exact registration wins over a range covering the same address
+			if user, err := usernameOf(s, "8.8.8.3"); err != nil || user != "bob" {
+				t.Errorf("UsernameForIP(8.8.8.3) = %q, %v; want bob", user, err)
+			}
+			if user, err := usernameOf(s, "8.8.8.9"); err != nil || user != "alice" {
+				t.Errorf("UsernameForIP(8.8.8.9) = %q, %v; want alice", user, err)
+			}
+			if _, err := usernameOf(s, "8.8.8.16"); err == nil {
+				t.Errorf("UsernameForIP(8.8.8.16) found a user outside the range")
+			}
+		})
+	}
+}
+
+func TestStoreRemoveExpired(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, now.Add(-8*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RegisterIP("2.2.2.2", "", "bob", defaultDevice, now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			expired, removed, err := s.RemoveExpired(now, 7*24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expired) != 1 || expired[0].Username != "alice" {
+				t.Errorf("RemoveExpired removed registrations %+v, want alice's", expired)
+			}
+			if len(removed) != 1 || removed[0] != "1.1.1.1" {
+				t.Errorf("RemoveExpired removed %v, want [1.1.1.1]", removed)
+			}
+			if _, err := usernameOf(s, "1.1.1.1"); err == nil {
+				t.Errorf("expired IP still mapped to a username")
+			}
+			if user, err := usernameOf(s, "2.2.2.2"); err != nil || user != "bob" {
+				t.Errorf("UsernameForIP(2.2.2.2) = %q, %v; want bob", user, err)
+			}
+		})
+	}
+}
+
+func TestStoreTracking(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+
+			if err := s.AddTracking("carol", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddTracking("dave", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddTracking("carol", "alice"); err != nil {
+				t.Fatal(err)
+			}
+
+			trackedMap, err := s.TrackedUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			trackers := trackedMap["alice"]
+			sort.Strings(trackers)
+			if strings.Join(trackers, ",") != "carol,dave" {
+				t.Errorf("alice trackers = %v, want [carol dave]", trackers)
+			}
+
+			if err := s.RemoveTracking("carol", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RemoveTracking("carol", "alice"); err == nil {
+				t.Errorf("RemoveTracking succeeded for a user carol no longer tracks")
+			}
+			if err := s.RemoveTracking("dave", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			trackedMap, err = s.TrackedUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := trackedMap["alice"]; exists {
+				t.Errorf("alice still tracked after every tracker was removed")
+			}
+		})
+	}
+}
+
+func TestStoreReminders(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+
+			if err := s.SetReminder("alice", "1", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetReminder("bob", "2", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetReminder("bob", "2", false); err != nil {
+				t.Fatal(err)
+			}
+			reminders, err := s.Reminders()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reminders) != 1 || reminders["alice"] != "1" {
+				t.Errorf("Reminders = %v, want map[alice:1]", reminders)
+			}
+
+			// A registration is reminded about once, a renewal makes it due again
+			registered := time.Unix(1700000000, 0)
+			for _, tc := range []struct {
+				username   string
+				registered time.Time
+				want       bool
+			}{
+				{"alice", registered, true},
+				{"alice", registered, false},
+				{"alice", registered.Add(time.Hour), true},
+				{"bob", registered, false},
+			} {
+				if got, err := s.MarkReminded(tc.username, "laptop", tc.registered); err != nil || got != tc.want {
+					t.Errorf("MarkReminded(%s, %v) = %v, %v, want %v", tc.username, tc.registered, got, err, tc.want)
+				}
+			}
+			// Turning reminders off and on again forgets them
+			s.SetReminder("alice", "1", false)
+			s.SetReminder("alice", "1", true)
+			if got, _ := s.MarkReminded("alice", "laptop", registered); !got {
+				t.Error("MarkReminded after turning reminders back on = false, want true")
+			}
+		})
+	}
+}
+
+func TestFileStoreRemembersReminders(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func() *fileStore {
+		return newFileStore(filepath.Join(dir, "allowlist.txt"), filepath.Join(dir, "usernames_ips.txt"), filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+	}
+	registered := time.Unix(1700000000, 0)
+
+	s := newStore()
+	s.SetReminder("alice", "1", true)
+	s.MarkReminded("alice", "laptop", registered)
+	s.MarkReminded("alice", defaultDevice, registered)
+	// Turning reminders on again keeps them
+	s.SetReminder("alice", "1", true)
+
+	content, err := os.ReadFile(filepath.Join(dir, "reminders.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice 1 default:1700000000,laptop:1700000000\n"; string(content) != want {
+		t.Errorf("reminders.txt = %q, want %q", content, want)
+	}
+
+	// A restarted bot doesn't remind again
+	if got, err := newStore().MarkReminded("alice", "laptop", registered); err != nil || got {
+		t.Errorf("MarkReminded after a restart = %v, %v, want false", got, err)
+	}
+}
+
+func TestStoreRevokeAndExtend(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+			s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, now)
+			s.RegisterIP("2.2.2.2", "", "alice", "laptop", now)
+			s.RegisterIP("2.2.2.2", "2", "bob", defaultDevice, now)
+
+			extended, err := s.ExtendRegistrations("alice", 24*time.Hour)
+			if err != nil || len(extended) != 2 || !extended[0].Registered.Equal(now) || extended[0].Extended != 24*time.Hour {
+				t.Errorf("ExtendRegistrations = %+v, %v", extended, err)
+			}
+			// The extension is kept, expiry counts it
+			registrations, _ := s.Registrations("alice")
+			if len(registrations) != 2 || !registrations[0].expiry(time.Hour).Equal(now.Add(25*time.Hour)) {
+				t.Errorf("Registrations after extending = %+v", registrations)
+			}
+			all, _ := s.AllRegistrations()
+			if _, removed, _ := removeExpired(all, now.Add(2*time.Hour), time.Hour); len(removed) != 1 || removed[0].Username != "bob" {
+				t.Errorf("removeExpired removed %+v, want only bob's registration", removed)
+			}
+
+			removed, dropped, err := s.RevokeUser("alice")
+			if err != nil || len(removed) != 2 {
+				t.Fatalf("RevokeUser = %+v, %v", removed, err)
+			}
+			// bob still registered 2.2.2.2, so only 1.1.1.1 leaves the allowlist
+			if len(dropped) != 1 || dropped[0] != "1.1.1.1" {
+				t.Errorf("dropped from allowlist = %v, want [1.1.1.1]", dropped)
+			}
+			if user, _ := usernameOf(s, "2.2.2.2"); user != "bob" {
+				t.Errorf("UsernameForIP(2.2.2.2) = %q after revoking alice, want bob", user)
+			}
+
+			// bob's registration carries his user ID
+			removed, dropped, err = s.RevokeUserID("2")
+			if err != nil || len(removed) != 1 || removed[0].Username != "bob" || len(dropped) != 1 || dropped[0] != "2.2.2.2" {
+				t.Errorf("RevokeUserID = %+v, %v, %v", removed, dropped, err)
+			}
+		})
+	}
+}
+
+func TestStoreBans(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+
+			if err := s.AddBan(Ban{UserID: "2", Username: "alice", Reason: "spamming rooms", By: "mod", Created: now}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddBan(Ban{IP: "1.2.3.0/24", By: "mod", Created: now, Until: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			// Banning alice again replaces her ban
+			if err := s.AddBan(Ban{UserID: "2", Username: "alice", Reason: "spamming rooms again", By: "mod", Created: now}); err != nil {
+				t.Fatal(err)
+			}
+			bans, err := s.Bans()
+			if err != nil || len(bans) != 2 {
+				t.Fatalf("Bans = %+v, %v", bans, err)
+			}
+			if bans[0].IP != "1.2.3.0/24" || !bans[0].Until.Equal(now.Add(time.Hour)) || bans[0].active(now.Add(2*time.Hour)) {
+				t.Errorf("temporary IP ban = %+v", bans[0])
+			}
+			if bans[1].UserID != "2" || bans[1].Username != "alice" || bans[1].Reason != "spamming rooms again" || !bans[1].active(now.Add(1000*time.Hour)) {
+				t.Errorf("permanent user ban = %+v", bans[1])
+			}
+
+			if lifted, err := s.RemoveBan("2"); err != nil || len(lifted) != 1 {
+				t.Errorf("RemoveBan(2) = %+v, %v", lifted, err)
+			}
+			if lifted, _ := s.RemoveBan("2"); len(lifted) != 0 {
+				t.Errorf("RemoveBan(2) lifted a ban twice")
+			}
+			if lifted, _ := s.RemoveBan("1.2.3.0/24"); len(lifted) != 1 {
+				t.Errorf("RemoveBan(1.2.3.0/24) = %+v", lifted)
+			}
+		})
+	}
+}
+
+func TestStoreRevokeIP(t *testing.T) {
+	for name, newStore := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			now := time.Unix(1700000000, 0)
+			s.RegisterIP("1.2.3.4", "", "alice", defaultDevice, now)
+			s.RegisterIP("1.2.0.0/16", "", "bob", defaultDevice, now)
+			s.RegisterIP("8.8.8.8", "", "carol", defaultDevice, now)
+
+			removed, dropped, err := s.RevokeIP("1.2.3.0/24")
+			if err != nil || len(removed) != 2 {
+				t.Fatalf("RevokeIP = %+v, %v", removed, err)
+			}
+			if strings.Join(dropped, ",") != "1.2.3.4,1.2.0.0/16" {
+				t.Errorf("dropped from allowlist = %v", dropped)
+			}
+			if user, _ := usernameOf(s, "8.8.8.8"); user != "carol" {
+				t.Errorf("UsernameForIP(8.8.8.8) = %q, want carol", user)
+			}
+		})
+	}
+}
+
+func TestFileStoreBansFormat(t *testing.T) {
+	dir := t.TempDir()
+	bansPath := filepath.Join(dir, "bans.txt")
+	s := newFileStore(filepath.Join(dir, "allowlist.txt"), filepath.Join(dir, "usernames_ips.txt"), filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), bansPath)
+
+	s.AddBan(Ban{UserID: "2", Username: "alice", Reason: "spamming\nrooms", By: "mod", Created: time.Unix(1700000000, 0)})
+	s.AddBan(Ban{IP: "1.2.3.4", By: "mod", Created: time.Unix(1700000000, 0), Until: time.Unix(1700003600, 0)})
+
+	bans, _ := ioutil.ReadFile(bansPath)
+	if string(bans) != "2 - 0 1700000000 mod alice spamming rooms\n- 1.2.3.4 1700003600 1700000000 mod -\n" {
+		t.Errorf("bans.txt = %q", bans)
+	}
+}
+
+func TestFileStoreKeepsFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	usernamesPath := filepath.Join(dir, "usernames_ips.txt")
+	s := newFileStore(allowlistPath, usernamesPath, filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+
+	if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist, _ := ioutil.ReadFile(allowlistPath)
+	if string(allowlist) != "1.1.1.1 1700000000\n" {
+		t.Errorf("allowlist.txt = %q", allowlist)
+	}
+	usernames, _ := ioutil.ReadFile(usernamesPath)
+	if string(usernames) != "1.1.1.1 alice default 1700000000\n" {
+		t.Errorf("usernames_ips.txt = %q", usernames)
+	}
+
+	// The user ID comes after the extension, which is then always written
+	if err := s.RegisterIP("2.2.2.2", "2", "bob", defaultDevice, time.Unix(1700000100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	usernames, _ = ioutil.ReadFile(usernamesPath)
+	if string(usernames) != "1.1.1.1 alice default 1700000000\n2.2.2.2 bob default 1700000100 0 2\n" {
+		t.Errorf("usernames_ips.txt = %q", usernames)
+	}
+
+	// No temporary files are left behind
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expected only allowlist and usernames files, found %d entries", len(entries))
+	}
+}
+
+func TestFileStoreReadsLinesWithoutDevice(t *testing.T) {
+	dir := t.TempDir()
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	usernamesPath := filepath.Join(dir, "usernames_ips.txt")
+	ioutil.WriteFile(allowlistPath, []byte("1.1.1.1 1700000000\n"), 0644)
+	ioutil.WriteFile(usernamesPath, []byte("1.1.1.1 alice\n"), 0644)
+	s := newFileStore(allowlistPath, usernamesPath, filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+
+	registrations, err := s.Registrations("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Registration{IP: "1.1.1.1", Username: "alice", Device: defaultDevice, Registered: time.Unix(1700000000, 0)}
+	if len(registrations) != 1 || registrations[0] != want {
+		t.Errorf("Registrations = %+v, want [%+v]", registrations, want)
+	}
+
+	// Registering without a device refreshes the old entry instead of adding one
+	if err := s.RegisterIP("2.2.2.2", "", "alice", defaultDevice, time.Unix(1700000100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	usernames, _ := ioutil.ReadFile(usernamesPath)
+	if string(usernames) != "2.2.2.2 alice default 1700000100\n" {
+		t.Errorf("usernames_ips.txt = %q", usernames)
+	}
+}
+
+func TestFileStoreImportsAllowlistOnlyIPs(t *testing.T) {
+	dir := t.TempDir()
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	usernamesPath := filepath.Join(dir, "usernames_ips.txt")
+	ioutil.WriteFile(allowlistPath, []byte("1.1.1.1 1700000000\n3.3.3.3 1700000050\n"), 0644)
+	ioutil.WriteFile(usernamesPath, []byte("1.1.1.1 alice default 1700000000\n"), 0644)
+	s := newFileStore(allowlistPath, usernamesPath, filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+
+	// 3.3.3.3 was added by hand and stays on the allowlist after the next rewrite
+	if err := s.RegisterIP("2.2.2.2", "", "bob", defaultDevice, time.Unix(1700000100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	allowlist, _ := ioutil.ReadFile(allowlistPath)
+	if string(allowlist) != "1.1.1.1 1700000000\n3.3.3.3 1700000050\n2.2.2.2 1700000100\n" {
+		t.Errorf("allowlist.txt = %q", allowlist)
+	}
+	usernames, _ := ioutil.ReadFile(usernamesPath)
+	if string(usernames) != "1.1.1.1 alice default 1700000000\n3.3.3.3 (legacy) default 1700000050\n2.2.2.2 bob default 1700000100\n" {
+		t.Errorf("usernames_ips.txt = %q", usernames)
+	}
+
+	// It expires with its allowlist time
+	_, dropped, _ := s.RemoveExpired(time.Unix(1700000060, 0).Add(time.Hour), time.Hour)
+	if !reflect.DeepEqual(dropped, []string{"1.1.1.1", "3.3.3.3"}) {
+		t.Errorf("dropped = %v", dropped)
+	}
+}
+
+func TestFileStoreRestoresAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	usernamesPath := filepath.Join(dir, "usernames_ips.txt")
+	s := newFileStore(allowlistPath, usernamesPath, filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+	if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// usernames_ips.txt can't be replaced by a file anymore
+	os.Remove(usernamesPath)
+	os.MkdirAll(filepath.Join(usernamesPath, "blocked"), 0755)
+	err := s.writeRegistrations([]Registration{{IP: "2.2.2.2", Username: "bob", Device: defaultDevice, Registered: time.Unix(1700000100, 0)}})
+	if err == nil {
+		t.Fatal("writeRegistrations succeeded")
+	}
+	allowlist, _ := ioutil.ReadFile(allowlistPath)
+	if string(allowlist) != "1.1.1.1 1700000000\n" {
+		t.Errorf("allowlist.txt = %q, want the previous one", allowlist)
+	}
+}
+
+func TestFileStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileStore(filepath.Join(dir, "allowlist.txt"), filepath.Join(dir, "usernames_ips.txt"), filepath.Join(dir, "tracking.txt"), filepath.Join(dir, "reminders.txt"), filepath.Join(dir, "bans.txt"))
+	if err := s.RegisterIP("1.1.1.1", "", "alice", defaultDevice, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RegisterIP("2.2.2.2", "", "bob", defaultDevice, time.Now()); !errors.Is(err, errStoreClosed) {
+		t.Errorf("RegisterIP after Close = %v, want errStoreClosed", err)
+	}
+	if err := s.AddTracking("alice", "bob"); !errors.Is(err, errStoreClosed) {
+		t.Errorf("AddTracking after Close = %v, want errStoreClosed", err)
+	}
+	// Reading still works
+	if registrations, err := s.AllRegistrations(); err != nil || len(registrations) != 1 {
+		t.Errorf("AllRegistrations after Close = %v, %v", registrations, err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownTimeout = 20 * time.Second // how long shutdown waits for tasks, handlers and DMs
+	dmQueueSize     = 100              // tracker DMs waiting to be sent, more are dropped
+
+	eventHandlers = &handlerTracker{} // Discord event handlers in progress
+	trackerDMs    = newDMQueue(dmQueueSize)
+)
+
+// supervisor runs the bot's background tasks under one context, like errgroup:
+// the first task that fails cancels the context of all the others, and Wait
+// waits for all of them to return.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+func newSupervisor(parent context.Context) (*supervisor, context.Context) {
+	ctx, cancel := context.WithCancelCause(parent)
+	return &supervisor{ctx: ctx, cancel: cancel}, ctx
+}
+
+// Go runs task in a goroutine. A task returns nil when its context is done or
+// when it has nothing to do. A panic is turned into an error, so the bot shuts
+// down cleanly instead of dying in the middle of a file rewrite.
+func (g *supervisor) Go(name string, task func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+				}
+			}()
+			return task(g.ctx)
+		}()
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			log.Println("Task failed, shutting down:", err)
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	}()
+}
+
+// Wait waits for all tasks and returns the first error.
+func (g *supervisor) Wait() error {
+	g.wg.Wait()
+	g.cancel(context.Canceled)
+	return g.err
+}
+
+// handlerTracker counts the event handlers in progress. Once closed it turns
+// new events away, so shutdown can wait for the handlers that already started.
+type handlerTracker struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// run calls handler unless the tracker was closed.
+func (t *handlerTracker) run(handler func()) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.wg.Add(1)
+	t.mu.Unlock()
+
+	defer t.wg.Done()
+	handler()
+}
+
+// closeAndWait turns new handlers away and waits for the running ones.
+func (t *handlerTracker) closeAndWait() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// trackerDM tells a tracker that a user they track joined a room.
+type trackerDM struct {
+	s           discordAPI
+	tracker     string
+	trackedUser string
+}
+
+// dmQueue sends tracker DMs one at a time, so a burst of joins doesn't start a
+// goroutine per DM and shutdown can wait until the queued DMs are sent.
+type dmQueue struct {
+	mu      sync.Mutex
+	closed  bool
+	pending chan trackerDM
+	stopped chan struct{}
+}
+
+func newDMQueue(size int) *dmQueue {
+	return &dmQueue{
+		pending: make(chan trackerDM, size),
+		stopped: make(chan struct{}),
+	}
+}
+
+// add queues a DM. It is dropped if the queue is full or closed.
+func (q *dmQueue) add(dm trackerDM) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		log.Printf("Shutting down, not sending DM to %s about %s", dm.tracker, dm.trackedUser)
+		return
+	}
+	select {
+	case q.pending <- dm:
+	default:
+		log.Printf("Too many DMs queued, not sending DM to %s about %s", dm.tracker, dm.trackedUser)
+	}
+}
+
+// run sends the queued DMs until the queue is closed and empty.
+func (q *dmQueue) run() {
+	defer close(q.stopped)
+	for dm := range q.pending {
+		sendDM(dm.s, dm.tracker, dm.trackedUser)
+	}
+}
+
+// closeAndWait stops accepting DMs and waits until the queued ones are sent.
+func (q *dmQueue) closeAndWait() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	<-q.stopped
+}
+
+// shutdown waits for the background tasks, the event handlers, the queued DMs
+// and audit events, then closes the store. It gives up after shutdownTimeout.
+func shutdown(group *supervisor) error {
+	handlers, dms, audits := eventHandlers, trackerDMs, auditMirror
+	finished := make(chan error, 1)
+	go func() {
+		err := group.Wait()
+		handlers.closeAndWait()
+		dms.closeAndWait()
+		audits.closeAndWait()
+		finished <- err
+	}()
+
+	var err error
+	select {
+	case err = <-finished:
+	case <-time.After(shutdownTimeout):
+		err = fmt.Errorf("gave up waiting for tasks after %s", shutdownTimeout)
+	}
+	// Closing the store waits for a write in progress even after the timeout,
+	// so usernames_ips.txt and the allowlist are not left out of step
+	if closeErr := store.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
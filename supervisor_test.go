@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupervisorCancelsOnError(t *testing.T) {
+	group, ctx := newSupervisor(context.Background())
+	stopped := make(chan struct{})
+	group.Go("ticker", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+	group.Go("broken", func(ctx context.Context) error {
+		return errors.New("disk full")
+	})
+
+	err := group.Wait()
+	if err == nil || err.Error() != "broken: disk full" {
+		t.Errorf("Wait = %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("the other task was not stopped")
+	}
+	if cause := context.Cause(ctx); cause != err {
+		t.Errorf("context cause = %v, want %v", cause, err)
+	}
+}
+
+func TestSupervisorRecoversPanics(t *testing.T) {
+	group, _ := newSupervisor(context.Background())
+	group.Go("cleanup", func(ctx context.Context) error {
+		var m map[string]int
+		m["x"] = 1
+		return nil
+	})
+	if err := group.Wait(); err == nil || !strings.HasPrefix(err.Error(), "cleanup: panic: assignment to entry in nil map") {
+		t.Errorf("Wait = %v", err)
+	}
+}
+
+func TestShutdownDrainsDMs(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "")
+	b.fake.addMember("2", "bob", "")
+	replace(t, &eventHandlers, &handlerTracker{})
+
+	parent, cancel := context.WithCancel(context.Background())
+	group, ctx := newSupervisor(parent)
+	group.Go("ticker", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	// A handler that is still running when the shutdown starts
+	started, release := make(chan struct{}), make(chan struct{})
+	handlerDone := make(chan struct{})
+	go eventHandlers.run(func() {
+		close(started)
+		<-release
+		store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+		close(handlerDone)
+	})
+	<-started
+
+	trackerDMs.add(trackerDM{s: b.fake, tracker: "alice", trackedUser: "bob"})
+	trackerDMs.add(trackerDM{s: b.fake, tracker: "bob", trackedUser: "alice"})
+	cancel()
+	<-ctx.Done()
+
+	finished := make(chan error)
+	go func() { finished <- shutdown(group) }()
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatalf("shutdown = %v", err)
+	}
+
+	select {
+	case <-handlerDone:
+	default:
+		t.Error("shutdown returned before the handler finished")
+	}
+	if got := append(b.fake.sentTo("dm-1"), b.fake.sentTo("dm-2")...); len(got) != 2 {
+		t.Errorf("DMs sent = %q", got)
+	}
+	// New events and DMs are turned away
+	ran := false
+	eventHandlers.run(func() { ran = true })
+	if ran {
+		t.Error("handler ran after shutdown")
+	}
+	trackerDMs.add(trackerDM{s: b.fake, tracker: "alice", trackedUser: "bob"})
+	if got := b.fake.sentTo("dm-1"); len(got) != 1 {
+		t.Errorf("DMs to alice = %q", got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	newTestBot(t)
+	replace(t, &shutdownTimeout, 10*time.Millisecond)
+	replace(t, &eventHandlers, &handlerTracker{})
+
+	group, _ := newSupervisor(context.Background())
+	stuck := make(chan struct{})
+	defer close(stuck)
+	group.Go("stuck", func(ctx context.Context) error {
+		<-stuck
+		return nil
+	})
+	if err := shutdown(group); err == nil || !strings.Contains(err.Error(), "gave up waiting") {
+		t.Errorf("shutdown = %v", err)
+	}
+}
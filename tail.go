@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// tailReader follows an append-only file such as current_players_portNNNN.txt.
+// The first load reads backward from EOF just far enough to find the last line,
+// after that it remembers its byte offset, so each Poll only reads the newly
+// appended bytes no matter how large the file has grown. Truncation and
+// rotation (the path now pointing to another file) make it start over from the
+// beginning of the new content.
+type tailReader struct {
+	path      string
+	fromStart bool        // read the whole file on the first Poll instead of only the last line
+	info      os.FileInfo // file identity at the last Poll, nil before the first one
+	started   bool        // a Poll has been made, later files are read from the start
+	offset    int64       // bytes consumed so far
+	partial   []byte      // trailing bytes of a line that is still being written
+	buf       []byte      // read buffer kept between Polls, grown up to tailReadSize as needed
+	lastLine  string
+	hasLine   bool
+}
+
+const (
+	tailChunkSize = 4096    // how much the initial load reads at a time while searching backward
+	tailReadSize  = 1 << 20 // how much Poll reads at a time going forward
+)
+
+func newTailReader(path string) *tailReader {
+	return &tailReader{path: path}
+}
+
+// newTailReaderFromStart returns a tailReader whose first Poll returns every line of
+// the file, for consumers that need the whole history.
+func newTailReaderFromStart(path string) *tailReader {
+	return &tailReader{path: path, fromStart: true}
+}
+
+// Poll reads what was appended since the last call and returns the new complete lines.
+// The first Poll of an existing file only loads its last line and returns no lines,
+// unless the reader was created with newTailReaderFromStart.
+// A missing file returns an error satisfying os.IsNotExist.
+func (t *tailReader) Poll() ([]string, error) {
+	var lines []string
+	err := t.PollFunc(func(line string) {
+		lines = append(lines, line)
+	})
+	return lines, err
+}
+
+// PollFunc is like Poll but hands each new line to fn instead of collecting them,
+// so a large amount of new content is never held in memory at once.
+func (t *tailReader) PollFunc(fn func(line string)) error {
+	first := !t.started
+	t.started = true
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.reset()
+		}
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if t.info != nil && !os.SameFile(t.info, info) {
+		// File was rotated, the new one is all new content
+		t.reset()
+	}
+	t.info = info
+
+	if first && !t.fromStart {
+		return t.loadFromEnd(file, info.Size())
+	}
+
+	if info.Size() < t.offset {
+		// File was truncated, start over
+		t.reset()
+		t.info = info
+	}
+	if info.Size() == t.offset {
+		return nil
+	}
+
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Read in chunks, up to the size seen above
+	remaining := info.Size() - t.offset
+	if size := min(remaining, tailReadSize); int64(len(t.buf)) < size {
+		t.buf = make([]byte, size)
+	}
+	buf := t.buf
+	for remaining > 0 {
+		n := int64(len(buf))
+		if n > remaining {
+			n = remaining
+		}
+		read, err := io.ReadFull(file, buf[:n])
+		t.offset += int64(read)
+		remaining -= int64(read)
+		for _, line := range t.consume(buf[:read]) {
+			fn(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFromEnd reads chunks backward from EOF until it has the last complete line.
+func (t *tailReader) loadFromEnd(file *os.File, size int64) error {
+	var buf []byte
+	pos := size
+	for pos > 0 {
+		n := int64(tailChunkSize)
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		chunk := make([]byte, n, int64(len(buf))+n)
+		if _, err := file.ReadAt(chunk, pos); err != nil {
+			return err
+		}
+		buf = append(chunk, buf...)
+
+		end := bytes.LastIndexByte(buf, '\n')
+		if end < 0 {
+			continue // no complete line yet
+		}
+		start := bytes.LastIndexByte(buf[:end], '\n')
+		if start < 0 && pos > 0 {
+			continue // the line may start in an earlier chunk
+		}
+		t.lastLine = string(bytes.TrimRight(buf[start+1:end], "\r"))
+		t.hasLine = true
+		t.partial = append([]byte(nil), buf[end+1:]...)
+		t.offset = size
+		return nil
+	}
+
+	// No complete line in the whole file
+	t.partial = buf
+	t.offset = size
+	return nil
+}
+
+// consume splits data into complete lines, keeping an unfinished line for later.
+func (t *tailReader) consume(data []byte) []string {
+	data = append(t.partial, data...)
+	t.partial = nil
+
+	var lines []string
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, string(bytes.TrimRight(data[:i], "\r")))
+		data = data[i+1:]
+	}
+	if len(data) > 0 {
+		t.partial = append([]byte(nil), data...)
+	}
+
+	if len(lines) > 0 {
+		t.lastLine = lines[len(lines)-1]
+		t.hasLine = true
+	}
+	return lines
+}
+
+// LastLine returns the last complete line seen by Poll.
+func (t *tailReader) LastLine() (string, bool) {
+	return t.lastLine, t.hasLine
+}
+
+func (t *tailReader) reset() {
+	t.info = nil
+	t.offset = 0
+	t.partial = nil
+	t.lastLine = ""
+	t.hasLine = false
+}
+
+var (
+	tailReadersMutex sync.Mutex
+	tailReaders      = make(map[string]*tailReader) // status file path -> reader
+)
+
+// lastStatusLine returns the last line of a room status file, reading only what
+// was appended since the previous call. ok is false if the file is missing or empty.
+func lastStatusLine(path string) (line string, ok bool, err error) {
+	tailReadersMutex.Lock()
+	defer tailReadersMutex.Unlock()
+
+	reader, exists := tailReaders[path]
+	if !exists {
+		reader = newTailReader(path)
+		tailReaders[path] = reader
+	}
+	if _, err := reader.Poll(); err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	line, ok = reader.LastLine()
+	return line, ok, nil
+}
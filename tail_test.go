@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func appendToFile(t testing.TB, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailReaderFollowsAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current_players_port8888.txt")
+	reader := newTailReader(path)
+
+	if _, err := reader.Poll(); !os.IsNotExist(err) {
+		t.Fatalf("Poll on a missing file = %v, want not exist", err)
+	}
+
+	appendToFile(t, path, "1;a\n2;b\n3;c")
+	lines, err := reader.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"1;a", "2;b"}) {
+		t.Errorf("lines = %q, want the two complete lines", lines)
+	}
+	if last, _ := reader.LastLine(); last != "2;b" {
+		t.Errorf("LastLine = %q, want 2;b while 3;c is incomplete", last)
+	}
+
+	// The rest of the line arrives
+	appendToFile(t, path, "\n")
+	lines, _ = reader.Poll()
+	if !reflect.DeepEqual(lines, []string{"3;c"}) {
+		t.Errorf("lines = %q, want [3;c]", lines)
+	}
+
+	// Nothing new
+	lines, _ = reader.Poll()
+	if len(lines) != 0 {
+		t.Errorf("lines = %q, want none", lines)
+	}
+}
+
+func TestTailReaderTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current_players_port8888.txt")
+	appendToFile(t, path, "1;a\n2;b\n")
+	reader := newTailReader(path)
+	reader.Poll()
+
+	if err := os.WriteFile(path, []byte("3;c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := reader.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"3;c"}) {
+		t.Errorf("lines after truncation = %q, want [3;c]", lines)
+	}
+}
+
+func TestTailReaderInitialLoadReadsBackward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current_players_port8888.txt")
+	// A last line longer than a chunk, followed by a line still being written
+	long := strings.Repeat("x", 3*tailChunkSize)
+	appendToFile(t, path, "1;old\n2;"+long+"\n3;partial")
+
+	reader := newTailReader(path)
+	lines, err := reader.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("initial load returned %d lines, want none", len(lines))
+	}
+	if last, ok := reader.LastLine(); !ok || last != "2;"+long {
+		t.Errorf("LastLine after initial load is wrong (ok=%v, %d bytes)", ok, len(last))
+	}
+
+	appendToFile(t, path, "\n4;new\n")
+	lines, _ = reader.Poll()
+	if !reflect.DeepEqual(lines, []string{"3;partial", "4;new"}) {
+		t.Errorf("lines = %q, want the completed and the new line", lines)
+	}
+}
+
+func TestTailReaderRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "current_players_port8888.txt")
+	appendToFile(t, path, "1;a\n2;b\n3;c\n")
+	reader := newTailReader(path)
+	reader.Poll()
+
+	// Replace the file with a new one that is larger than the old offset
+	rotated := filepath.Join(dir, "new.txt")
+	appendToFile(t, rotated, "4;d\n5;e\n6;f\n7;g\n")
+	if err := os.Rename(rotated, path); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := reader.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"4;d", "5;e", "6;f", "7;g"}) {
+		t.Errorf("lines after rotation = %q, want all lines of the new file", lines)
+	}
+}
+
+func TestTailReaderReusesBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current_players_port8888.txt")
+	appendToFile(t, path, "1;a\n")
+	reader := newTailReader(path)
+	reader.Poll()
+
+	appendToFile(t, path, "2;bbbbbbbb\n")
+	reader.Poll()
+	buf := reader.buf
+	appendToFile(t, path, "3;c\n")
+	if lines, _ := reader.Poll(); !reflect.DeepEqual(lines, []string{"3;c"}) {
+		t.Errorf("lines = %q, want [3;c]", lines)
+	}
+	if &reader.buf[0] != &buf[0] {
+		t.Error("Poll allocated a new read buffer for a smaller append")
+	}
+}
+
+// BenchmarkTailReader shows that loading and polling cost the same whatever the
+// size of the file. The files are sparse, so only the tail is actually on disk.
+func BenchmarkTailReader(b *testing.B) {
+	for _, size := range []int64{1 << 20, 256 << 20, 768 << 20} {
+		path := filepath.Join(b.TempDir(), "current_players_port8888.txt")
+		f, err := os.Create(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := f.Truncate(size); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+		line := "1700000000;1.1.1.1:5000:Player1:Hotel,2.2.2.2:5001:@SPECTATOR@:Hotel\n"
+		appendToFile(b, path, "\n"+line)
+
+		b.Run(fmt.Sprintf("initial_load_%dMB", size>>20), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				reader := newTailReader(path)
+				if _, err := reader.Poll(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("poll_append_%dMB", size>>20), func(b *testing.B) {
+			reader := newTailReader(path)
+			reader.Poll()
+			for i := 0; i < b.N; i++ {
+				appendToFile(b, path, line)
+				if lines, err := reader.Poll(); err != nil || len(lines) != 1 {
+					b.Fatalf("Poll = %d lines, %v", len(lines), err)
+				}
+			}
+		})
+	}
+}
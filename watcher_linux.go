@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// fileWatcher reports changes to a set of files using inotify. It watches the
+// directories containing the files, so files that are created, replaced or
+// renamed into place are noticed too.
+type fileWatcher struct {
+	fd   int
+	file *os.File // wraps fd; calling file.Fd() would switch it back to blocking mode
+	// Changes receives a value after any watched file changed. Bursts of changes
+	// are coalesced. It is closed when watching fails or the watcher is closed.
+	Changes chan struct{}
+
+	mu    sync.Mutex
+	dirs  map[int32]string // watch descriptor -> directory
+	files map[string]bool  // cleaned paths of the watched files
+	wds   map[string]int32 // directory -> watch descriptor
+}
+
+const watchMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+func newFileWatcher() (*fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &fileWatcher{
+		fd: fd,
+		// A non-blocking descriptor goes through the runtime poller, so Close unblocks reads
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		Changes: make(chan struct{}, 1),
+		dirs:    make(map[int32]string),
+		files:   make(map[string]bool),
+		wds:     make(map[string]int32),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Watch adds path to the watched files. Watching the same path again is a no-op.
+func (w *fileWatcher) Watch(path string) error {
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, watched := w.wds[dir]; !watched {
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.wds[dir] = int32(wd)
+		w.dirs[int32(wd)] = dir
+	}
+	w.files[path] = true
+	return nil
+}
+
+// Close stops watching and closes Changes.
+func (w *fileWatcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *fileWatcher) readEvents() {
+	defer close(w.Changes)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were dropped, assume everything changed
+				changed = true
+				continue
+			}
+
+			w.mu.Lock()
+			dir, ok := w.dirs[event.Wd]
+			if ok && w.files[filepath.Join(dir, name)] {
+				changed = true
+			}
+			w.mu.Unlock()
+		}
+
+		if changed {
+			select {
+			case w.Changes <- struct{}{}:
+			default:
+				// A change is already pending
+			}
+		}
+	}
+}
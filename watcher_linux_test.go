@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcherReportsAppends(t *testing.T) {
+	dir := t.TempDir()
+	watched := filepath.Join(dir, "current_players_port8888.txt")
+	other := filepath.Join(dir, "unrelated.txt")
+
+	watcher, err := newFileWatcher()
+	if err != nil {
+		t.Skip("inotify not available:", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Watch(watched); err != nil {
+		t.Fatal(err)
+	}
+
+	appendToFile(t, other, "ignored\n")
+	select {
+	case <-watcher.Changes:
+		t.Fatal("change reported for a file that is not watched")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	appendToFile(t, watched, "1;\n")
+	select {
+	case <-watcher.Changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported after appending to the watched file")
+	}
+
+	watcher.Close()
+	select {
+	case _, ok := <-watcher.Changes:
+		if ok {
+			// drain a pending change, the channel closes next
+			<-watcher.Changes
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Changes not closed after Close")
+	}
+}
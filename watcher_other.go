@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// fileWatcher is only implemented with inotify, other platforms poll.
+type fileWatcher struct {
+	Changes chan struct{}
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
+
+func (w *fileWatcher) Watch(path string) error {
+	return errors.New("file watching is not supported on this platform")
+}
+
+func (w *fileWatcher) Close() error {
+	return nil
+}
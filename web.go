@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	httpListenAddress = "127.0.0.1:8090"   // keep it local, expose it through a reverse proxy
+	httpMux           = http.NewServeMux() // handlers of the local HTTP server
+
+	displayNameTTL   = 10 * time.Minute // how long nicknames shown on the dashboard are cached
+	displayNameMutex sync.Mutex
+	displayNameCache = make(map[string]cachedName) // unique username -> nickname
+)
+
+type cachedName struct {
+	name    string
+	fetched time.Time
+}
+
+// roomJSON is the JSON representation of a room served by /api/rooms.
+// It never contains player IPs.
+type roomJSON struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Port        int          `json:"port"`
+	PlayerLimit int          `json:"player_limit"`
+	Running     bool         `json:"running"`
+	Down        string       `json:"down,omitempty"` // why the watchdog considers the room down
+	Updated     *time.Time   `json:"updated,omitempty"`
+	Players     []playerJSON `json:"players"`
+}
+
+type playerJSON struct {
+	Name      string `json:"name"`
+	Character string `json:"character,omitempty"`
+	Spectator bool   `json:"spectator"`
+	Scene     string `json:"scene,omitempty"`
+}
+
+func init() {
+	httpMux.HandleFunc("/api/rooms", handleRoomsAPI)
+	httpMux.HandleFunc("/", handleDashboard)
+}
+
+// startHTTPServer serves httpMux on the address from the config
+// until ctx is done, then waits for the requests in progress.
+func startHTTPServer(ctx context.Context) error {
+	return serveHTTP(ctx, httpListenAddress, httpMux)
+}
+
+// serveHTTP serves handler on address until ctx is done, then waits for the
+// requests in progress. Failing to listen is an error, so the supervisor stops
+// the bot instead of running it without registration links or health checks.
+func serveHTTP(ctx context.Context, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("HTTP server listening on %s", address)
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("Error stopping HTTP server:", err)
+		}
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	// Shutdown returns once the requests in progress are answered
+	<-stopped
+	return nil
+}
+
+// roomsToJSON converts room snapshots for the API, showing nicknames instead of IPs.
+func roomsToJSON(snaps []RoomSnapshot) []roomJSON {
+	result := []roomJSON{}
+	for _, snap := range snaps {
+		room := roomJSON{
+			Name:        snap.Room.Name,
+			Description: snap.Room.Description,
+			Port:        snap.Room.Port,
+			PlayerLimit: snap.Room.PlayerLimit,
+			Running:     snap.Running && snap.Problem == "" && snap.Down == "",
+			Down:        snap.Down,
+			Players:     []playerJSON{},
+		}
+		if !snap.Updated.IsZero() {
+			updated := snap.Updated
+			room.Updated = &updated
+		}
+		for _, player := range snap.Players {
+			room.Players = append(room.Players, playerJSON{
+				Name:      cachedDisplayName(player),
+				Character: player.Character,
+				Spectator: player.Spectator,
+				Scene:     player.Scene,
+			})
+		}
+		result = append(result, room)
+	}
+	return result
+}
+
+// cachedDisplayName is displayName with a cache, so dashboard refreshes don't
+// search the guild members every time.
+func cachedDisplayName(player PlayerPresence) string {
+	if player.Username == "" {
+		return ownersDisplayName(player, cachedDisplayName)
+	}
+
+	displayNameMutex.Lock()
+	cached, ok := displayNameCache[player.Username]
+	displayNameMutex.Unlock()
+	if ok && time.Since(cached.fetched) < displayNameTTL {
+		return cached.name
+	}
+
+	name := displayName(player)
+	displayNameMutex.Lock()
+	displayNameCache[player.Username] = cachedName{name: name, fetched: time.Now()}
+	displayNameMutex.Unlock()
+	return name
+}
+
+// handleRoomsAPI serves the live state of every room as JSON.
+func handleRoomsAPI(w http.ResponseWriter, r *http.Request) {
+	snaps, err := currentSnapshots()
+	if err != nil {
+		log.Println("Error getting game status:", err)
+		http.Error(w, "error retrieving game status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(struct {
+		Rooms []roomJSON `json:"rooms"`
+	}{roomsToJSON(snaps)})
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="20">
+<title>VaM Multiplayer rooms</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #1e1f22; color: #dbdee1; }
+.room { margin-bottom: 1.5em; }
+.muted { color: #949ba4; }
+</style>
+</head>
+<body>
+<h1>VaM Multiplayer rooms</h1>
+{{range .}}
+<div class="room">
+<h2>{{.Name}}{{if .Description}} <span class="muted">{{.Description}}</span>{{end}}</h2>
+{{if .Down}}<p class="muted">Down ({{.Down}}).</p>
+{{else if not .Running}}<p class="muted">Not running.</p>
+{{else}}
+<p class="muted">Port {{.Port}}{{if .PlayerLimit}}, up to {{.PlayerLimit}} players{{end}}{{if .Updated}}, updated {{.Updated.Format "Mon, 02 Jan 2006 15:04:05 MST"}}{{end}}</p>
+{{if .Players}}<ul>
+{{range .Players}}<li>{{.Name}} {{if .Spectator}}is spectating{{else}}controls {{.Character}}{{end}}{{if .Scene}} <span class="muted">on {{.Scene}}</span>{{end}}</li>
+{{end}}</ul>
+{{else}}<p>Empty.</p>{{end}}
+{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// handleDashboard serves a simple HTML page with the room state.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	snaps, err := currentSnapshots()
+	if err != nil {
+		log.Println("Error getting game status:", err)
+		http.Error(w, "error retrieving game status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, roomsToJSON(snaps)); err != nil {
+		log.Println("Error rendering dashboard:", err)
+	}
+}
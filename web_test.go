@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomsAPI(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "Ally")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1700000000, "8.8.8.8:5000:Player1:Hotel,7.7.7.7:5001:@SPECTATOR@")
+
+	rec := httptest.NewRecorder()
+	httpMux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/rooms", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "8.8.8.8") || strings.Contains(body, "7.7.7.7") {
+		t.Errorf("API response exposes player IPs: %s", body)
+	}
+
+	var resp struct {
+		Rooms []roomJSON `json:"rooms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rooms) != 2 {
+		t.Fatalf("rooms = %+v", resp.Rooms)
+	}
+	room1, room2 := resp.Rooms[0], resp.Rooms[1]
+	if !room1.Running || room1.Updated == nil || room1.Updated.Unix() != 1700000000 {
+		t.Errorf("room1 = %+v", room1)
+	}
+	want := []playerJSON{
+		{Name: "Ally", Character: "Player1", Scene: "Hotel"},
+		{Name: "unknown", Spectator: true},
+	}
+	if len(room1.Players) != 2 || room1.Players[0] != want[0] || room1.Players[1] != want[1] {
+		t.Errorf("room1 players = %+v, want %+v", room1.Players, want)
+	}
+	if room2.Running || room2.Players == nil || len(room2.Players) != 0 {
+		t.Errorf("room2 = %+v, want not running with an empty player list", room2)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	b := newTestBot(t)
+	b.fake.addMember("1", "alice", "<b>Ally</b>")
+	store.RegisterIP("8.8.8.8", "", "alice", defaultDevice, time.Now())
+	b.appendStatus(t, "room1", 1700000000, "8.8.8.8:5000:Player1:Hotel")
+
+	rec := httptest.NewRecorder()
+	httpMux.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "&lt;b&gt;Ally&lt;/b&gt; controls Player1") {
+		t.Errorf("dashboard does not show the escaped nickname:\n%s", body)
+	}
+	if strings.Contains(body, "8.8.8.8") {
+		t.Errorf("dashboard exposes a player IP")
+	}
+
+	rec = httptest.NewRecorder()
+	httpMux.ServeHTTP(rec, httptest.NewRequest("GET", "/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown path status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServeHTTPReportsListenErrors(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := serveHTTP(ctx, taken.Addr().String(), httpMux); err == nil {
+		t.Error("serveHTTP on an address in use returned nil")
+	}
+}